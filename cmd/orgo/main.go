@@ -2,7 +2,14 @@ package main
 
 import (
 	"context"
+	"expvar"
+	"flag"
+	"fmt"
 	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
 
 	log "github.com/Sirupsen/logrus"
 	oauth2google "golang.org/x/oauth2/google"
@@ -12,6 +19,7 @@ import (
 	"github.com/gorilla/sessions"
 	"github.com/joeshaw/envdecode"
 	"github.com/rsampaio/orgo/conf"
+	orgodb "github.com/rsampaio/orgo/db"
 	"github.com/rsampaio/orgo/dropbox"
 	"github.com/rsampaio/orgo/google"
 	"github.com/rsampaio/orgo/web"
@@ -19,19 +27,70 @@ import (
 	"golang.org/x/oauth2"
 )
 
+var (
+	showPlans = flag.String("plans", "", "print the sync plans of a user waiting for review and exit")
+	applyPlan = flag.Int64("apply", 0, "queue a sync plan waiting for review to be applied and exit")
+	migrate   = flag.Bool("migrate", false, "migrate the database schema and exit")
+	ephemeral = flag.Bool("ephemeral", false, "keep every record in memory, for trying orgo locally")
+)
+
 func main() {
 	var (
 		cfg  conf.Config
 		urls map[string]string
 	)
 
+	flag.Parse()
+
 	err := envdecode.Decode(&cfg)
 	if err != nil {
 		log.Fatal(err.Error())
 	}
 
+	if *ephemeral {
+		cfg.DatabaseURL = "memory://"
+		log.Warn("running ephemeral, every record is lost on exit")
+	}
+
+	// Tokens are encrypted by the database when there are keys
+	var keyring *orgodb.Keyring
+	if cfg.TokenKeys != "" {
+		if keyring, err = orgodb.NewKeyring(cfg.TokenKeyID, cfg.TokenKeys); err != nil {
+			log.Fatal(err.Error())
+		}
+	}
+
+	// Every component shares the database
+	database, err := orgodb.Open(cfg.DatabaseURL, keyring)
+	if err != nil {
+		log.Fatalf("open database: %s", err.Error())
+	}
+	defer database.Close()
+
+	if cfg.DBMigrate || *migrate {
+		migrateDB(database)
+		if *migrate {
+			return
+		}
+	} else if version, err := database.SchemaVersion(); err != nil || version < database.LatestVersion() {
+		log.Warnf("database schema at version %d of %d, run orgo -migrate", version, database.LatestVersion())
+	}
+
+	if keyring != nil {
+		// Tokens in plaintext or encrypted with an older key are encrypted with the current key
+		encrypted, err := database.EncryptTokens()
+		if err != nil {
+			log.Fatalf("encrypt tokens: %s", err.Error())
+		}
+		log.Infof("encrypted %d tokens with key %s", encrypted, keyring.Current())
+	} else {
+		log.Warn("TOKEN_KEYS not set, tokens are stored in plaintext")
+	}
+
 	ctx := context.Background()
 	store := sessions.NewCookieStore([]byte(cfg.HTTPCookieSecret))
+	store.Options.MaxAge = int(cfg.SessionTTL.Seconds())
+	store.Options.HttpOnly = true
 
 	googleOauth := &oauth2.Config{
 		ClientID:     cfg.Google.APIKey,
@@ -46,34 +105,133 @@ func main() {
 		ClientSecret: cfg.Dropbox.APISecret,
 		RedirectURL:  cfg.Dropbox.RedirectURL,
 		Endpoint: oauth2.Endpoint{
-			AuthURL:  "https://www.dropbox.com/1/oauth2/authorize",
-			TokenURL: "https://api.dropbox.com/1/oauth2/token",
+			AuthURL:  "https://www.dropbox.com/oauth2/authorize",
+			TokenURL: "https://api.dropboxapi.com/oauth2/token",
 		},
 	}
 
-	// Buffered work chan for async producers
-	worker := work.NewWorker(googleOauth, dropboxOauth)
+	// Jobs queued by the handlers are run by the worker
+	worker := work.NewWorker(googleOauth, dropboxOauth, database)
+	worker.DeleteThreshold = cfg.Sync.DeleteThreshold
+	worker.DeleteMinimum = cfg.Sync.DeleteMinimum
+	worker.TrashRetention = cfg.Sync.TrashRetention
+	worker.Workers = cfg.Sync.Workers
+
+	if *showPlans != "" {
+		printPlans(database, *showPlans)
+		return
+	}
+
+	if *applyPlan != 0 {
+		queueApply(database, *applyPlan)
+		return
+	}
 
 	go worker.WaitWork()
 
-	dropboxHandler := dropbox.NewDropboxHandler(dropboxOauth, worker.WorkChan, store)
-	googleHandler := google.NewGoogleHandler(googleOauth, store)
+	// Queue depth and jobs in flight are served in /debug/vars
+	expvar.Publish("worker", expvar.Func(func() interface{} {
+		return worker.Stats()
+	}))
+
+	dropboxHandler := dropbox.NewDropboxHandler(dropboxOauth, store, database)
+	googleHandler := google.NewGoogleHandler(googleOauth, store, database)
+	googleHandler.SessionTTL = cfg.SessionTTL
+	googleHandler.SessionIdle = cfg.SessionIdle
 
 	urls = map[string]string{
-		"Dropbox": dropboxHandler.AuthCodeURL(),
-		"Google":  googleHandler.AuthCodeURL(),
+		"Dropbox": "/dropbox/login",
 	}
 
-	handler := web.NewHandler(ctx, store, urls)
+	handler := web.NewHandler(ctx, store, urls, database)
+	handler.SessionIdle = cfg.SessionIdle
 
 	// Default handler
 	http.HandleFunc("/dropbox/webhook", dropboxHandler.WebhookHandler)
+	http.HandleFunc("/dropbox/login", dropboxHandler.LoginHandler)
 	http.HandleFunc("/dropbox/oauth", dropboxHandler.OauthHandler)
+	http.HandleFunc("/google/state", googleHandler.StateHandler)
 	http.HandleFunc("/google/oauth", googleHandler.OauthHandler)
+	http.HandleFunc("/api/mappings", handler.MappingsHandler)
+	http.HandleFunc("/api/plans", handler.PlansHandler)
+	http.HandleFunc("/api/plans/apply", handler.PlanActionHandler)
+	http.HandleFunc("/api/plans/discard", handler.PlanActionHandler)
+	http.HandleFunc("/api/settings", handler.SettingsHandler)
+	http.HandleFunc("/api/trash", handler.TrashHandler)
+	http.HandleFunc("/api/trash/restore", handler.RestoreHandler)
+	http.HandleFunc("/api/syncs", handler.SyncsHandler)
+	http.HandleFunc("/api/disconnect", handler.DisconnectHandler)
+	http.HandleFunc("/api/sessions/revoke", handler.RevokeSessionHandler)
+	http.HandleFunc("/api/timezone", handler.TimezoneHandler)
+	http.HandleFunc("/logout", handler.LogoutHandler)
 	fs := http.FileServer(http.Dir("static"))
 	http.Handle("/static/", http.StripPrefix("/static/", fs))
 	templateHandler := http.HandlerFunc(handler.TemplateHandler)
 	http.Handle("/", handler.IndexMiddleware(templateHandler))
 
-	log.Fatal(http.ListenAndServe(":8080", nil).Error())
+	srv := &http.Server{Addr: ":8080"}
+	go func() {
+		if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+			log.Fatal(err.Error())
+		}
+	}()
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	log.Infof("shutting down: %s", <-sig)
+
+	// Requests are drained before the running jobs, both within the timeout
+	shutdown, cancel := context.WithTimeout(ctx, cfg.ShutdownTimeout)
+	defer cancel()
+
+	if err := srv.Shutdown(shutdown); err != nil {
+		log.Errorf("http shutdown: %s", err.Error())
+	}
+
+	if err := worker.Shutdown(shutdown); err != nil {
+		log.Errorf("worker shutdown: %s", err.Error())
+	}
+}
+
+// printPlans prints the plans waiting for review of an user.
+func printPlans(database orgodb.Store, userID string) {
+	plans, err := database.GetPendingPlans(userID)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+
+	for _, stored := range plans {
+		plan, err := work.LoadPlan(stored)
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+		fmt.Println(plan)
+	}
+}
+
+// queueApply queues a job applying a plan, the plan is applied by a
+// running worker holding the lease of the user like any other sync.
+func queueApply(database orgodb.Store, id int64) {
+	plan, err := database.GetPlan(id)
+	if err != nil {
+		log.Fatalf("plan %d: %s", id, err.Error())
+	}
+
+	job, err := database.EnqueueJob(orgodb.JobApply, plan.UserID, strconv.FormatInt(id, 10), id)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	log.Infof("plan %d queued in job %d", id, job)
+}
+
+// migrateDB migrates the database schema to the latest version.
+func migrateDB(database orgodb.Store) {
+	applied, err := database.Migrate()
+	if err != nil {
+		log.Fatalf("migrate: %s", err.Error())
+	}
+
+	if applied > 0 {
+		log.Infof("applied %d migrations, schema at version %d", applied, database.LatestVersion())
+	}
 }
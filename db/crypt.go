@@ -0,0 +1,113 @@
+package db
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Keyring holds the keys encrypting the data keys of tokens, new data keys are
+// encrypted with the current key and the others decrypt keys being rotated out.
+type Keyring struct {
+	current string
+	keys    map[string][]byte
+}
+
+// NewKeyring parses keys in the form "id:base64key,id:base64key", the keys
+// are 32 bytes long and current is the id of the key encrypting new tokens.
+func NewKeyring(current, keys string) (*Keyring, error) {
+	k := &Keyring{current: current, keys: map[string][]byte{}}
+	for _, pair := range strings.Split(keys, ",") {
+		parts := strings.SplitN(strings.TrimSpace(pair), ":", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid key %q, expected id:base64key", pair)
+		}
+
+		key, err := base64.StdEncoding.DecodeString(parts[1])
+		if err != nil {
+			return nil, errors.Wrapf(err, "decode key %s", parts[0])
+		}
+		if len(key) != 32 {
+			return nil, fmt.Errorf("key %s must be 32 bytes long, got %d", parts[0], len(key))
+		}
+		k.keys[parts[0]] = key
+	}
+
+	if _, ok := k.keys[current]; !ok {
+		return nil, fmt.Errorf("current key %q not in keyring", current)
+	}
+	return k, nil
+}
+
+// Current returns the id of the key encrypting new tokens.
+func (k *Keyring) Current() string {
+	return k.current
+}
+
+// newDataKey returns a random data key and the data key encrypted with the current key.
+func (k *Keyring) newDataKey() ([]byte, string, error) {
+	dataKey := make([]byte, 32)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, "", err
+	}
+
+	wrapped, err := seal(k.keys[k.current], dataKey, []byte(k.current))
+	if err != nil {
+		return nil, "", err
+	}
+	return dataKey, wrapped, nil
+}
+
+// dataKey decrypts a data key encrypted with the key keyID.
+func (k *Keyring) dataKey(keyID, wrapped string) ([]byte, error) {
+	key, ok := k.keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("key %q not in keyring", keyID)
+	}
+	return open(key, wrapped, []byte(keyID))
+}
+
+// seal encrypts plaintext with AES-GCM, returning the nonce and ciphertext in base64,
+// data is authenticated and must be the same to open it.
+func seal(key, plaintext, data []byte) (string, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(gcm.Seal(nonce, nonce, plaintext, data)), nil
+}
+
+// open decrypts a value encrypted by seal.
+func open(key []byte, sealed string, data []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	raw, err := base64.StdEncoding.DecodeString(sealed)
+	if err != nil {
+		return nil, err
+	}
+	if len(raw) < gcm.NonceSize() {
+		return nil, errors.New("encrypted value too short")
+	}
+	return gcm.Open(nil, raw[:gcm.NonceSize()], raw[gcm.NonceSize():], data)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
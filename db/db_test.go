@@ -1,28 +1,89 @@
 package db
 
 import (
+	"bytes"
+	"encoding/base64"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"golang.org/x/oauth2"
+	db "upper.io/db.v3"
 )
 
+// TestDB runs the store tests on SQLite, in memory and, when ORGO_TEST_POSTGRES
+// has the DSN of a database the tests can drop, on PostgreSQL.
 func TestDB(t *testing.T) {
-	d := NewDB("/tmp/orgo-test.db")
-	defer os.RemoveAll("/tmp/orgo-test.db")
-	defer d.Close()
-	if d == nil || d.sess == nil {
-		t.Fatal("failed to open db")
-	}
+	t.Run("SQLite", func(t *testing.T) {
+		file, remove := tempFile(t)
+		defer remove()
 
-	err := d.createTables()
-	if err != nil {
+		d, err := Open(file, nil)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		defer d.Close()
+
+		// Readers do not block the writer
+		row, err := d.(*DB).sess.QueryRow("PRAGMA journal_mode")
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		var mode string
+		if err := row.Scan(&mode); err != nil || mode != "wal" {
+			t.Fatalf("journal mode %q: %v, want wal", mode, err)
+		}
+
+		// A database that can not be opened fails instead of returning nil
+		if _, err := NewDB(filepath.Join(file, "missing", "orgo.db"), nil); err == nil {
+			t.Fatal("database in a missing directory opened")
+		}
+
+		testStore(t, d)
+	})
+
+	t.Run("Memory", func(t *testing.T) {
+		d, err := Open("memory://", nil)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		defer d.Close()
+
+		testStore(t, d)
+	})
+
+	t.Run("PostgreSQL", func(t *testing.T) {
+		dsn := os.Getenv("ORGO_TEST_POSTGRES")
+		if dsn == "" {
+			t.Skip("ORGO_TEST_POSTGRES not set")
+		}
+
+		d, err := Open(dsn, nil)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		defer d.Close()
+
+		// Tables of a previous run are dropped
+		if _, err := d.(*DB).sess.Exec("drop schema public cascade; create schema public"); err != nil {
+			t.Fatal(err.Error())
+		}
+
+		testStore(t, d)
+	})
+}
+
+func testStore(t *testing.T, d Store) {
+	if _, err := d.Migrate(); err != nil {
 		t.Fatal(err.Error())
 	}
 
 	t.Run("SessionSaveGet", func(t *testing.T) {
-		sessionID, err := d.SaveSession("user1")
+		sessionID, err := d.SaveSession("user1", "agent", time.Hour, time.Minute)
 		if err != nil {
 			t.Fatal(err.Error())
 		}
@@ -36,21 +97,99 @@ func TestDB(t *testing.T) {
 			t.Fatal("session user invalid")
 		}
 
-	})
+		if _, err := d.GetSession("unknown"); err != db.ErrNoMoreRows {
+			t.Fatalf("unknown session: %v", err)
+		}
+
+		if u, err := d.TouchSession(sessionID, time.Minute); err != nil || u != "user1" {
+			t.Fatalf("touch session: %q %v", u, err)
+		}
+
+		sessions, err := d.GetSessions("user1")
+		if err != nil || len(sessions) != 1 || sessions[0].UserAgent != "agent" {
+			t.Fatalf("sessions %v %v, want the active one", sessions, err)
+		}
 
-	t.Run("GoogleDropboxMap", func(t *testing.T) {
-		err := d.SaveGoogleDropbox("google1", "dropbox1")
+		if handle := sessions[0].Handle(); handle == "" || strings.Contains(handle, sessionID) {
+			t.Fatalf("handle %q of session %s, want it without the id", handle, sessionID)
+		}
+
+		// Sessions idle for longer than the idle timeout expire
+		idle, err := d.SaveSession("user1", "agent", time.Hour, -time.Second)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if _, err := d.TouchSession(idle, time.Minute); err == nil {
+			t.Fatal("idle session touched")
+		}
+
+		// Sessions expire after their ttl even when used
+		expired, err := d.SaveSession("user1", "agent", -time.Second, time.Minute)
 		if err != nil {
 			t.Fatal(err.Error())
 		}
+		if _, err := d.GetSession(expired); err == nil {
+			t.Fatal("expired session found")
+		}
+
+		if err := d.PurgeSessions(time.Now()); err != nil {
+			t.Fatal(err.Error())
+		}
+		if count := storedSessions(d, "user1"); count != 1 {
+			t.Fatalf("%d sessions after purge, want the active one", count)
+		}
+
+		if err := d.DeleteSession(sessionID); err != nil {
+			t.Fatal(err.Error())
+		}
+		if _, err := d.GetSession(sessionID); err == nil {
+			t.Fatal("logged out session found")
+		}
+	})
 
-		d, err := d.GetDropboxID("google1")
+	t.Run("Users", func(t *testing.T) {
+		user, err := d.SignIn("google1", "user@example.com", "User")
 		if err != nil {
 			t.Fatal(err.Error())
 		}
 
-		if d != "dropbox1" {
-			t.Fatal("dropbox user map invalid")
+		// Signing in again returns the same user with the current profile
+		again, err := d.SignIn("google1", "new@example.com", "User")
+		if err != nil || again.ID != user.ID || again.Email != "new@example.com" {
+			t.Fatalf("user %+v %v, want %s signed in again", again, err, user.ID)
+		}
+
+		for _, dropboxID := range []string{"dropbox1", "dropbox2"} {
+			if err := d.LinkAccount(Account{Provider: "dropbox", Account: dropboxID, UserID: user.ID}); err != nil {
+				t.Fatal(err.Error())
+			}
+		}
+
+		accounts, err := d.GetAccounts(user.ID, "dropbox")
+		if err != nil || len(accounts) != 2 {
+			t.Fatalf("accounts %v %v, want both dropbox accounts", accounts, err)
+		}
+
+		if userID, err := d.GetAccountUser("dropbox", "dropbox2"); err != nil || userID != user.ID {
+			t.Fatalf("user of dropbox2 %q %v, want %s", userID, err, user.ID)
+		}
+
+		if googleID, err := d.GetAccountID(user.ID, "google"); err != nil || googleID != "google1" {
+			t.Fatalf("google account %q %v", googleID, err)
+		}
+
+		if err := d.UnlinkAccount("dropbox", "dropbox1"); err != nil {
+			t.Fatal(err.Error())
+		}
+		if accounts, _ := d.GetAccounts(user.ID, "dropbox"); len(accounts) != 1 || accounts[0].Account != "dropbox2" {
+			t.Fatalf("accounts %v, want dropbox2 left", accounts)
+		}
+
+		if err := d.SetTimezone(user.ID, "Europe/Lisbon"); err != nil {
+			t.Fatal(err.Error())
+		}
+		if user, _ := d.GetUser(user.ID); user.Timezone != "Europe/Lisbon" {
+			t.Fatalf("timezone %q, want Europe/Lisbon", user.Timezone)
 		}
 	})
 
@@ -84,6 +223,132 @@ func TestDB(t *testing.T) {
 			t.Fatalf("code is %v, want abc123", to.Code)
 		}
 
+		if err := d.SetNeedsConsent("provider1", "account1"); err != nil {
+			t.Fatal(err.Error())
+		}
+
+		// Authorizing again replaces the token and keeps the refresh token
+		err = d.SaveToken("provider1", "account1", "def456", &oauth2.Token{AccessToken: "token456"})
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+
+		to, err = d.GetToken("provider1", "account1")
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+
+		if to.AccessToken != "token456" || to.RefreshToken != "refresh" || to.NeedsConsent {
+			t.Fatalf("token %+v, want the new token with the old refresh token", to)
+		}
+
+		err = d.UpdateToken("provider1", "account1", &oauth2.Token{AccessToken: "token789", RefreshToken: "refresh2"})
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+
+		if to, _ := d.GetToken("provider1", "account1"); to.AccessToken != "token789" || to.RefreshToken != "refresh2" {
+			t.Fatalf("token %+v, want the refreshed token", to)
+		}
+
+		// The same account id at another provider has its own token
+		if err := d.SaveToken("provider2", "account1", "ghi789", &oauth2.Token{AccessToken: "other"}); err != nil {
+			t.Fatal(err.Error())
+		}
+
+		if to, err := d.GetToken("provider2", "account1"); err != nil || to.AccessToken != "other" || to.RefreshToken != "" {
+			t.Fatalf("token %+v %v, want the token of provider2", to, err)
+		}
+
+		if to, err := d.GetToken("provider1", "account1"); err != nil || to.AccessToken != "token789" {
+			t.Fatalf("token %+v %v, want the token of provider1 kept", to, err)
+		}
+	})
+
+	t.Run("TokenEncryption", func(t *testing.T) {
+		defer useKeyring(d, nil)
+
+		if err := d.SaveToken("provider1", "account2", "code", &oauth2.Token{AccessToken: "plain", RefreshToken: "refresh"}); err != nil {
+			t.Fatal(err.Error())
+		}
+
+		first, err := NewKeyring("k1", "k1:"+base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 32)))
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		useKeyring(d, first)
+
+		// Tokens saved in plaintext are encrypted with the current key
+		if n, err := d.EncryptTokens(); err != nil || n == 0 {
+			t.Fatalf("encrypted %d tokens: %v", n, err)
+		}
+
+		stored, err := storedToken(d, "account2")
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if stored.KeyID != "k1" || stored.AccessToken == "plain" || stored.RefreshToken == "refresh" {
+			t.Fatalf("stored token %+v, want it encrypted with k1", stored)
+		}
+
+		if to, err := d.GetToken("provider1", "account2"); err != nil || to.AccessToken != "plain" || to.RefreshToken != "refresh" {
+			t.Fatalf("token %+v %v, want it decrypted", to, err)
+		}
+
+		// Rotating re-encrypts with the new key, the old one still decrypts until then
+		second, err := NewKeyring("k2", "k1:"+base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 32))+",k2:"+base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{2}, 32)))
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		useKeyring(d, second)
+
+		if to, err := d.GetToken("provider1", "account2"); err != nil || to.AccessToken != "plain" {
+			t.Fatalf("token %+v %v, want it decrypted with k1", to, err)
+		}
+
+		if n, err := d.EncryptTokens(); err != nil || n == 0 {
+			t.Fatalf("encrypted %d tokens: %v", n, err)
+		}
+		if n, _ := d.EncryptTokens(); n != 0 {
+			t.Fatalf("encrypted %d tokens again, want none", n)
+		}
+
+		if err := d.UpdateToken("provider1", "account2", &oauth2.Token{AccessToken: "refreshed", RefreshToken: "refresh"}); err != nil {
+			t.Fatal(err.Error())
+		}
+		if to, err := d.GetToken("provider1", "account2"); err != nil || to.AccessToken != "refreshed" {
+			t.Fatalf("token %+v %v, want the refreshed token", to, err)
+		}
+
+		if _, err := NewKeyring("k3", "k1:"+base64.StdEncoding.EncodeToString([]byte("short"))); err == nil {
+			t.Fatal("keyring with a short key and without the current key")
+		}
+
+		// Tokens are bound to their provider and account
+		swapped := Token{Provider: "provider1", Account: "account2", AccessToken: "access"}
+		if err := swapped.encrypt(second); err != nil {
+			t.Fatal(err.Error())
+		}
+		swapped.Provider = "provider2"
+		if err := swapped.decrypt(second); err == nil {
+			t.Fatal("token decrypted for another provider")
+		}
+
+		// Tokens authenticating only the account still decrypt
+		dataKey, wrapped, err := second.newDataKey()
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		legacy := Token{Provider: "provider1", Account: "account2", KeyID: "k2", DataKey: wrapped}
+		if legacy.AccessToken, err = seal(dataKey, []byte("access"), []byte("account2")); err != nil {
+			t.Fatal(err.Error())
+		}
+		if legacy.RefreshToken, err = seal(dataKey, []byte("refresh"), []byte("account2")); err != nil {
+			t.Fatal(err.Error())
+		}
+		if err := legacy.decrypt(second); err != nil || legacy.AccessToken != "access" || !legacy.legacy {
+			t.Fatalf("legacy token %+v: %v, want it decrypted", legacy, err)
+		}
 	})
 
 	t.Run("EntrySaveGet", func(t *testing.T) {
@@ -91,6 +356,10 @@ func TestDB(t *testing.T) {
 			ti    = time.Now()
 			entry = &OrgEntry{
 				UserID:    "test@email.com",
+				FileID:    "id:file",
+				File:      "/file.org",
+				Outline:   "Tasks",
+				Line:      2,
 				Title:     "title",
 				Tag:       "tag",
 				Priority:  "prio",
@@ -106,7 +375,7 @@ func TestDB(t *testing.T) {
 			t.Fatal(err.Error())
 		}
 
-		entry1, err := d.GetEntry("title", "test@email.com")
+		entry1, err := d.GetEntry("test@email.com", "id:file", "title")
 		if err != nil {
 			t.Fatal(err.Error())
 		}
@@ -114,5 +383,686 @@ func TestDB(t *testing.T) {
 		if entry1 == nil {
 			t.Fatal("entry is nil")
 		}
+
+		if entry1.File != "/file.org" || entry1.Line != 2 {
+			t.Fatalf("entry location %s:%d, want /file.org:2", entry1.File, entry1.Line)
+		}
+
+		// same title in another file does not collide
+		entry.FileID = "id:other"
+		if err := d.SaveEntry(entry); err != nil {
+			t.Fatal(err.Error())
+		}
+	})
+
+	t.Run("FileEntries", func(t *testing.T) {
+		entries := []*OrgEntry{
+			{UserID: "user1", FileID: "id:file1", Title: "** TODO one"},
+			{UserID: "user1", FileID: "id:file1", Title: "** TODO two"},
+		}
+
+		if err := d.ReplaceFileEntries("user1", "id:file1", entries); err != nil {
+			t.Fatal(err.Error())
+		}
+
+		if err := d.ReplaceFileEntries("user1", "id:file1", entries[1:]); err != nil {
+			t.Fatal(err.Error())
+		}
+
+		stored, err := d.GetFileEntries("user1", "id:file1")
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+
+		if len(stored) != 1 || stored[0].Title != "** TODO two" {
+			t.Fatalf("file entries %v, want only the second entry", stored)
+		}
+
+		if err := d.DeleteFileEntries("user1", "id:file1"); err != nil {
+			t.Fatal(err.Error())
+		}
+
+		stored, err = d.GetFileEntries("user1", "id:file1")
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+
+		if len(stored) != 0 {
+			t.Fatalf("file entries not deleted: %v", stored)
+		}
+	})
+
+	t.Run("DropboxFiles", func(t *testing.T) {
+		err := d.SaveFile(DropboxFile{Account: "dropbox1", FileID: "id:file1", Path: "/a.org"})
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+
+		// rename keeps the same id
+		err = d.SaveFile(DropboxFile{Account: "dropbox1", FileID: "id:file1", Path: "/b.org"})
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+
+		f, err := d.GetFile("dropbox1", "id:file1")
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+
+		if f.Path != "/b.org" {
+			t.Fatalf("path is %v, want /b.org", f.Path)
+		}
+
+		if err := d.DeleteFile("dropbox1", "id:file1"); err != nil {
+			t.Fatal(err.Error())
+		}
+
+		files, err := d.GetFiles("dropbox1")
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+
+		if len(files) != 0 {
+			t.Fatalf("files not deleted: %v", files)
+		}
+	})
+
+	t.Run("DropboxCursor", func(t *testing.T) {
+		for _, c := range []string{"cursor1", "cursor2"} {
+			if err := d.SaveCursor("dropbox1", c); err != nil {
+				t.Fatal(err.Error())
+			}
+		}
+
+		c, err := d.GetCursor("dropbox1")
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+
+		if c != "cursor2" {
+			t.Fatalf("cursor is %v, want cursor2", c)
+		}
+	})
+
+	t.Run("TasklistMappings", func(t *testing.T) {
+		for _, list := range []string{"home", "work"} {
+			err := d.SaveMapping(TasklistMapping{UserID: "user1", Kind: MappingTag, Value: "work", Tasklist: list})
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+		}
+
+		mappings, err := d.GetMappings("user1")
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+
+		if len(mappings) != 1 || mappings[0].Tasklist != "work" {
+			t.Fatalf("mappings %v, want a single mapping to work", mappings)
+		}
+
+		if err := d.DeleteMapping("user1", MappingTag, "work"); err != nil {
+			t.Fatal(err.Error())
+		}
+	})
+
+	t.Run("Tasklists", func(t *testing.T) {
+		err := d.SaveTasklist(Tasklist{UserID: "user1", Title: "work", ListID: "list1"})
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+
+		lists, err := d.GetTasklists("user1")
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+
+		if len(lists) != 1 || lists[0].ListID != "list1" {
+			t.Fatalf("tasklists %v", lists)
+		}
+
+		if err := d.DeleteTasklist("user1", "list1"); err != nil {
+			t.Fatal(err.Error())
+		}
+	})
+
+	t.Run("Settings", func(t *testing.T) {
+		s, err := d.GetSettings("user1")
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+
+		if s.AlwaysPreview {
+			t.Fatal("preview should be disabled by default")
+		}
+
+		if s.Tasklist != DefaultTasklist || s.Deletion != DefaultDeletion || len(s.DoneKeywords) != 1 || s.DoneKeywords[0] != "DONE" {
+			t.Fatalf("unexpected default settings %+v", s)
+		}
+
+		s.AlwaysPreview = true
+		s.Tasklist = "inbox"
+		s.Folders = List{"/notes", "/work"}
+		s.DoneKeywords = List{"DONE", "CANCELLED"}
+		s.Deletion = DeletionReview
+		if err := s.Validate(); err != nil {
+			t.Fatal(err.Error())
+		}
+
+		if err := d.SaveSettings(s); err != nil {
+			t.Fatal(err.Error())
+		}
+
+		s, err = d.GetSettings("user1")
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+
+		if !s.AlwaysPreview {
+			t.Fatal("preview setting not saved")
+		}
+
+		if s.Tasklist != "inbox" || s.Deletion != DeletionReview || len(s.Folders) != 2 || len(s.DoneKeywords) != 2 || s.DoneKeywords[1] != "CANCELLED" {
+			t.Errorf("settings not saved %+v", s)
+		}
+
+		if !s.InFolders("/notes/tasks.org") || s.InFolders("/notesbook/tasks.org") {
+			t.Errorf("folders %v matched", s.Folders)
+		}
+
+		s.Deletion = "never"
+		if err := s.Validate(); err == nil {
+			t.Error("unknown deletion policy is valid")
+		}
+	})
+
+	t.Run("Plans", func(t *testing.T) {
+		first, err := d.SavePlan(StoredPlan{UserID: "user1", FileID: "id:file1", Created: time.Now(), Data: "{}"})
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+
+		second, err := d.SavePlan(StoredPlan{UserID: "user1", FileID: "id:file1", Created: time.Now(), Data: "{}"})
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+
+		plans, err := d.GetPendingPlans("user1")
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+
+		if len(plans) != 1 || plans[0].ID != second || first == second {
+			t.Fatalf("pending plans %v, want only plan %d", plans, second)
+		}
+
+		if replaced, err := d.GetPlan(first); err != nil || replaced.Status != PlanDiscarded {
+			t.Fatalf("replaced plan %v: %v, want it discarded", replaced, err)
+		}
+
+		if err := d.SetPlanStatus(second, PlanApplied); err != nil {
+			t.Fatal(err.Error())
+		}
+
+		p, err := d.GetPlan(second)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+
+		if p.Status != PlanApplied {
+			t.Fatalf("plan status %s, want %s", p.Status, PlanApplied)
+		}
+	})
+
+	t.Run("Trash", func(t *testing.T) {
+		old := TrashEntry{UserID: "user1", Title: "old", Deleted: time.Now().Add(-48 * time.Hour), Data: "{}"}
+		recent := TrashEntry{UserID: "user1", Title: "recent", Deleted: time.Now(), Data: "{}"}
+		for _, e := range []TrashEntry{old, recent} {
+			if err := d.SaveTrash(e); err != nil {
+				t.Fatal(err.Error())
+			}
+		}
+
+		if err := d.PurgeTrash(time.Now().Add(-24 * time.Hour)); err != nil {
+			t.Fatal(err.Error())
+		}
+
+		trash, err := d.GetTrash("user1")
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+
+		if len(trash) != 1 || trash[0].Title != "recent" {
+			t.Fatalf("trash %v, want only the recent entry", trash)
+		}
+
+		if err := d.DeleteTrash(trash[0].ID); err != nil {
+			t.Fatal(err.Error())
+		}
+
+		if _, err := d.GetTrashEntry(trash[0].ID); err == nil {
+			t.Fatal("trash entry not deleted")
+		}
+	})
+
+	t.Run("Jobs", func(t *testing.T) {
+		id, err := d.EnqueueJob(JobProcess, "user1", "account1", "account1")
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+
+		// A burst of jobs for the same topic is coalesced
+		if again, err := d.EnqueueJob(JobProcess, "user1", "account1", "account1"); err != nil || again != id {
+			t.Fatalf("job %d not coalesced into %d", again, id)
+		}
+
+		// Jobs of an account wait for the running one
+		other, err := d.EnqueueJob(JobSync, "user1", "file1", "file1")
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+
+		job, err := d.LeaseJob(time.Minute)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+
+		if job == nil || job.ID != id || job.Payload != `"account1"` || job.Attempts != 1 {
+			t.Fatalf("leased job %v, want job %d", job, id)
+		}
+
+		if next, err := d.LeaseJob(time.Minute); err != nil || next != nil {
+			t.Fatalf("leased job %v while the account is busy", next)
+		}
+
+		if err := d.FailJob(id, job.Lease, "failed", time.Now().Add(-time.Second)); err != nil {
+			t.Fatal(err.Error())
+		}
+
+		// An expired lease makes the job available again
+		job, err = d.LeaseJob(-time.Second)
+		if err != nil || job == nil || job.Attempts != 2 || job.Error != "failed" {
+			t.Fatalf("retried job %v, want second attempt", job)
+		}
+
+		expired := job.Lease
+		job, err = d.LeaseJob(time.Minute)
+		if err != nil || job == nil || job.Attempts != 3 {
+			t.Fatalf("expired job %v, want third attempt", job)
+		}
+
+		// The worker of the expired lease no longer updates the job
+		if err := d.HeartbeatJob(id, expired, time.Minute); err != ErrLeaseLost {
+			t.Fatalf("heartbeat of an expired lease: %v, want ErrLeaseLost", err)
+		}
+
+		if err := d.CompleteJob(id, expired); err != ErrLeaseLost {
+			t.Fatalf("job completed with an expired lease: %v, want ErrLeaseLost", err)
+		}
+
+		if err := d.HeartbeatJob(id, job.Lease, time.Minute); err != nil {
+			t.Fatal(err.Error())
+		}
+
+		if err := d.CompleteJob(id, job.Lease); err != nil {
+			t.Fatal(err.Error())
+		}
+
+		next, err := d.LeaseJob(time.Minute)
+		if err != nil || next == nil || next.ID != other {
+			t.Fatalf("leased job %v, want job %d", next, other)
+		}
+
+		if err := d.ReleaseJob(other, next.Lease); err != nil {
+			t.Fatal(err.Error())
+		}
+
+		next, err = d.LeaseJob(time.Minute)
+		if err != nil || next == nil || next.ID != other || next.Attempts != 1 {
+			t.Fatalf("released job %v, want job %d leased again without counting the attempt", next, other)
+		}
+
+		if err := d.CompleteJob(other, next.Lease); err != nil {
+			t.Fatal(err.Error())
+		}
+
+		if n, err := d.CountJobs(JobDone); err != nil || n != 2 {
+			t.Fatalf("%d jobs done, want 2", n)
+		}
+
+		if err := d.PurgeJobs(time.Now().Add(time.Second)); err != nil {
+			t.Fatal(err.Error())
+		}
+
+		if _, err := d.GetJob(id); err == nil {
+			t.Fatal("completed job not purged")
+		}
+	})
+
+	t.Run("ConcurrentLease", func(t *testing.T) {
+		for _, account := range []string{"user7", "user8"} {
+			for _, topic := range []string{"file1", "file2", "file3"} {
+				if _, err := d.EnqueueJob(JobSync, account, topic, topic); err != nil {
+					t.Fatal(err.Error())
+				}
+			}
+		}
+
+		var (
+			mu     sync.Mutex
+			wg     sync.WaitGroup
+			leased []*Job
+		)
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < 4; j++ {
+					// Workers racing on SQLite may find the database locked, they poll again
+					job, err := d.LeaseJob(time.Minute)
+					if err != nil || job == nil {
+						continue
+					}
+
+					mu.Lock()
+					leased = append(leased, job)
+					mu.Unlock()
+				}
+			}()
+		}
+		wg.Wait()
+
+		// Each account runs a single job at a time
+		accounts := make(map[string]bool)
+		for _, job := range leased {
+			if accounts[job.Account] {
+				t.Errorf("job %d leased while another job of %s runs", job.ID, job.Account)
+			}
+			accounts[job.Account] = true
+
+			if err := d.CompleteJob(job.ID, job.Lease); err != nil {
+				t.Fatal(err.Error())
+			}
+		}
+
+		for _, account := range []string{"user7", "user8"} {
+			if err := d.CancelJobs(account, JobSync); err != nil {
+				t.Fatal(err.Error())
+			}
+		}
+	})
+
+	t.Run("SyncRuns", func(t *testing.T) {
+		run := &SyncRun{UserID: "user1", Kind: JobProcess, Started: time.Now()}
+		if err := d.StartRun(run); err != nil {
+			t.Fatal(err.Error())
+		}
+
+		run.Status = RunFailed
+		run.Files = 2
+		run.Errors = []SyncError{{Class: ErrorParse, File: "/todo.org", Line: 3, Message: "bad"}}
+		if err := d.FinishRun(run); err != nil {
+			t.Fatal(err.Error())
+		}
+
+		runs, err := d.GetRuns("user1", 10)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+
+		if len(runs) != 1 || runs[0].Status != RunFailed || runs[0].Files != 2 {
+			t.Fatalf("runs %v, want the failed run", runs)
+		}
+
+		if len(runs[0].Errors) != 1 || runs[0].Errors[0].Line != 3 {
+			t.Fatalf("run errors %v, want the parse error", runs[0].Errors)
+		}
+
+		if err := d.PurgeRuns(time.Now().Add(time.Second)); err != nil {
+			t.Fatal(err.Error())
+		}
+
+		if runs, _ := d.GetRuns("user1", 10); len(runs) != 0 {
+			t.Fatalf("runs %v not purged", runs)
+		}
+	})
+
+	t.Run("Diagnostics", func(t *testing.T) {
+		diagnostics := []Diagnostic{
+			{UserID: "user1", FileID: "id:1", File: "/todo.org", Line: 2, Column: 14, Severity: "error", Message: "bad"},
+		}
+		if err := d.ReplaceDiagnostics("user1", "id:1", diagnostics); err != nil {
+			t.Fatal(err.Error())
+		}
+
+		stored, err := d.GetDiagnostics("user1")
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+
+		if len(stored) != 1 || stored[0].Line != 2 || stored[0].Column != 14 {
+			t.Fatalf("diagnostics %v, want the stored one", stored)
+		}
+
+		if err := d.ReplaceDiagnostics("user1", "id:1", nil); err != nil {
+			t.Fatal(err.Error())
+		}
+
+		if stored, _ := d.GetDiagnostics("user1"); len(stored) != 0 {
+			t.Fatalf("diagnostics %v not replaced", stored)
+		}
+	})
+
+	t.Run("Disconnect", func(t *testing.T) {
+		if err := d.LinkAccount(Account{Provider: "dropbox", Account: "dropbox3", UserID: "user3"}); err != nil {
+			t.Fatal(err.Error())
+		}
+		if err := d.SaveToken("dropbox", "dropbox3", "code", &oauth2.Token{AccessToken: "token"}); err != nil {
+			t.Fatal(err.Error())
+		}
+		sessionID, err := d.SaveSession("user3", "agent", time.Hour, time.Hour)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		id, err := d.EnqueueJob(JobProcess, "user3", "dropbox3", "dropbox3")
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+
+		if err := d.CancelJobs("user3", JobProcess, JobSync); err != nil {
+			t.Fatal(err.Error())
+		}
+		if _, err := d.GetJob(id); err == nil {
+			t.Fatalf("pending job %d not cancelled", id)
+		}
+
+		if err := d.DeleteToken("dropbox", "dropbox3"); err != nil {
+			t.Fatal(err.Error())
+		}
+		if _, err := d.GetToken("dropbox", "dropbox3"); err == nil {
+			t.Fatal("token not deleted")
+		}
+
+		if err := d.UnlinkAccount("dropbox", "dropbox3"); err != nil {
+			t.Fatal(err.Error())
+		}
+		if _, err := d.GetAccountID("user3", "dropbox"); err == nil {
+			t.Fatal("mapping not deleted")
+		}
+
+		if err := d.DeleteSessions("user3"); err != nil {
+			t.Fatal(err.Error())
+		}
+		if _, err := d.GetSession(sessionID); err == nil {
+			t.Fatal("session not deleted")
+		}
+	})
+}
+
+// storedSessions counts the sessions of an user stored, expired or not.
+func storedSessions(s Store, userID string) int {
+	switch s := s.(type) {
+	case *DB:
+		count, _ := s.sess.Collection("sessions").Find(db.Cond{"user_id": userID}).Count()
+		return int(count)
+	case *Memory:
+		count := 0
+		for _, session := range s.sessions {
+			if session.UserID == userID {
+				count++
+			}
+		}
+		return count
+	}
+	return 0
+}
+
+// storedToken retrieves the token of an account as it is stored, without decrypting it.
+func storedToken(s Store, account string) (Token, error) {
+	var stored Token
+	switch s := s.(type) {
+	case *DB:
+		err := s.sess.Collection("tokens").Find(db.Cond{"account": account}).One(&stored)
+		return stored, err
+	case *Memory:
+		for _, t := range s.tokens {
+			if t.Account == account {
+				return t, nil
+			}
+		}
+	}
+	return stored, db.ErrNoMoreRows
+}
+
+// useKeyring sets the keyring of a store, keys are rotated without opening the store again.
+func useKeyring(s Store, k *Keyring) {
+	switch s := s.(type) {
+	case *DB:
+		s.keyring = k
+	case *Memory:
+		s.mu.Lock()
+		s.keyring = k
+		s.mu.Unlock()
+	}
+}
+
+// tempFile returns the path of a database file in a new directory and a function removing the directory.
+func tempFile(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "orgo-test")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	return filepath.Join(dir, "orgo.db"), func() { os.RemoveAll(dir) }
+}
+
+func TestMigrate(t *testing.T) {
+	file, remove := tempFile(t)
+	defer remove()
+
+	d, err := NewDB(file, nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer d.Close()
+
+	// A database created before versions were recorded
+	if _, err := d.sess.Exec(sqliteMigrations[0].up); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	for _, stmt := range []string{
+		"insert into tokens (account, provider, token) values ('google1', 'google', 'token')",
+		"insert into map_google_dropbox (google_id, dropbox_id) values ('google1', 'dropbox1')",
+		"insert into entries (user_id, title, tag) values ('google1', '* TODO a', 'TODO')",
+	} {
+		if _, err := d.sess.Exec(stmt); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	if version, err := d.SchemaVersion(); err != nil || version != 1 {
+		t.Fatalf("version %d of a database without versions: %v", version, err)
+	}
+
+	applied, err := d.Migrate()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if applied != d.LatestVersion()-1 {
+		t.Errorf("applied %d migrations, want %d", applied, d.LatestVersion()-1)
+	}
+
+	if version, err := d.SchemaVersion(); err != nil || version != d.LatestVersion() {
+		t.Fatalf("version %d after migrating, want %d: %v", version, d.LatestVersion(), err)
+	}
+
+	t.Run("Data", func(t *testing.T) {
+		if userID, err := d.GetAccountUser("dropbox", "dropbox1"); err != nil || userID != "google1" {
+			t.Errorf("dropbox account of %q: %v", userID, err)
+		}
+
+		if token, err := d.GetToken("google", "google1"); err != nil || token.AccessToken != "token" {
+			t.Errorf("token %q: %v", token.AccessToken, err)
+		}
+
+		entries, err := d.GetEntries("google1")
+		if err != nil || len(entries) != 1 {
+			t.Errorf("entries %v: %v", entries, err)
+		}
+
+		// Users from before timezones keep the timezone files were read in
+		if user, err := d.GetUser("google1"); err != nil || user.Timezone != "America/Los_Angeles" {
+			t.Errorf("timezone %q: %v, want America/Los_Angeles", user.Timezone, err)
+		}
+	})
+
+	t.Run("TimezoneOfNewUsers", func(t *testing.T) {
+		user, err := d.SignIn("google2", "google2@example.com", "")
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+
+		// The backfill leaves the users created after timezones in UTC
+		for _, m := range sqliteMigrations {
+			if m.version != 12 {
+				continue
+			}
+			if _, err := d.sess.Exec(m.up); err != nil {
+				t.Fatal(err.Error())
+			}
+		}
+
+		if user, err := d.GetUser(user.ID); err != nil || user.Timezone != "" {
+			t.Errorf("timezone %q: %v, want UTC", user.Timezone, err)
+		}
+		if user, err := d.GetUser("google1"); err != nil || user.Timezone != "America/Los_Angeles" {
+			t.Errorf("timezone %q: %v, want America/Los_Angeles", user.Timezone, err)
+		}
+	})
+
+	t.Run("EntriesTitle", func(t *testing.T) {
+		for _, fileID := range []string{"id:file1", "id:file2"} {
+			entry := &OrgEntry{UserID: "google1", FileID: fileID, Title: "* TODO a"}
+			if err := d.SaveEntry(entry); err != nil {
+				t.Fatalf("same title in %s: %s", fileID, err.Error())
+			}
+		}
+	})
+
+	t.Run("TokensByProvider", func(t *testing.T) {
+		if err := d.SaveToken("dropbox", "google1", "code", &oauth2.Token{AccessToken: "dropbox"}); err != nil {
+			t.Fatal(err.Error())
+		}
+
+		if token, err := d.GetToken("google", "google1"); err != nil || token.AccessToken != "token" {
+			t.Errorf("google token %q: %v, want it kept", token.AccessToken, err)
+		}
+	})
+
+	t.Run("Idempotent", func(t *testing.T) {
+		if applied, err := d.Migrate(); err != nil || applied != 0 {
+			t.Errorf("migrated %d again: %v", applied, err)
+		}
 	})
 }
@@ -0,0 +1,48 @@
+package db
+
+import (
+	"context"
+
+	db "upper.io/db.v3"
+	"upper.io/db.v3/lib/sqlbuilder"
+)
+
+// Diagnostic is a problem found parsing a file of an user.
+type Diagnostic struct {
+	UserID   string `db:"user_id" json:"-"`
+	FileID   string `db:"file_id" json:"file_id"`
+	File     string `db:"file" json:"file"`
+	Line     int    `db:"line" json:"line"`
+	Column   int    `db:"col" json:"column"`
+	Severity string `db:"severity" json:"severity"`
+	Message  string `db:"message" json:"message"`
+}
+
+// ReplaceDiagnostics replaces the diagnostics stored for a file with the ones of its last parse.
+func (d *DB) ReplaceDiagnostics(userID, fileID string, diagnostics []Diagnostic) error {
+	return d.sess.Tx(context.Background(), func(tx sqlbuilder.Tx) error {
+		col := tx.Collection("diagnostics")
+		if err := col.Find(db.Cond{"user_id": userID}, db.Cond{"file_id": fileID}).Delete(); err != nil {
+			return err
+		}
+
+		for _, diagnostic := range diagnostics {
+			if _, err := col.Insert(&diagnostic); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// DeleteDiagnostics removes the diagnostics of every file of an user.
+func (d *DB) DeleteDiagnostics(userID string) error {
+	return d.sess.Collection("diagnostics").Find(db.Cond{"user_id": userID}).Delete()
+}
+
+// GetDiagnostics retrieves the diagnostics of the files of an user.
+func (d *DB) GetDiagnostics(userID string) ([]Diagnostic, error) {
+	var diagnostics []Diagnostic
+	err := d.sess.Collection("diagnostics").Find(db.Cond{"user_id": userID}).OrderBy("file", "line").All(&diagnostics)
+	return diagnostics, err
+}
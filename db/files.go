@@ -0,0 +1,86 @@
+package db
+
+import (
+	db "upper.io/db.v3"
+)
+
+// DropboxFile maps the stable dropbox id of a file to its current path.
+type DropboxFile struct {
+	Account string `db:"account"`
+	FileID  string `db:"file_id"`
+	Path    string `db:"path"`
+}
+
+// DropboxCursor stores the list_folder cursor of an account.
+type DropboxCursor struct {
+	Account string `db:"account"`
+	Cursor  string `db:"cursor"`
+}
+
+// GetFiles retrieves all known files for a dropbox account.
+func (d *DB) GetFiles(account string) ([]DropboxFile, error) {
+	var files []DropboxFile
+	err := d.sess.Collection("dropbox_files").Find(db.Cond{"account": account}).All(&files)
+	return files, err
+}
+
+// GetFile retrieves a file by its dropbox id.
+func (d *DB) GetFile(account, fileID string) (DropboxFile, error) {
+	var file DropboxFile
+	err := d.sess.Collection("dropbox_files").Find(db.Cond{"account": account}, db.Cond{"file_id": fileID}).One(&file)
+	return file, err
+}
+
+// SaveFile creates or updates the path of a file.
+func (d *DB) SaveFile(file DropboxFile) error {
+	res := d.sess.Collection("dropbox_files").Find(db.Cond{"account": file.Account}, db.Cond{"file_id": file.FileID})
+	count, err := res.Count()
+	if err != nil {
+		return err
+	}
+
+	if count > 0 {
+		return res.Update(&file)
+	}
+
+	_, err = d.sess.Collection("dropbox_files").Insert(&file)
+	return err
+}
+
+// DeleteFile removes a file from the known files of an account.
+func (d *DB) DeleteFile(account, fileID string) error {
+	return d.sess.Collection("dropbox_files").Find(db.Cond{"account": account}, db.Cond{"file_id": fileID}).Delete()
+}
+
+// DeleteFiles forgets every file of an account.
+func (d *DB) DeleteFiles(account string) error {
+	return d.sess.Collection("dropbox_files").Find(db.Cond{"account": account}).Delete()
+}
+
+// GetCursor retrieves the last list_folder cursor of an account.
+func (d *DB) GetCursor(account string) (string, error) {
+	var cursor DropboxCursor
+	err := d.sess.Collection("dropbox_cursors").Find(db.Cond{"account": account}).One(&cursor)
+	return cursor.Cursor, err
+}
+
+// SaveCursor stores the list_folder cursor of an account.
+func (d *DB) SaveCursor(account, cursor string) error {
+	res := d.sess.Collection("dropbox_cursors").Find(db.Cond{"account": account})
+	count, err := res.Count()
+	if err != nil {
+		return err
+	}
+
+	if count > 0 {
+		return res.Update(&DropboxCursor{Account: account, Cursor: cursor})
+	}
+
+	_, err = d.sess.Collection("dropbox_cursors").Insert(&DropboxCursor{Account: account, Cursor: cursor})
+	return err
+}
+
+// DeleteCursor forgets the cursor of an account so the next sync lists every file.
+func (d *DB) DeleteCursor(account string) error {
+	return d.sess.Collection("dropbox_cursors").Find(db.Cond{"account": account}).Delete()
+}
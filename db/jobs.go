@@ -0,0 +1,289 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+	db "upper.io/db.v3"
+	"upper.io/db.v3/lib/sqlbuilder"
+	"upper.io/db.v3/postgresql"
+)
+
+// Job kinds
+const (
+	// JobProcess lists the files of a dropbox account, the payload is the account id
+	JobProcess = "process"
+	// JobSync syncs the entries parsed from a file
+	JobSync = "sync"
+	// JobApply applies a plan confirmed by the user, the payload is the plan id
+	JobApply = "apply"
+	// JobRestore restores a task from the trash, the payload is the trash entry id
+	JobRestore = "restore"
+	// JobDisconnect unlinks a provider from an user, the payload is the provider and options
+	JobDisconnect = "disconnect"
+)
+
+// Job statuses
+const (
+	JobPending = "pending"
+	JobRunning = "running"
+	JobDone    = "done"
+	JobFailed  = "failed"
+)
+
+// ErrLeaseLost is returned for a job whose lease expired and was taken by another worker.
+var ErrLeaseLost = errors.New("job lease lost")
+
+// Job is a unit of work in the queue, Payload holds its argument encoded as JSON.
+// Jobs of the same account run one at a time and a job queued while another with
+// the same kind, account and topic is pending is coalesced into it.
+// A running job whose lease expired is taken again, the worker running it stopped,
+// Lease identifies each lease so only the worker holding it updates the job.
+type Job struct {
+	ID          int64     `db:"id,omitempty"`
+	Kind        string    `db:"kind"`
+	Account     string    `db:"account"`
+	Topic       string    `db:"topic"`
+	Payload     string    `db:"payload"`
+	Status      string    `db:"status"`
+	Attempts    int       `db:"attempts"`
+	Error       string    `db:"error"`
+	RunAt       time.Time `db:"run_at"`
+	LeasedUntil time.Time `db:"leased_until"`
+	Lease       string    `db:"lease"`
+	Created     time.Time `db:"created_at"`
+}
+
+// EnqueueJob queues a job to run as soon as possible, a pending job with
+// the same kind, account and topic runs instead with the new payload.
+func (d *DB) EnqueueJob(kind, account, topic string, payload interface{}) (int64, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return 0, err
+	}
+
+	var id int64
+	err = d.sess.Tx(context.Background(), func(tx sqlbuilder.Tx) error {
+		now := time.Now()
+		col := tx.Collection("jobs")
+
+		var pending Job
+		res := col.Find(db.Cond{"kind": kind, "account": account, "topic": topic, "status": JobPending})
+		err := res.One(&pending)
+		if err == nil {
+			id = pending.ID
+			return res.Update(map[string]interface{}{"payload": string(data), "run_at": now})
+		}
+		if err != db.ErrNoMoreRows {
+			return err
+		}
+
+		inserted, err := col.Insert(&Job{
+			Kind:    kind,
+			Account: account,
+			Topic:   topic,
+			Payload: string(data),
+			Status:  JobPending,
+			RunAt:   now,
+			Created: now,
+		})
+		id = toInt64(inserted)
+		return err
+	})
+	return id, err
+}
+
+// LeaseJob takes the next job due to run for the lease duration, skipping the
+// accounts with a running job, it returns nil when no job can run. Workers lease
+// at the same time: on PostgreSQL the leases of an account are serialized with
+// an advisory lock and a job is only taken while it is unchanged since it was read.
+func (d *DB) LeaseJob(lease time.Duration) (*Job, error) {
+	var job *Job
+
+	err := d.sess.Tx(context.Background(), func(tx sqlbuilder.Tx) error {
+		now := time.Now()
+		col := tx.Collection("jobs")
+
+		var running []Job
+		if err := col.Find(db.Cond{"status": JobRunning, "leased_until >=": now}).All(&running); err != nil {
+			return err
+		}
+
+		busy := make(map[string]bool)
+		for _, r := range running {
+			busy[r.Account] = true
+		}
+
+		var due []Job
+		err := col.Find(db.Or(
+			db.Cond{"status": JobPending, "run_at <=": now},
+			db.Cond{"status": JobRunning, "leased_until <": now},
+		)).OrderBy("run_at").All(&due)
+		if err != nil {
+			return err
+		}
+
+		for _, next := range due {
+			if busy[next.Account] {
+				continue
+			}
+
+			if d.adapter == postgresql.Adapter {
+				if _, err := tx.Exec("select pg_advisory_xact_lock(hashtext(?))", next.Account); err != nil {
+					return err
+				}
+
+				// Another worker may have leased a job of the account before the lock
+				n, err := col.Find(db.Cond{"account": next.Account, "status": JobRunning, "leased_until >=": now}).Count()
+				if err != nil {
+					return err
+				}
+				if n > 0 {
+					busy[next.Account] = true
+					continue
+				}
+			}
+
+			leased := next
+			leased.Status = JobRunning
+			leased.Attempts++
+			leased.LeasedUntil = now.Add(lease)
+			leased.Lease = uuid.New().String()
+
+			res, err := tx.Update("jobs").Set(map[string]interface{}{
+				"status":       leased.Status,
+				"attempts":     leased.Attempts,
+				"leased_until": leased.LeasedUntil,
+				"lease":        leased.Lease,
+			}).Where(db.Cond{"id": next.ID, "status": next.Status, "lease": next.Lease}).Exec()
+			if err != nil {
+				return err
+			}
+
+			n, err := res.RowsAffected()
+			if err != nil {
+				return err
+			}
+
+			// The job was taken by another worker since it was read
+			if n == 0 {
+				continue
+			}
+
+			job = &leased
+			return nil
+		}
+		return nil
+	})
+	return job, err
+}
+
+// HeartbeatJob extends the lease of a running job.
+func (d *DB) HeartbeatJob(id int64, lease string, duration time.Duration) error {
+	return updateLeased(d.sess, id, lease, map[string]interface{}{"leased_until": time.Now().Add(duration)})
+}
+
+// CompleteJob marks a job as done.
+func (d *DB) CompleteJob(id int64, lease string) error {
+	return updateLeased(d.sess, id, lease, map[string]interface{}{
+		"status": JobDone,
+		"error":  "",
+	})
+}
+
+// FailJob records the error of a job run and schedules it to run again at next,
+// a zero next fails the job for good.
+func (d *DB) FailJob(id int64, lease, message string, next time.Time) error {
+	status := JobPending
+	if next.IsZero() {
+		status = JobFailed
+	}
+
+	return updateLeased(d.sess, id, lease, map[string]interface{}{
+		"status": status,
+		"error":  message,
+		"run_at": next,
+	})
+}
+
+// updateLeased updates a running job while it is held with lease, ErrLeaseLost
+// is returned when the lease expired and another worker took the job.
+func updateLeased(sess sqlbuilder.SQLBuilder, id int64, lease string, values map[string]interface{}) error {
+	res, err := sess.Update("jobs").Set(values).Where(db.Cond{"id": id, "status": JobRunning, "lease": lease}).Exec()
+	if err != nil {
+		return err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if n == 0 {
+		return ErrLeaseLost
+	}
+	return nil
+}
+
+// CountJobs returns the number of jobs with a status.
+func (d *DB) CountJobs(status string) (int, error) {
+	count, err := d.sess.Collection("jobs").Find(db.Cond{"status": status}).Count()
+	return int(count), err
+}
+
+// ReleaseJob queues a running job again without counting the attempt,
+// its run was interrupted before it finished.
+func (d *DB) ReleaseJob(id int64, lease string) error {
+	return d.sess.Tx(context.Background(), func(tx sqlbuilder.Tx) error {
+		var job Job
+		err := tx.Collection("jobs").Find(db.Cond{"id": id, "status": JobRunning, "lease": lease}).One(&job)
+		if err == db.ErrNoMoreRows {
+			return ErrLeaseLost
+		}
+		if err != nil {
+			return err
+		}
+
+		return updateLeased(tx, id, lease, map[string]interface{}{
+			"status":   JobPending,
+			"attempts": job.Attempts - 1,
+			"run_at":   time.Now(),
+		})
+	})
+}
+
+// CancelJobs removes the pending jobs of an account with one of kinds.
+func (d *DB) CancelJobs(account string, kinds ...string) error {
+	return d.sess.Collection("jobs").Find(
+		db.Cond{"account": account},
+		db.Cond{"kind IN": kinds},
+		db.Cond{"status": JobPending},
+	).Delete()
+}
+
+// CancelTopic removes the pending jobs of an account about a topic.
+func (d *DB) CancelTopic(account, topic string) error {
+	return d.sess.Collection("jobs").Find(
+		db.Cond{"account": account},
+		db.Cond{"topic": topic},
+		db.Cond{"status": JobPending},
+	).Delete()
+}
+
+// GetJob retrieves a job by id.
+func (d *DB) GetJob(id int64) (Job, error) {
+	var job Job
+	err := d.sess.Collection("jobs").Find(db.Cond{"id": id}).One(&job)
+	return job, err
+}
+
+// PurgeJobs removes the finished jobs created before a time.
+func (d *DB) PurgeJobs(before time.Time) error {
+	return d.sess.Collection("jobs").Find(
+		db.Cond{"status IN": []string{JobDone, JobFailed}},
+		db.Cond{"created_at <": before},
+	).Delete()
+}
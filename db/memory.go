@@ -0,0 +1,1346 @@
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+	"golang.org/x/oauth2"
+	db "upper.io/db.v3"
+)
+
+// Memory is a Store keeping every record in memory, it has the semantics of DB
+// without a database: missing records return db.ErrNoMoreRows, records are
+// listed in the order they were saved unless DB orders them, and the unique
+// keys of the tables are enforced. The records are lost when the process exits.
+type Memory struct {
+	mu sync.Mutex
+
+	entries     []OrgEntry
+	tokens      []Token
+	sessions    []Session
+	mappings    []TasklistMapping
+	tasklists   []Tasklist
+	users       []User
+	accounts    []Account
+	files       []DropboxFile
+	cursors     []DropboxCursor
+	jobs        []Job
+	plans       []StoredPlan
+	trash       []TrashEntry
+	runs        []SyncRun
+	syncErrors  []SyncError
+	diagnostics []Diagnostic
+	settings    []Settings
+
+	// ids are the last ids inserted by table, ids are never reused
+	ids map[string]int64
+	// keyring encrypts the tokens saved, tokens are saved in plaintext without one
+	keyring *Keyring
+}
+
+var _ Store = (*Memory)(nil)
+
+// NewMemory creates an empty Memory store, tokens are encrypted with keyring when it is not nil.
+func NewMemory(keyring *Keyring) *Memory {
+	return &Memory{ids: make(map[string]int64), keyring: keyring}
+}
+
+// nextID returns the id of a record inserted in a table.
+func (m *Memory) nextID(table string) int64 {
+	m.ids[table]++
+	return m.ids[table]
+}
+
+// errUnique is the error of an insert breaking a unique key of a table.
+func errUnique(table string, key ...string) error {
+	return fmt.Errorf("unique constraint failed: %s %v", table, key)
+}
+
+// SchemaVersion returns the latest version, a Memory store has no schema to migrate.
+func (m *Memory) SchemaVersion() (int, error) {
+	return m.LatestVersion(), nil
+}
+
+// LatestVersion returns the version of the schema after every migration.
+func (m *Memory) LatestVersion() int {
+	return sqliteMigrations[len(sqliteMigrations)-1].version
+}
+
+// Migrate applies no migration.
+func (m *Memory) Migrate() (int, error) {
+	return 0, nil
+}
+
+// Close does nothing, there is no database to close.
+func (m *Memory) Close() error {
+	return nil
+}
+
+// GetEntry retrieves an OrgEntry by user, file and title.
+func (m *Memory) GetEntry(userID, fileID, title string) (*OrgEntry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, entry := range m.entries {
+		if entry.UserID == userID && entry.FileID == fileID && entry.Title == title {
+			return &entry, nil
+		}
+	}
+	return &OrgEntry{}, db.ErrNoMoreRows
+}
+
+// SaveEntry saves an OrgEntry, an user has a single entry with a key in a file.
+func (m *Memory) SaveEntry(entry *OrgEntry) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if hasEntry(m.entries, entry) {
+		return errUnique("entries", entry.UserID, entry.FileID, entry.ID())
+	}
+	m.entries = append(m.entries, *keyed(entry))
+	return nil
+}
+
+// hasEntry reports whether entries has an entry with the key of entry.
+func hasEntry(entries []OrgEntry, entry *OrgEntry) bool {
+	for _, e := range entries {
+		if e.UserID == entry.UserID && e.FileID == entry.FileID && e.ID() == entry.ID() {
+			return true
+		}
+	}
+	return false
+}
+
+// GetEntries retrieves all entries for an user.
+func (m *Memory) GetEntries(userID string) ([]*OrgEntry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var entries []*OrgEntry
+	for _, entry := range m.entries {
+		if entry.UserID == userID {
+			entry := entry
+			entries = append(entries, &entry)
+		}
+	}
+	return entries, nil
+}
+
+// GetFileEntries retrieves the entries parsed from a single file.
+func (m *Memory) GetFileEntries(userID, fileID string) ([]*OrgEntry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var entries []*OrgEntry
+	for _, entry := range m.entries {
+		if entry.UserID == userID && entry.FileID == fileID {
+			entry := entry
+			entries = append(entries, &entry)
+		}
+	}
+	return entries, nil
+}
+
+// DeleteFileEntries removes every entry parsed from a file.
+func (m *Memory) DeleteFileEntries(userID, fileID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.entries = withoutFileEntries(m.entries, userID, fileID)
+	return nil
+}
+
+// withoutFileEntries returns the entries not parsed from a file.
+func withoutFileEntries(entries []OrgEntry, userID, fileID string) []OrgEntry {
+	var kept []OrgEntry
+	for _, entry := range entries {
+		if entry.UserID != userID || entry.FileID != fileID {
+			kept = append(kept, entry)
+		}
+	}
+	return kept
+}
+
+// DeleteEntries removes every entry of an user.
+func (m *Memory) DeleteEntries(userID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var kept []OrgEntry
+	for _, entry := range m.entries {
+		if entry.UserID != userID {
+			kept = append(kept, entry)
+		}
+	}
+	m.entries = kept
+	return nil
+}
+
+// ReplaceFileEntries replaces the entries stored for a file with the ones
+// provided, the entries are unchanged when one of them can not be saved.
+func (m *Memory) ReplaceFileEntries(userID, fileID string, entries []*OrgEntry) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	replaced := withoutFileEntries(m.entries, userID, fileID)
+	for _, entry := range entries {
+		if hasEntry(replaced, entry) {
+			return errUnique("entries", entry.UserID, entry.FileID, entry.ID())
+		}
+		replaced = append(replaced, *keyed(entry))
+	}
+
+	m.entries = replaced
+	return nil
+}
+
+// SaveToken saves the code from an OAUTH negotiation with a provider for a specific account,
+// authorizing an account again replaces its token and keeps the refresh token when none is given.
+func (m *Memory) SaveToken(provider, account, code string, token *oauth2.Token) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	saved := Token{
+		Account:      account,
+		Provider:     provider,
+		AccessToken:  token.AccessToken,
+		TokenType:    token.TokenType,
+		RefreshToken: token.RefreshToken,
+		Expiry:       token.Expiry,
+		Code:         code,
+	}
+
+	for i, current := range m.tokens {
+		if current.Provider != provider || current.Account != account {
+			continue
+		}
+
+		if err := current.decrypt(m.keyring); err != nil {
+			return err
+		}
+		if saved.RefreshToken == "" {
+			saved.RefreshToken = current.RefreshToken
+		}
+		if err := saved.encrypt(m.keyring); err != nil {
+			return err
+		}
+		m.tokens[i] = saved
+		return nil
+	}
+
+	if err := saved.encrypt(m.keyring); err != nil {
+		return err
+	}
+	m.tokens = append(m.tokens, saved)
+	return nil
+}
+
+// UpdateToken saves a refreshed token of an account.
+func (m *Memory) UpdateToken(provider, account string, token *oauth2.Token) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	saved := Token{Provider: provider, Account: account, AccessToken: token.AccessToken, RefreshToken: token.RefreshToken}
+	if err := saved.encrypt(m.keyring); err != nil {
+		return err
+	}
+
+	for i, t := range m.tokens {
+		if t.Provider == provider && t.Account == account {
+			t.AccessToken, t.TokenType, t.RefreshToken = saved.AccessToken, token.TokenType, saved.RefreshToken
+			t.Expiry, t.NeedsConsent = token.Expiry, false
+			t.KeyID, t.DataKey = saved.KeyID, saved.DataKey
+			m.tokens[i] = t
+		}
+	}
+	return nil
+}
+
+// SetNeedsConsent marks the token of an account as needing the user to authorize again.
+func (m *Memory) SetNeedsConsent(provider, account string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i, t := range m.tokens {
+		if t.Provider == provider && t.Account == account {
+			m.tokens[i].NeedsConsent = true
+		}
+	}
+	return nil
+}
+
+// GetToken retrieves the token for a provider and account.
+func (m *Memory) GetToken(provider, account string) (Token, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, t := range m.tokens {
+		if t.Provider == provider && t.Account == account {
+			return t, errors.Wrap(t.decrypt(m.keyring), "get token")
+		}
+	}
+	return Token{}, errors.Wrap(db.ErrNoMoreRows, "get token")
+}
+
+// DeleteToken removes the token of an account.
+func (m *Memory) DeleteToken(provider, account string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var kept []Token
+	for _, t := range m.tokens {
+		if t.Provider != provider || t.Account != account {
+			kept = append(kept, t)
+		}
+	}
+	m.tokens = kept
+	return nil
+}
+
+// EncryptTokens encrypts the tokens not encrypted with the current key of the
+// keyring and returns the number of tokens encrypted, no token is changed when
+// one of them can not be encrypted.
+func (m *Memory) EncryptTokens() (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.keyring == nil {
+		return 0, errors.New("encrypt tokens without a keyring")
+	}
+
+	tokens := make([]Token, len(m.tokens))
+	copy(tokens, m.tokens)
+
+	count := 0
+	for i := range tokens {
+		keyID := tokens[i].KeyID
+		if err := tokens[i].decrypt(m.keyring); err != nil {
+			return 0, err
+		}
+		if keyID == m.keyring.Current() && !tokens[i].legacy {
+			tokens[i] = m.tokens[i]
+			continue
+		}
+
+		if err := tokens[i].encrypt(m.keyring); err != nil {
+			return 0, err
+		}
+		count++
+	}
+
+	m.tokens = tokens
+	return count, nil
+}
+
+// SaveSession creates an uuid ID for the given userID as a session, lasting
+// for ttl unless it is not used for idle.
+func (m *Memory) SaveSession(userID, userAgent string, ttl, idle time.Duration) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	session := Session{
+		ID:        uuid.New().String(),
+		UserID:    userID,
+		UserAgent: userAgent,
+		Created:   now,
+		LastSeen:  now,
+		Expires:   now.Add(ttl),
+		IdleUntil: now.Add(idle),
+	}
+	m.sessions = append(m.sessions, session)
+	return session.ID, nil
+}
+
+// activeAt reports whether a session is not expired at now.
+func (s Session) activeAt(now time.Time) bool {
+	return s.Expires.After(now) && s.IdleUntil.After(now)
+}
+
+// GetSession retrieves the userID for the sessionID provided, expired
+// and unknown sessions return db.ErrNoMoreRows.
+func (m *Memory) GetSession(sessionID string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	for _, session := range m.sessions {
+		if session.ID == sessionID && session.activeAt(now) {
+			return session.UserID, nil
+		}
+	}
+	return "", db.ErrNoMoreRows
+}
+
+// TouchSession retrieves the userID for the sessionID provided and keeps
+// the session from expiring idle for another idle duration.
+func (m *Memory) TouchSession(sessionID string, idle time.Duration) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	for i, session := range m.sessions {
+		if session.ID == sessionID && session.activeAt(now) {
+			m.sessions[i].LastSeen = now
+			m.sessions[i].IdleUntil = now.Add(idle)
+			return session.UserID, nil
+		}
+	}
+	return "", db.ErrNoMoreRows
+}
+
+// GetSessions retrieves the active sessions of an user, the last used first.
+func (m *Memory) GetSessions(userID string) ([]Session, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	var sessions []Session
+	for _, session := range m.sessions {
+		if session.UserID == userID && session.activeAt(now) {
+			sessions = append(sessions, session)
+		}
+	}
+
+	sort.SliceStable(sessions, func(i, j int) bool {
+		return sessions[i].LastSeen.After(sessions[j].LastSeen)
+	})
+	return sessions, nil
+}
+
+// DeleteSession removes a session, signing it out.
+func (m *Memory) DeleteSession(sessionID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var kept []Session
+	for _, session := range m.sessions {
+		if session.ID != sessionID {
+			kept = append(kept, session)
+		}
+	}
+	m.sessions = kept
+	return nil
+}
+
+// DeleteSessions removes every session of an user, signing them out everywhere.
+func (m *Memory) DeleteSessions(userID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var kept []Session
+	for _, session := range m.sessions {
+		if session.UserID != userID {
+			kept = append(kept, session)
+		}
+	}
+	m.sessions = kept
+	return nil
+}
+
+// PurgeSessions removes the sessions expired before a time.
+func (m *Memory) PurgeSessions(before time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var kept []Session
+	for _, session := range m.sessions {
+		if !session.Expires.Before(before) && !session.IdleUntil.Before(before) {
+			kept = append(kept, session)
+		}
+	}
+	m.sessions = kept
+	return nil
+}
+
+// GetMappings retrieves the tasklist mappings of an user.
+func (m *Memory) GetMappings(userID string) ([]TasklistMapping, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var mappings []TasklistMapping
+	for _, mapping := range m.mappings {
+		if mapping.UserID == userID {
+			mappings = append(mappings, mapping)
+		}
+	}
+	return mappings, nil
+}
+
+// SaveMapping creates a mapping or replaces the tasklist of an existing one.
+func (m *Memory) SaveMapping(mapping TasklistMapping) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.mappings = append(withoutMapping(m.mappings, mapping.UserID, mapping.Kind, mapping.Value), mapping)
+	return nil
+}
+
+// DeleteMapping removes a mapping.
+func (m *Memory) DeleteMapping(userID, kind, value string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.mappings = withoutMapping(m.mappings, userID, kind, value)
+	return nil
+}
+
+// withoutMapping returns the mappings but the one of a kind and value of an user.
+func withoutMapping(mappings []TasklistMapping, userID, kind, value string) []TasklistMapping {
+	var kept []TasklistMapping
+	for _, mapping := range mappings {
+		if mapping.UserID != userID || mapping.Kind != kind || mapping.Value != value {
+			kept = append(kept, mapping)
+		}
+	}
+	return kept
+}
+
+// GetTasklists retrieves the tasklists managed by orgo for an user.
+func (m *Memory) GetTasklists(userID string) ([]Tasklist, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var lists []Tasklist
+	for _, list := range m.tasklists {
+		if list.UserID == userID {
+			lists = append(lists, list)
+		}
+	}
+	return lists, nil
+}
+
+// SaveTasklist records a tasklist created by orgo.
+func (m *Memory) SaveTasklist(list Tasklist) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, l := range m.tasklists {
+		if l.ListID == list.ListID {
+			return errUnique("tasklists", list.ListID)
+		}
+	}
+	m.tasklists = append(m.tasklists, list)
+	return nil
+}
+
+// DeleteTasklist forgets a tasklist managed by orgo.
+func (m *Memory) DeleteTasklist(userID, listID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var kept []Tasklist
+	for _, list := range m.tasklists {
+		if list.UserID != userID || list.ListID != listID {
+			kept = append(kept, list)
+		}
+	}
+	m.tasklists = kept
+	return nil
+}
+
+// SignIn returns the user signed in with a google account, creating the user on its first sign in.
+func (m *Memory) SignIn(googleID, email, name string) (User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, account := range m.accounts {
+		if account.Provider != "google" || account.Account != googleID {
+			continue
+		}
+
+		for i, user := range m.users {
+			if user.ID == account.UserID {
+				// The profile follows the one of the google account
+				m.users[i].Email, m.users[i].Name = email, name
+				return m.users[i], nil
+			}
+		}
+		return User{}, db.ErrNoMoreRows
+	}
+
+	user := User{ID: uuid.New().String(), Email: email, Name: name, Created: time.Now()}
+	m.users = append(m.users, user)
+	m.accounts = append(m.accounts, Account{Provider: "google", Account: googleID, UserID: user.ID, Email: email, Linked: time.Now()})
+	return user, nil
+}
+
+// GetUser retrieves an user by id.
+func (m *Memory) GetUser(userID string) (User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.user(userID)
+}
+
+// user retrieves an user by id, m.mu is held.
+func (m *Memory) user(userID string) (User, error) {
+	for _, user := range m.users {
+		if user.ID == userID {
+			return user, nil
+		}
+	}
+	return User{}, db.ErrNoMoreRows
+}
+
+// SetTimezone sets the timezone the files of an user are read in, an IANA name as "Europe/Lisbon".
+func (m *Memory) SetTimezone(userID, timezone string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.setTimezone(userID, timezone)
+	return nil
+}
+
+// setTimezone sets the timezone of an user, m.mu is held.
+func (m *Memory) setTimezone(userID, timezone string) {
+	for i, user := range m.users {
+		if user.ID == userID {
+			m.users[i].Timezone = timezone
+		}
+	}
+}
+
+// LinkAccount links an account to an user, an account linked to another user is moved to this one.
+func (m *Memory) LinkAccount(account Account) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	account.Linked = time.Now()
+	m.accounts = append(withoutAccount(m.accounts, account.Provider, account.Account), account)
+	return nil
+}
+
+// UnlinkAccount removes an account from its user.
+func (m *Memory) UnlinkAccount(provider, account string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.accounts = withoutAccount(m.accounts, provider, account)
+	return nil
+}
+
+// withoutAccount returns the accounts but the account of a provider.
+func withoutAccount(accounts []Account, provider, account string) []Account {
+	var kept []Account
+	for _, a := range accounts {
+		if a.Provider != provider || a.Account != account {
+			kept = append(kept, a)
+		}
+	}
+	return kept
+}
+
+// GetAccounts retrieves the accounts of a provider linked to an user.
+func (m *Memory) GetAccounts(userID, provider string) ([]Account, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.userAccounts(userID, provider), nil
+}
+
+// userAccounts returns the accounts of a provider linked to an user, the
+// first linked first, m.mu is held.
+func (m *Memory) userAccounts(userID, provider string) []Account {
+	var accounts []Account
+	for _, account := range m.accounts {
+		if account.UserID == userID && account.Provider == provider {
+			accounts = append(accounts, account)
+		}
+	}
+
+	sort.SliceStable(accounts, func(i, j int) bool {
+		return accounts[i].Linked.Before(accounts[j].Linked)
+	})
+	return accounts
+}
+
+// GetAccountID retrieves the first account of a provider linked to an user, the google account of an user.
+func (m *Memory) GetAccountID(userID, provider string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	accounts := m.userAccounts(userID, provider)
+	if len(accounts) == 0 {
+		return "", db.ErrNoMoreRows
+	}
+	return accounts[0].Account, nil
+}
+
+// GetAccountUser retrieves the user an account is linked to.
+func (m *Memory) GetAccountUser(provider, account string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, a := range m.accounts {
+		if a.Provider == provider && a.Account == account {
+			return a.UserID, nil
+		}
+	}
+	return "", db.ErrNoMoreRows
+}
+
+// GetFiles retrieves all known files for a dropbox account.
+func (m *Memory) GetFiles(account string) ([]DropboxFile, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var files []DropboxFile
+	for _, file := range m.files {
+		if file.Account == account {
+			files = append(files, file)
+		}
+	}
+	return files, nil
+}
+
+// GetFile retrieves a file by its dropbox id.
+func (m *Memory) GetFile(account, fileID string) (DropboxFile, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, file := range m.files {
+		if file.Account == account && file.FileID == fileID {
+			return file, nil
+		}
+	}
+	return DropboxFile{}, db.ErrNoMoreRows
+}
+
+// SaveFile creates or updates the path of a file.
+func (m *Memory) SaveFile(file DropboxFile) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i, f := range m.files {
+		if f.Account == file.Account && f.FileID == file.FileID {
+			m.files[i] = file
+			return nil
+		}
+	}
+	m.files = append(m.files, file)
+	return nil
+}
+
+// DeleteFile removes a file from the known files of an account.
+func (m *Memory) DeleteFile(account, fileID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var kept []DropboxFile
+	for _, file := range m.files {
+		if file.Account != account || file.FileID != fileID {
+			kept = append(kept, file)
+		}
+	}
+	m.files = kept
+	return nil
+}
+
+// DeleteFiles forgets every file of an account.
+func (m *Memory) DeleteFiles(account string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var kept []DropboxFile
+	for _, file := range m.files {
+		if file.Account != account {
+			kept = append(kept, file)
+		}
+	}
+	m.files = kept
+	return nil
+}
+
+// GetCursor retrieves the last list_folder cursor of an account.
+func (m *Memory) GetCursor(account string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, cursor := range m.cursors {
+		if cursor.Account == account {
+			return cursor.Cursor, nil
+		}
+	}
+	return "", db.ErrNoMoreRows
+}
+
+// SaveCursor stores the list_folder cursor of an account.
+func (m *Memory) SaveCursor(account, cursor string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i, c := range m.cursors {
+		if c.Account == account {
+			m.cursors[i].Cursor = cursor
+			return nil
+		}
+	}
+	m.cursors = append(m.cursors, DropboxCursor{Account: account, Cursor: cursor})
+	return nil
+}
+
+// DeleteCursor forgets the cursor of an account so the next sync lists every file.
+func (m *Memory) DeleteCursor(account string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var kept []DropboxCursor
+	for _, cursor := range m.cursors {
+		if cursor.Account != account {
+			kept = append(kept, cursor)
+		}
+	}
+	m.cursors = kept
+	return nil
+}
+
+// EnqueueJob queues a job to run as soon as possible, a pending job with
+// the same kind, account and topic runs instead with the new payload.
+func (m *Memory) EnqueueJob(kind, account, topic string, payload interface{}) (int64, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return 0, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	for i, job := range m.jobs {
+		if job.Kind == kind && job.Account == account && job.Topic == topic && job.Status == JobPending {
+			m.jobs[i].Payload, m.jobs[i].RunAt = string(data), now
+			return job.ID, nil
+		}
+	}
+
+	job := Job{
+		ID:      m.nextID("jobs"),
+		Kind:    kind,
+		Account: account,
+		Topic:   topic,
+		Payload: string(data),
+		Status:  JobPending,
+		RunAt:   now,
+		Created: now,
+	}
+	m.jobs = append(m.jobs, job)
+	return job.ID, nil
+}
+
+// LeaseJob takes the next job due to run for the lease duration, skipping the
+// accounts with a running job, it returns nil when no job can run.
+func (m *Memory) LeaseJob(lease time.Duration) (*Job, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	busy := make(map[string]bool)
+	var due []int
+	for i, job := range m.jobs {
+		switch {
+		case job.Status == JobRunning && !job.LeasedUntil.Before(now):
+			busy[job.Account] = true
+		case job.Status == JobPending && !job.RunAt.After(now),
+			job.Status == JobRunning && job.LeasedUntil.Before(now):
+			due = append(due, i)
+		}
+	}
+
+	sort.SliceStable(due, func(i, j int) bool {
+		return m.jobs[due[i]].RunAt.Before(m.jobs[due[j]].RunAt)
+	})
+
+	for _, i := range due {
+		if busy[m.jobs[i].Account] {
+			continue
+		}
+
+		m.jobs[i].Status = JobRunning
+		m.jobs[i].Attempts++
+		m.jobs[i].LeasedUntil = now.Add(lease)
+		m.jobs[i].Lease = uuid.New().String()
+
+		job := m.jobs[i]
+		return &job, nil
+	}
+	return nil, nil
+}
+
+// HeartbeatJob extends the lease of a running job.
+func (m *Memory) HeartbeatJob(id int64, lease string, duration time.Duration) error {
+	return m.updateLeased(id, lease, func(job *Job) {
+		job.LeasedUntil = time.Now().Add(duration)
+	})
+}
+
+// CompleteJob marks a job as done.
+func (m *Memory) CompleteJob(id int64, lease string) error {
+	return m.updateLeased(id, lease, func(job *Job) {
+		job.Status, job.Error = JobDone, ""
+	})
+}
+
+// FailJob records the error of a job run and schedules it to run again at next,
+// a zero next fails the job for good.
+func (m *Memory) FailJob(id int64, lease, message string, next time.Time) error {
+	status := JobPending
+	if next.IsZero() {
+		status = JobFailed
+	}
+
+	return m.updateLeased(id, lease, func(job *Job) {
+		job.Status, job.Error, job.RunAt = status, message, next
+	})
+}
+
+// updateLeased updates a running job while it is held with lease.
+func (m *Memory) updateLeased(id int64, lease string, update func(*Job)) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i, job := range m.jobs {
+		if job.ID == id && job.Status == JobRunning && job.Lease == lease {
+			update(&m.jobs[i])
+			return nil
+		}
+	}
+	return ErrLeaseLost
+}
+
+// CountJobs returns the number of jobs with a status.
+func (m *Memory) CountJobs(status string) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	count := 0
+	for _, job := range m.jobs {
+		if job.Status == status {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// ReleaseJob queues a running job again without counting the attempt,
+// its run was interrupted before it finished.
+func (m *Memory) ReleaseJob(id int64, lease string) error {
+	return m.updateLeased(id, lease, func(job *Job) {
+		job.Status = JobPending
+		job.Attempts--
+		job.RunAt = time.Now()
+	})
+}
+
+// CancelJobs removes the pending jobs of an account with one of kinds.
+func (m *Memory) CancelJobs(account string, kinds ...string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	cancelled := make(map[string]bool)
+	for _, kind := range kinds {
+		cancelled[kind] = true
+	}
+
+	var kept []Job
+	for _, job := range m.jobs {
+		if job.Account != account || !cancelled[job.Kind] || job.Status != JobPending {
+			kept = append(kept, job)
+		}
+	}
+	m.jobs = kept
+	return nil
+}
+
+// CancelTopic removes the pending jobs of an account about a topic.
+func (m *Memory) CancelTopic(account, topic string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var kept []Job
+	for _, job := range m.jobs {
+		if job.Account != account || job.Topic != topic || job.Status != JobPending {
+			kept = append(kept, job)
+		}
+	}
+	m.jobs = kept
+	return nil
+}
+
+// GetJob retrieves a job by id.
+func (m *Memory) GetJob(id int64) (Job, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, job := range m.jobs {
+		if job.ID == id {
+			return job, nil
+		}
+	}
+	return Job{}, db.ErrNoMoreRows
+}
+
+// PurgeJobs removes the finished jobs created before a time.
+func (m *Memory) PurgeJobs(before time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var kept []Job
+	for _, job := range m.jobs {
+		finished := job.Status == JobDone || job.Status == JobFailed
+		if !finished || !job.Created.Before(before) {
+			kept = append(kept, job)
+		}
+	}
+	m.jobs = kept
+	return nil
+}
+
+// SavePlan stores a pending plan, the pending plan of the same file it replaces is discarded.
+func (m *Memory) SavePlan(plan StoredPlan) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i, p := range m.plans {
+		if p.UserID == plan.UserID && p.FileID == plan.FileID && p.Status == PlanPending {
+			m.plans[i].Status = PlanDiscarded
+		}
+	}
+
+	plan.ID, plan.Status = m.nextID("plans"), PlanPending
+	m.plans = append(m.plans, plan)
+	return plan.ID, nil
+}
+
+// GetPlan retrieves a plan by id.
+func (m *Memory) GetPlan(id int64) (StoredPlan, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, plan := range m.plans {
+		if plan.ID == id {
+			return plan, nil
+		}
+	}
+	return StoredPlan{}, db.ErrNoMoreRows
+}
+
+// GetPendingPlans retrieves the plans of an user waiting for review.
+func (m *Memory) GetPendingPlans(userID string) ([]StoredPlan, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var plans []StoredPlan
+	for _, plan := range m.plans {
+		if plan.UserID == userID && plan.Status == PlanPending {
+			plans = append(plans, plan)
+		}
+	}
+
+	sort.SliceStable(plans, func(i, j int) bool {
+		return plans[i].Created.Before(plans[j].Created)
+	})
+	return plans, nil
+}
+
+// SetPlanStatus marks a plan as applied or discarded.
+func (m *Memory) SetPlanStatus(id int64, status string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i, plan := range m.plans {
+		if plan.ID == id {
+			m.plans[i].Status = status
+			return nil
+		}
+	}
+	return db.ErrNoMoreRows
+}
+
+// DiscardPendingPlans discards the pending plans of a file, a newer sync replaced them.
+func (m *Memory) DiscardPendingPlans(userID, fileID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i, plan := range m.plans {
+		if plan.UserID == userID && plan.FileID == fileID && plan.Status == PlanPending {
+			m.plans[i].Status = PlanDiscarded
+		}
+	}
+	return nil
+}
+
+// DiscardUserPlans discards the pending plans of every file of an user.
+func (m *Memory) DiscardUserPlans(userID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i, plan := range m.plans {
+		if plan.UserID == userID && plan.Status == PlanPending {
+			m.plans[i].Status = PlanDiscarded
+		}
+	}
+	return nil
+}
+
+// SaveTrash keeps a deleted task in the trash.
+func (m *Memory) SaveTrash(entry TrashEntry) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	entry.ID = m.nextID("trash")
+	m.trash = append(m.trash, entry)
+	return nil
+}
+
+// GetTrash retrieves the deleted tasks of an user, most recent first.
+func (m *Memory) GetTrash(userID string) ([]TrashEntry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var entries []TrashEntry
+	for _, entry := range m.trash {
+		if entry.UserID == userID {
+			entries = append(entries, entry)
+		}
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].Deleted.After(entries[j].Deleted)
+	})
+	return entries, nil
+}
+
+// GetTrashEntry retrieves a deleted task by id.
+func (m *Memory) GetTrashEntry(id int64) (TrashEntry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, entry := range m.trash {
+		if entry.ID == id {
+			return entry, nil
+		}
+	}
+	return TrashEntry{}, db.ErrNoMoreRows
+}
+
+// DeleteTrash removes a task from the trash.
+func (m *Memory) DeleteTrash(id int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var kept []TrashEntry
+	for _, entry := range m.trash {
+		if entry.ID != id {
+			kept = append(kept, entry)
+		}
+	}
+	m.trash = kept
+	return nil
+}
+
+// PurgeTrash removes the tasks deleted before a time.
+func (m *Memory) PurgeTrash(before time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var kept []TrashEntry
+	for _, entry := range m.trash {
+		if !entry.Deleted.Before(before) {
+			kept = append(kept, entry)
+		}
+	}
+	m.trash = kept
+	return nil
+}
+
+// StartRun records the start of a sync run.
+func (m *Memory) StartRun(run *SyncRun) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	run.ID, run.Status = m.nextID("sync_runs"), RunRunning
+
+	stored := *run
+	stored.Errors = nil
+	m.runs = append(m.runs, stored)
+	return nil
+}
+
+// FinishRun records the end of a sync run and its errors.
+func (m *Memory) FinishRun(run *SyncRun) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i := range m.runs {
+		if m.runs[i].ID == run.ID {
+			m.runs[i] = *run
+			m.runs[i].Errors = nil
+		}
+	}
+
+	for _, e := range run.Errors {
+		e.RunID = run.ID
+		m.syncErrors = append(m.syncErrors, e)
+	}
+	return nil
+}
+
+// GetRuns retrieves the latest sync runs of an user with their errors.
+func (m *Memory) GetRuns(userID string, limit int) ([]SyncRun, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var runs []SyncRun
+	for _, run := range m.runs {
+		if run.UserID == userID {
+			runs = append(runs, run)
+		}
+	}
+
+	sort.SliceStable(runs, func(i, j int) bool {
+		return runs[i].Started.After(runs[j].Started)
+	})
+	if len(runs) > limit {
+		runs = runs[:limit]
+	}
+
+	for i := range runs {
+		for _, e := range m.syncErrors {
+			if e.RunID == runs[i].ID {
+				runs[i].Errors = append(runs[i].Errors, e)
+			}
+		}
+	}
+	return runs, nil
+}
+
+// PurgeRuns removes the sync runs started before a time and their errors.
+func (m *Memory) PurgeRuns(before time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	purged := make(map[int64]bool)
+	var kept []SyncRun
+	for _, run := range m.runs {
+		if run.Started.Before(before) {
+			purged[run.ID] = true
+			continue
+		}
+		kept = append(kept, run)
+	}
+	m.runs = kept
+
+	var errs []SyncError
+	for _, e := range m.syncErrors {
+		if !purged[e.RunID] {
+			errs = append(errs, e)
+		}
+	}
+	m.syncErrors = errs
+	return nil
+}
+
+// ReplaceDiagnostics replaces the diagnostics stored for a file with the ones of its last parse.
+func (m *Memory) ReplaceDiagnostics(userID, fileID string, diagnostics []Diagnostic) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var kept []Diagnostic
+	for _, diagnostic := range m.diagnostics {
+		if diagnostic.UserID != userID || diagnostic.FileID != fileID {
+			kept = append(kept, diagnostic)
+		}
+	}
+	m.diagnostics = append(kept, diagnostics...)
+	return nil
+}
+
+// DeleteDiagnostics removes the diagnostics of every file of an user.
+func (m *Memory) DeleteDiagnostics(userID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var kept []Diagnostic
+	for _, diagnostic := range m.diagnostics {
+		if diagnostic.UserID != userID {
+			kept = append(kept, diagnostic)
+		}
+	}
+	m.diagnostics = kept
+	return nil
+}
+
+// GetDiagnostics retrieves the diagnostics of the files of an user.
+func (m *Memory) GetDiagnostics(userID string) ([]Diagnostic, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var diagnostics []Diagnostic
+	for _, diagnostic := range m.diagnostics {
+		if diagnostic.UserID == userID {
+			diagnostics = append(diagnostics, diagnostic)
+		}
+	}
+
+	sort.SliceStable(diagnostics, func(i, j int) bool {
+		if diagnostics[i].File != diagnostics[j].File {
+			return diagnostics[i].File < diagnostics[j].File
+		}
+		return diagnostics[i].Line < diagnostics[j].Line
+	})
+	return diagnostics, nil
+}
+
+// GetSettings retrieves the settings of an user, defaults are returned when none were saved.
+func (m *Memory) GetSettings(userID string) (Settings, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	settings := Settings{UserID: userID}
+	for _, s := range m.settings {
+		if s.UserID == userID {
+			settings = s
+		}
+	}
+
+	user, _ := m.user(userID)
+	settings.Timezone = user.Timezone
+	return settings.withDefaults(), nil
+}
+
+// SaveSettings creates or updates the settings of an user.
+func (m *Memory) SaveSettings(settings Settings) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.setTimezone(settings.UserID, settings.Timezone)
+
+	// Lists are read back as DB stores them
+	settings.Timezone = ""
+	settings.Folders = storedList(settings.Folders)
+	settings.DoneKeywords = storedList(settings.DoneKeywords)
+
+	for i, s := range m.settings {
+		if s.UserID == settings.UserID {
+			m.settings[i] = settings
+			return nil
+		}
+	}
+	m.settings = append(m.settings, settings)
+	return nil
+}
+
+// storedList returns a list as it is scanned after being stored.
+func storedList(l List) List {
+	value, _ := l.Value()
+
+	var stored List
+	stored.Scan(value)
+	return stored
+}
@@ -0,0 +1,623 @@
+package db
+
+import (
+	"context"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+	db "upper.io/db.v3"
+	"upper.io/db.v3/lib/sqlbuilder"
+	"upper.io/db.v3/postgresql"
+	"upper.io/db.v3/sqlite"
+)
+
+// migration changes the schema from the previous version to version.
+type migration struct {
+	version int
+	name    string
+	up      string
+}
+
+// sqliteMigrations are applied in order, a migration is never changed once
+// released, changes to the schema are new migrations for every adapter with
+// the same version.
+var sqliteMigrations = []migration{
+	{1, "create tables", `
+create table users (
+    id              integer primary key autoincrement,
+    email           text,
+    token_id        integer
+);
+
+create table tokens (
+    account       text unique primary key,
+    provider      text,
+    code          text,
+    token         text,
+    token_type    text,
+    token_refresh text,
+    expiry        datetime
+);
+
+create table map_google_dropbox (
+    google_id  text,
+    dropbox_id text
+);
+
+create table entries (
+    user_id       text,
+    title         text unique,
+    tag           text,
+    priority      text,
+    body          text,
+    created_at    datetime,
+    scheduled     datetime,
+    closed        datetime
+);
+
+create table sessions (
+    sid     text primary key,
+    account text
+);
+`},
+
+	// The users keep their google id as id so the records referencing them are unchanged
+	{2, "users and accounts", `
+drop table users;
+
+create table users (
+    id         text primary key,
+    email      text,
+    name       text,
+    timezone   text default '',
+    created_at datetime
+);
+
+create table accounts (
+    provider  text,
+    account   text,
+    user_id   text references users (id),
+    email     text,
+    linked_at datetime,
+    primary key (provider, account)
+);
+
+insert into users (id, created_at)
+    select account, current_timestamp from tokens where provider = 'google';
+
+insert into accounts (provider, account, user_id, linked_at)
+    select 'google', account, account, current_timestamp from tokens where provider = 'google';
+
+insert or ignore into accounts (provider, account, user_id, linked_at)
+    select 'dropbox', dropbox_id, google_id, current_timestamp from map_google_dropbox;
+
+drop table map_google_dropbox;
+`},
+
+	// Titles were unique across every user and file, entries stored before
+	// files were tracked are kept without a file.
+	{3, "entries by file", `
+create table entries_by_file (
+    user_id       text references users (id),
+    file_id       text,
+    file          text,
+    outline       text,
+    line          integer,
+    title         text,
+    parent        text,
+    tag           text,
+    tags          text,
+    category      text,
+    tasklist      text,
+    priority      text,
+    body          text,
+    created_at    datetime,
+    scheduled     datetime,
+    closed        datetime,
+    unique (user_id, file_id, title)
+);
+
+insert into entries_by_file (user_id, file_id, title, tag, priority, body, created_at, scheduled, closed)
+    select user_id, '', title, tag, priority, body, created_at, scheduled, closed from entries;
+
+drop table entries;
+
+alter table entries_by_file rename to entries;
+`},
+
+	{4, "token consent and encryption", `
+alter table tokens add column needs_consent boolean default false;
+alter table tokens add column key_id text default '';
+alter table tokens add column data_key text default '';
+`},
+
+	// Sessions never expired, they are signed out
+	{5, "expiring sessions", `
+drop table sessions;
+
+create table sessions (
+    sid        text primary key,
+    user_id    text references users (id),
+    user_agent text,
+    created_at datetime,
+    last_seen  datetime,
+    expires_at datetime,
+    idle_until datetime
+);
+`},
+
+	{6, "dropbox files and tasklists", `
+create table dropbox_files (
+    account text,
+    file_id text,
+    path    text,
+    primary key (account, file_id)
+);
+
+create table dropbox_cursors (
+    account text primary key,
+    cursor  text
+);
+
+create table tasklist_mappings (
+    user_id  text references users (id),
+    kind     text,
+    value    text,
+    tasklist text,
+    unique (user_id, kind, value)
+);
+
+create table tasklists (
+    user_id text references users (id),
+    title   text,
+    list_id text primary key
+);
+`},
+
+	{7, "settings, plans and trash", `
+create table settings (
+    user_id        text primary key references users (id),
+    always_preview boolean default false,
+    tasklist       text default 'orgo',
+    folders        text default '',
+    done_keywords  text default 'DONE',
+    deletion       text default 'guard'
+);
+
+create table plans (
+    id         integer primary key autoincrement,
+    user_id    text references users (id),
+    file_id    text,
+    status     text,
+    created_at datetime,
+    data       text
+);
+
+create table trash (
+    id         integer primary key autoincrement,
+    user_id    text references users (id),
+    tasklist   text,
+    title      text,
+    file       text,
+    deleted_at datetime,
+    data       text
+);
+`},
+
+	{8, "jobs and sync runs", `
+create table jobs (
+    id           integer primary key autoincrement,
+    kind         text,
+    account      text,
+    topic        text,
+    payload      text,
+    status       text,
+    attempts     integer default 0,
+    error        text,
+    run_at       datetime,
+    leased_until datetime,
+    created_at   datetime
+);
+
+create index jobs_status on jobs (status, run_at);
+
+create table sync_runs (
+    id          integer primary key autoincrement,
+    user_id     text references users (id),
+    job_id      integer,
+    kind        text,
+    account     text,
+    file        text,
+    status      text,
+    started_at  datetime,
+    finished_at datetime,
+    files       integer default 0,
+    created     integer default 0,
+    updated     integer default 0,
+    completed   integer default 0,
+    deleted     integer default 0
+);
+
+create table sync_errors (
+    run_id  integer,
+    class   text,
+    file    text,
+    line    integer,
+    message text
+);
+
+create table diagnostics (
+    user_id  text references users (id),
+    file_id  text,
+    file     text,
+    line     integer,
+    col      integer,
+    severity text,
+    message  text
+);
+`},
+
+	// Entries keep the task they were synced to, tasks are matched by id
+	// instead of their title and the file recorded in their notes.
+	{9, "entry task ids", `
+alter table entries add column task_id text default '';
+`},
+
+	// Workers only update the jobs they hold the lease of
+	{10, "job leases", `
+alter table jobs add column lease text default '';
+`},
+
+	// Tokens were keyed by account alone, the same id at two providers shared a row
+	{11, "tokens by provider", `
+create table tokens_by_provider (
+    provider      text,
+    account       text,
+    code          text,
+    token         text,
+    token_type    text,
+    token_refresh text,
+    expiry        datetime,
+    needs_consent boolean default false,
+    key_id        text default '',
+    data_key      text default '',
+    primary key (provider, account)
+);
+
+insert into tokens_by_provider (provider, account, code, token, token_type, token_refresh, expiry, needs_consent, key_id, data_key)
+    select provider, account, code, token, token_type, token_refresh, expiry, needs_consent, key_id, data_key from tokens;
+
+drop table tokens;
+
+alter table tokens_by_provider rename to tokens;
+`},
+
+	// Files were read in America/Los_Angeles before users had a timezone, the
+	// users created by the migration adding timezones keep it instead of moving
+	// to UTC, the users created since then read their files in UTC already
+	{12, "timezone of existing users", `
+update users set timezone = 'America/Los_Angeles'
+    where (timezone = '' or timezone is null)
+    and julianday(created_at) <= (select julianday(applied_at) from schema_version where version = 2);
+`},
+
+	// A file can repeat a heading, entries are unique by a key numbering the
+	// repeated titles instead of the title
+	{13, "entry keys", `
+create table entries_by_key (
+    user_id    text references users (id),
+    file_id    text,
+    file       text,
+    outline    text,
+    line       integer,
+    title      text,
+    parent     text,
+    tag        text,
+    tags       text,
+    category   text,
+    tasklist   text,
+    priority   text,
+    body       text,
+    created_at datetime,
+    scheduled  datetime,
+    closed     datetime,
+    task_id    text default '',
+    entry_key  text,
+    unique (user_id, file_id, entry_key)
+);
+
+insert into entries_by_key (user_id, file_id, file, outline, line, title, parent, tag, tags, category, tasklist, priority, body, created_at, scheduled, closed, task_id, entry_key)
+    select user_id, file_id, file, outline, line, title, parent, tag, tags, category, tasklist, priority, body, created_at, scheduled, closed, task_id, title from entries;
+
+drop table entries;
+
+alter table entries_by_key rename to entries;
+`},
+}
+
+// postgresMigrations start at the schema of the SQLite migrations at the
+// time PostgreSQL was supported, there are no older PostgreSQL databases.
+// SQLite does not enforce the references to users so they are left out.
+// Migrations of data only older SQLite databases have are skipped.
+var postgresMigrations = []migration{
+	{8, "create tables", `
+create table users (
+    id         text primary key,
+    email      text,
+    name       text,
+    timezone   text default '',
+    created_at timestamptz
+);
+
+create table accounts (
+    provider  text,
+    account   text,
+    user_id   text,
+    email     text,
+    linked_at timestamptz,
+    primary key (provider, account)
+);
+
+create table tokens (
+    account       text primary key,
+    provider      text,
+    code          text,
+    token         text,
+    token_type    text,
+    token_refresh text,
+    expiry        timestamptz,
+    needs_consent boolean default false,
+    key_id        text default '',
+    data_key      text default ''
+);
+
+create table entries (
+    user_id    text,
+    file_id    text,
+    file       text,
+    outline    text,
+    line       integer,
+    title      text,
+    parent     text,
+    tag        text,
+    tags       text,
+    category   text,
+    tasklist   text,
+    priority   text,
+    body       text,
+    created_at timestamptz,
+    scheduled  timestamptz,
+    closed     timestamptz,
+    unique (user_id, file_id, title)
+);
+
+create table sessions (
+    sid        text primary key,
+    user_id    text,
+    user_agent text,
+    created_at timestamptz,
+    last_seen  timestamptz,
+    expires_at timestamptz,
+    idle_until timestamptz
+);
+
+create table dropbox_files (
+    account text,
+    file_id text,
+    path    text,
+    primary key (account, file_id)
+);
+
+create table dropbox_cursors (
+    account text primary key,
+    cursor  text
+);
+
+create table tasklist_mappings (
+    user_id  text,
+    kind     text,
+    value    text,
+    tasklist text,
+    unique (user_id, kind, value)
+);
+
+create table tasklists (
+    user_id text,
+    title   text,
+    list_id text primary key
+);
+
+create table settings (
+    user_id        text primary key,
+    always_preview boolean default false,
+    tasklist       text default 'orgo',
+    folders        text default '',
+    done_keywords  text default 'DONE',
+    deletion       text default 'guard'
+);
+
+create table plans (
+    id         bigserial primary key,
+    user_id    text,
+    file_id    text,
+    status     text,
+    created_at timestamptz,
+    data       text
+);
+
+create table trash (
+    id         bigserial primary key,
+    user_id    text,
+    tasklist   text,
+    title      text,
+    file       text,
+    deleted_at timestamptz,
+    data       text
+);
+
+create table jobs (
+    id           bigserial primary key,
+    kind         text,
+    account      text,
+    topic        text,
+    payload      text,
+    status       text,
+    attempts     integer default 0,
+    error        text,
+    run_at       timestamptz,
+    leased_until timestamptz,
+    created_at   timestamptz
+);
+
+create index jobs_status on jobs (status, run_at);
+
+create table sync_runs (
+    id          bigserial primary key,
+    user_id     text,
+    job_id      bigint,
+    kind        text,
+    account     text,
+    file        text,
+    status      text,
+    started_at  timestamptz,
+    finished_at timestamptz,
+    files       integer default 0,
+    created     integer default 0,
+    updated     integer default 0,
+    completed   integer default 0,
+    deleted     integer default 0
+);
+
+create table sync_errors (
+    run_id  bigint,
+    class   text,
+    file    text,
+    line    integer,
+    message text
+);
+
+create table diagnostics (
+    user_id  text,
+    file_id  text,
+    file     text,
+    line     integer,
+    col      integer,
+    severity text,
+    message  text
+);
+`},
+
+	{9, "entry task ids", `
+alter table entries add column task_id text default '';
+`},
+
+	{10, "job leases", `
+alter table jobs add column lease text default '';
+`},
+
+	{11, "tokens by provider", `
+alter table tokens drop constraint tokens_pkey;
+alter table tokens add primary key (provider, account);
+`},
+
+	{13, "entry keys", `
+alter table entries add column entry_key text;
+update entries set entry_key = title;
+alter table entries drop constraint entries_user_id_file_id_title_key;
+alter table entries add unique (user_id, file_id, entry_key);
+`},
+}
+
+// schemaVersion records a migration applied to the database.
+type schemaVersion struct {
+	Version int       `db:"version"`
+	Name    string    `db:"name"`
+	Applied time.Time `db:"applied_at"`
+}
+
+// migrations returns the migrations of the adapter of the database.
+func (d *DB) migrations() []migration {
+	if d.adapter == postgresql.Adapter {
+		return postgresMigrations
+	}
+	return sqliteMigrations
+}
+
+// SchemaVersion returns the version of the schema of the database, 0 for an empty
+// database. SQLite databases created before versions were recorded have the tables
+// of the first migration and are at version 1.
+func (d *DB) SchemaVersion() (int, error) {
+	if !d.sess.Collection("schema_version").Exists() {
+		if d.adapter == sqlite.Adapter && d.sess.Collection("tokens").Exists() {
+			return 1, nil
+		}
+		return 0, nil
+	}
+
+	var version schemaVersion
+	err := d.sess.Collection("schema_version").Find().OrderBy("-version").One(&version)
+	if err == db.ErrNoMoreRows {
+		return 0, nil
+	}
+	return version.Version, errors.Wrap(err, "schema version")
+}
+
+// LatestVersion returns the version of the schema after every migration.
+func (d *DB) LatestVersion() int {
+	migrations := d.migrations()
+	return migrations[len(migrations)-1].version
+}
+
+// Migrate applies the migrations newer than the schema of the database, each
+// one in a transaction recording its version, and returns the number applied.
+func (d *DB) Migrate() (int, error) {
+	recorded := d.sess.Collection("schema_version").Exists()
+	current, err := d.SchemaVersion()
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = d.sess.Exec(`create table if not exists schema_version (
+    version    integer primary key,
+    name       text,
+    applied_at timestamp
+)`)
+	if err != nil {
+		return 0, errors.Wrap(err, "create schema_version")
+	}
+
+	migrations := d.migrations()
+	if !recorded && current > 0 {
+		if err := recordVersion(d.sess.Collection("schema_version"), migrations[0]); err != nil {
+			return 0, err
+		}
+	}
+
+	applied := 0
+	for _, m := range migrations {
+		if m.version <= current {
+			continue
+		}
+
+		err := d.sess.Tx(context.Background(), func(tx sqlbuilder.Tx) error {
+			if _, err := tx.Exec(m.up); err != nil {
+				return err
+			}
+			return recordVersion(tx.Collection("schema_version"), m)
+		})
+		if err != nil {
+			return applied, errors.Wrapf(err, "migration %d %s", m.version, m.name)
+		}
+
+		log.Infof("migrated to version %d: %s", m.version, m.name)
+		applied++
+	}
+	return applied, nil
+}
+
+// recordVersion records a migration as applied in the schema_version collection.
+func recordVersion(versions db.Collection, m migration) error {
+	_, err := versions.Insert(&schemaVersion{Version: m.version, Name: m.name, Applied: time.Now()})
+	return errors.Wrap(err, "record schema version")
+}
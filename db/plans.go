@@ -0,0 +1,98 @@
+package db
+
+import (
+	"time"
+
+	db "upper.io/db.v3"
+)
+
+// Plan statuses
+const (
+	PlanPending   = "pending"
+	PlanApplied   = "applied"
+	PlanDiscarded = "discarded"
+)
+
+// StoredPlan is a sync plan waiting for review, Data holds the plan encoded as JSON.
+type StoredPlan struct {
+	ID      int64     `db:"id,omitempty"`
+	UserID  string    `db:"user_id"`
+	FileID  string    `db:"file_id"`
+	Status  string    `db:"status"`
+	Created time.Time `db:"created_at"`
+	Data    string    `db:"data"`
+}
+
+// SavePlan stores a pending plan, the pending plan of the same file it replaces
+// is discarded so the jobs applying it find out.
+func (d *DB) SavePlan(plan StoredPlan) (int64, error) {
+	if err := d.DiscardPendingPlans(plan.UserID, plan.FileID); err != nil {
+		return 0, err
+	}
+
+	plan.Status = PlanPending
+	id, err := d.sess.Collection("plans").Insert(&plan)
+	if err != nil {
+		return 0, err
+	}
+	return toInt64(id), nil
+}
+
+// GetPlan retrieves a plan by id.
+func (d *DB) GetPlan(id int64) (StoredPlan, error) {
+	var plan StoredPlan
+	err := d.sess.Collection("plans").Find(db.Cond{"id": id}).One(&plan)
+	return plan, err
+}
+
+// GetPendingPlans retrieves the plans of an user waiting for review.
+func (d *DB) GetPendingPlans(userID string) ([]StoredPlan, error) {
+	var plans []StoredPlan
+	err := d.sess.Collection("plans").Find(
+		db.Cond{"user_id": userID},
+		db.Cond{"status": PlanPending},
+	).OrderBy("created_at").All(&plans)
+	return plans, err
+}
+
+// SetPlanStatus marks a plan as applied or discarded.
+func (d *DB) SetPlanStatus(id int64, status string) error {
+	res := d.sess.Collection("plans").Find(db.Cond{"id": id})
+	var plan StoredPlan
+	if err := res.One(&plan); err != nil {
+		return err
+	}
+
+	plan.Status = status
+	return res.Update(&plan)
+}
+
+// DiscardPendingPlans discards the pending plans of a file, a newer sync replaced them.
+func (d *DB) DiscardPendingPlans(userID, fileID string) error {
+	return d.sess.Collection("plans").Find(
+		db.Cond{"user_id": userID},
+		db.Cond{"file_id": fileID},
+		db.Cond{"status": PlanPending},
+	).Update(map[string]interface{}{"status": PlanDiscarded})
+}
+
+// DiscardUserPlans discards the pending plans of every file of an user.
+func (d *DB) DiscardUserPlans(userID string) error {
+	return d.sess.Collection("plans").Find(
+		db.Cond{"user_id": userID},
+		db.Cond{"status": PlanPending},
+	).Update(map[string]interface{}{"status": PlanDiscarded})
+}
+
+// toInt64 converts the id returned by an insert.
+func toInt64(id interface{}) int64 {
+	switch v := id.(type) {
+	case int64:
+		return v
+	case int:
+		return int64(v)
+	case uint64:
+		return int64(v)
+	}
+	return 0
+}
@@ -0,0 +1,116 @@
+package db
+
+import (
+	"time"
+
+	db "upper.io/db.v3"
+)
+
+// Sync run statuses
+const (
+	RunRunning = "running"
+	RunOK      = "ok"
+	RunFailed  = "failed"
+)
+
+// Error classes
+const (
+	// ErrorTransient errors are retried, the network or an api failed
+	ErrorTransient = "transient"
+	// ErrorAuth errors need the user to connect the account again
+	ErrorAuth = "auth"
+	// ErrorParse errors need the file to be fixed
+	ErrorParse = "parse"
+	// ErrorInternal errors fail the same way on every attempt
+	ErrorInternal = "internal"
+)
+
+// SyncRun records a job run of an user, Account is the dropbox account processed
+// and File the file synced, the counts are the changes applied to google tasks.
+type SyncRun struct {
+	ID        int64     `db:"id,omitempty" json:"id"`
+	UserID    string    `db:"user_id" json:"-"`
+	JobID     int64     `db:"job_id" json:"job_id"`
+	Kind      string    `db:"kind" json:"kind"`
+	Account   string    `db:"account" json:"account,omitempty"`
+	File      string    `db:"file" json:"file,omitempty"`
+	Status    string    `db:"status" json:"status"`
+	Started   time.Time `db:"started_at" json:"started_at"`
+	Finished  time.Time `db:"finished_at" json:"finished_at"`
+	Files     int       `db:"files" json:"files"`
+	Created   int       `db:"created" json:"created"`
+	Updated   int       `db:"updated" json:"updated"`
+	Completed int       `db:"completed" json:"completed"`
+	Deleted   int       `db:"deleted" json:"deleted"`
+
+	Errors []SyncError `db:"-" json:"errors,omitempty"`
+}
+
+// SyncError is an error of a sync run with the file and line it refers to.
+type SyncError struct {
+	RunID   int64  `db:"run_id" json:"-"`
+	Class   string `db:"class" json:"class"`
+	File    string `db:"file" json:"file,omitempty"`
+	Line    int    `db:"line" json:"line,omitempty"`
+	Message string `db:"message" json:"message"`
+}
+
+// StartRun records the start of a sync run.
+func (d *DB) StartRun(run *SyncRun) error {
+	run.Status = RunRunning
+	id, err := d.sess.Collection("sync_runs").Insert(run)
+	if err != nil {
+		return err
+	}
+
+	run.ID = toInt64(id)
+	return nil
+}
+
+// FinishRun records the end of a sync run and its errors.
+func (d *DB) FinishRun(run *SyncRun) error {
+	if err := d.sess.Collection("sync_runs").Find(db.Cond{"id": run.ID}).Update(run); err != nil {
+		return err
+	}
+
+	for _, e := range run.Errors {
+		e.RunID = run.ID
+		if _, err := d.sess.Collection("sync_errors").Insert(&e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetRuns retrieves the latest sync runs of an user with their errors.
+func (d *DB) GetRuns(userID string, limit int) ([]SyncRun, error) {
+	var runs []SyncRun
+	err := d.sess.Collection("sync_runs").Find(db.Cond{"user_id": userID}).OrderBy("-started_at").Limit(limit).All(&runs)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range runs {
+		err := d.sess.Collection("sync_errors").Find(db.Cond{"run_id": runs[i].ID}).All(&runs[i].Errors)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return runs, nil
+}
+
+// PurgeRuns removes the sync runs started before a time and their errors.
+func (d *DB) PurgeRuns(before time.Time) error {
+	var runs []SyncRun
+	res := d.sess.Collection("sync_runs").Find(db.Cond{"started_at <": before})
+	if err := res.All(&runs); err != nil {
+		return err
+	}
+
+	for _, run := range runs {
+		if err := d.sess.Collection("sync_errors").Find(db.Cond{"run_id": run.ID}).Delete(); err != nil {
+			return err
+		}
+	}
+	return res.Delete()
+}
@@ -1,33 +1,110 @@
 package db
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"time"
+
 	db "upper.io/db.v3"
 
 	"github.com/google/uuid"
 )
 
+// Session of an user signed in, a session expires at Expires or when it
+// is not used until IdleUntil.
 type Session struct {
-	ID      string `db:"sid"`
-	Account string `db:"account"`
+	ID        string    `db:"sid"`
+	UserID    string    `db:"user_id"`
+	UserAgent string    `db:"user_agent"`
+	Created   time.Time `db:"created_at"`
+	LastSeen  time.Time `db:"last_seen"`
+	Expires   time.Time `db:"expires_at"`
+	IdleUntil time.Time `db:"idle_until"`
+}
+
+// Handle identifies the session in pages without its id, knowing the id of
+// a session is enough to use it.
+func (s Session) Handle() string {
+	sum := sha256.Sum256([]byte(s.ID))
+	return hex.EncodeToString(sum[:16])
 }
 
-// SaveSession creates an uuid ID for the given userID as a session.
-func (d *DB) SaveSession(userID string) (string, error) {
+// active returns a condition matching the sessions not expired at now.
+func active(now time.Time) db.Cond {
+	return db.Cond{"expires_at >": now, "idle_until >": now}
+}
+
+// SaveSession creates an uuid ID for the given userID as a session, lasting
+// for ttl unless it is not used for idle.
+func (d *DB) SaveSession(userID, userAgent string, ttl, idle time.Duration) (string, error) {
+	now := time.Now()
 	sessionID := uuid.New().String()
 	sessionCollection := d.sess.Collection("sessions")
-	if _, err := sessionCollection.Insert(&Session{ID: sessionID, Account: userID}); err != nil {
+	session := &Session{
+		ID:        sessionID,
+		UserID:    userID,
+		UserAgent: userAgent,
+		Created:   now,
+		LastSeen:  now,
+		Expires:   now.Add(ttl),
+		IdleUntil: now.Add(idle),
+	}
+	if _, err := sessionCollection.Insert(session); err != nil {
 		return "", err
 	}
 	return sessionID, nil
 }
 
-// GetSession retrieves the userID for the sessionID provided.
+// GetSession retrieves the userID for the sessionID provided, expired
+// and unknown sessions return db.ErrNoMoreRows.
 func (d *DB) GetSession(sessionID string) (string, error) {
-	var sessions []Session
-	err := d.sess.Collection("sessions").Find(db.Cond{"sid": sessionID}).All(&sessions)
+	var session Session
+	err := d.sess.Collection("sessions").Find(db.Cond{"sid": sessionID}, active(time.Now())).One(&session)
 	if err != nil {
 		return "", err
 	}
+	return session.UserID, nil
+}
+
+// TouchSession retrieves the userID for the sessionID provided and keeps
+// the session from expiring idle for another idle duration.
+func (d *DB) TouchSession(sessionID string, idle time.Duration) (string, error) {
+	now := time.Now()
+	res := d.sess.Collection("sessions").Find(db.Cond{"sid": sessionID}, active(now))
+
+	var session Session
+	if err := res.One(&session); err != nil {
+		return "", err
+	}
+
+	err := res.Update(map[string]interface{}{
+		"last_seen":  now,
+		"idle_until": now.Add(idle),
+	})
+	return session.UserID, err
+}
+
+// GetSessions retrieves the active sessions of an user, the last used first.
+func (d *DB) GetSessions(userID string) ([]Session, error) {
+	var sessions []Session
+	err := d.sess.Collection("sessions").Find(db.Cond{"user_id": userID}, active(time.Now())).OrderBy("-last_seen").All(&sessions)
+	return sessions, err
+}
+
+// DeleteSession removes a session, signing it out.
+func (d *DB) DeleteSession(sessionID string) error {
+	return d.sess.Collection("sessions").Find(db.Cond{"sid": sessionID}).Delete()
+}
+
+// DeleteSessions removes every session of an user, signing them out everywhere.
+func (d *DB) DeleteSessions(userID string) error {
+	return d.sess.Collection("sessions").Find(db.Cond{"user_id": userID}).Delete()
+}
 
-	return sessions[0].Account, nil
+// PurgeSessions removes the sessions expired before a time.
+func (d *DB) PurgeSessions(before time.Time) error {
+	return d.sess.Collection("sessions").Find(db.Or(
+		db.Cond{"expires_at <": before},
+		db.Cond{"idle_until <": before},
+	)).Delete()
 }
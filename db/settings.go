@@ -0,0 +1,170 @@
+package db
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"strings"
+
+	db "upper.io/db.v3"
+)
+
+// Deletion policies, what happens to the tasks of entries removed from the files.
+const (
+	// DeletionGuard deletes the tasks and holds mass deletions for review
+	DeletionGuard = "guard"
+	// DeletionReview holds every deletion for review
+	DeletionReview = "review"
+	// DeletionAlways deletes the tasks without review
+	DeletionAlways = "always"
+	// DeletionKeep leaves the tasks in google tasks
+	DeletionKeep = "keep"
+)
+
+// Defaults of the settings not saved by an user.
+const (
+	DefaultTasklist = "orgo"
+	DefaultDeletion = DeletionGuard
+)
+
+// DefaultDoneKeywords are the keywords completing a task by default.
+var DefaultDoneKeywords = List{"DONE"}
+
+// List is a list of values stored separated by commas.
+type List []string
+
+// Value implements driver.Valuer.
+func (l List) Value() (driver.Value, error) {
+	return strings.Join(l, ","), nil
+}
+
+// Scan implements sql.Scanner.
+func (l *List) Scan(src interface{}) error {
+	var s string
+	switch v := src.(type) {
+	case nil:
+	case string:
+		s = v
+	case []byte:
+		s = string(v)
+	default:
+		return fmt.Errorf("scan list from %T", src)
+	}
+
+	*l = nil
+	for _, value := range strings.Split(s, ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			*l = append(*l, value)
+		}
+	}
+	return nil
+}
+
+// Settings are the sync preferences of an user.
+type Settings struct {
+	UserID        string `db:"user_id" json:"-"`
+	AlwaysPreview bool   `db:"always_preview" json:"always_preview"`
+	// Tasklist receives the entries without a mapping
+	Tasklist string `db:"tasklist" json:"tasklist"`
+	// Folders synced from dropbox, every folder when empty
+	Folders List `db:"folders" json:"folders"`
+	// DoneKeywords are the heading keywords completing a task
+	DoneKeywords List `db:"done_keywords" json:"done_keywords"`
+	// Deletion is the deletion policy
+	Deletion string `db:"deletion" json:"deletion"`
+	// Timezone of the user, stored with the user
+	Timezone string `db:"-" json:"timezone"`
+}
+
+// withDefaults fills the settings an user did not save.
+func (s Settings) withDefaults() Settings {
+	if s.Tasklist == "" {
+		s.Tasklist = DefaultTasklist
+	}
+	if len(s.DoneKeywords) == 0 {
+		s.DoneKeywords = DefaultDoneKeywords
+	}
+	if s.Deletion == "" {
+		s.Deletion = DefaultDeletion
+	}
+	return s
+}
+
+// Validate returns an error describing the first invalid setting.
+func (s Settings) Validate() error {
+	if strings.TrimSpace(s.Tasklist) == "" {
+		return fmt.Errorf("tasklist is empty")
+	}
+
+	for _, folder := range s.Folders {
+		if !strings.HasPrefix(folder, "/") {
+			return fmt.Errorf("folder %q must start with /", folder)
+		}
+	}
+
+	for _, keyword := range s.DoneKeywords {
+		if keyword != strings.ToUpper(keyword) || strings.ContainsAny(keyword, " \t:") {
+			return fmt.Errorf("keyword %q must be an uppercase word", keyword)
+		}
+	}
+
+	switch s.Deletion {
+	case DeletionGuard, DeletionReview, DeletionAlways, DeletionKeep:
+	default:
+		return fmt.Errorf("unknown deletion policy %q", s.Deletion)
+	}
+	return nil
+}
+
+// InFolders reports whether a dropbox path is in the folders synced.
+func (s Settings) InFolders(path string) bool {
+	if len(s.Folders) == 0 {
+		return true
+	}
+
+	for _, folder := range s.Folders {
+		folder = strings.TrimSuffix(strings.ToLower(folder), "/")
+		if folder == "" || path == folder || strings.HasPrefix(path, folder+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// GetSettings retrieves the settings of an user, defaults are returned when none were saved.
+func (d *DB) GetSettings(userID string) (Settings, error) {
+	settings := Settings{UserID: userID}
+	err := d.sess.Collection("settings").Find(db.Cond{"user_id": userID}).One(&settings)
+	if err == db.ErrNoMoreRows {
+		settings, err = Settings{UserID: userID}, nil
+	}
+	if err != nil {
+		return settings, err
+	}
+
+	user, err := d.GetUser(userID)
+	if err != nil && err != db.ErrNoMoreRows {
+		return settings, err
+	}
+	settings.Timezone = user.Timezone
+	return settings.withDefaults(), nil
+}
+
+// SaveSettings creates or updates the settings of an user.
+func (d *DB) SaveSettings(settings Settings) error {
+	if err := d.SetTimezone(settings.UserID, settings.Timezone); err != nil {
+		return err
+	}
+
+	res := d.sess.Collection("settings").Find(db.Cond{"user_id": settings.UserID})
+	count, err := res.Count()
+	if err != nil {
+		return err
+	}
+
+	if count > 0 {
+		return res.Update(&settings)
+	}
+
+	_, err = d.sess.Collection("settings").Insert(&settings)
+	return err
+}
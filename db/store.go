@@ -0,0 +1,153 @@
+package db
+
+import (
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// Store is the storage of orgo, DB implements it on SQLite and PostgreSQL.
+type Store interface {
+	EntryStore
+	TokenStore
+	SessionStore
+	MappingStore
+	UserStore
+	FileStore
+	JobStore
+	PlanStore
+	TrashStore
+	RunStore
+	DiagnosticStore
+	SettingsStore
+
+	// SchemaVersion returns the version of the schema, LatestVersion the version after Migrate
+	SchemaVersion() (int, error)
+	LatestVersion() int
+	// Migrate applies the migrations newer than the schema and returns the number applied
+	Migrate() (int, error)
+	Close() error
+}
+
+// EntryStore stores the entries parsed from the files of the users.
+type EntryStore interface {
+	GetEntry(userID, fileID, title string) (*OrgEntry, error)
+	SaveEntry(entry *OrgEntry) error
+	GetEntries(userID string) ([]*OrgEntry, error)
+	GetFileEntries(userID, fileID string) ([]*OrgEntry, error)
+	DeleteFileEntries(userID, fileID string) error
+	DeleteEntries(userID string) error
+	ReplaceFileEntries(userID, fileID string, entries []*OrgEntry) error
+}
+
+// TokenStore stores the oauth tokens of the accounts.
+type TokenStore interface {
+	SaveToken(provider, account, code string, token *oauth2.Token) error
+	UpdateToken(provider, account string, token *oauth2.Token) error
+	SetNeedsConsent(provider, account string) error
+	GetToken(provider, account string) (Token, error)
+	DeleteToken(provider, account string) error
+	EncryptTokens() (int, error)
+}
+
+// SessionStore stores the sessions of the users signed in.
+type SessionStore interface {
+	SaveSession(userID, userAgent string, ttl, idle time.Duration) (string, error)
+	GetSession(sessionID string) (string, error)
+	TouchSession(sessionID string, idle time.Duration) (string, error)
+	GetSessions(userID string) ([]Session, error)
+	DeleteSession(sessionID string) error
+	DeleteSessions(userID string) error
+	PurgeSessions(before time.Time) error
+}
+
+// MappingStore stores the tasklist mappings of the users and the tasklists created by orgo.
+type MappingStore interface {
+	GetMappings(userID string) ([]TasklistMapping, error)
+	SaveMapping(mapping TasklistMapping) error
+	DeleteMapping(userID, kind, value string) error
+	GetTasklists(userID string) ([]Tasklist, error)
+	SaveTasklist(list Tasklist) error
+	DeleteTasklist(userID, listID string) error
+}
+
+// UserStore stores the users and the accounts linked to them.
+type UserStore interface {
+	SignIn(googleID, email, name string) (User, error)
+	GetUser(userID string) (User, error)
+	SetTimezone(userID, timezone string) error
+	LinkAccount(account Account) error
+	UnlinkAccount(provider, account string) error
+	GetAccounts(userID, provider string) ([]Account, error)
+	GetAccountID(userID, provider string) (string, error)
+	GetAccountUser(provider, account string) (string, error)
+}
+
+// FileStore stores the dropbox files and cursors of the accounts.
+type FileStore interface {
+	GetFiles(account string) ([]DropboxFile, error)
+	GetFile(account, fileID string) (DropboxFile, error)
+	SaveFile(file DropboxFile) error
+	DeleteFile(account, fileID string) error
+	DeleteFiles(account string) error
+	GetCursor(account string) (string, error)
+	SaveCursor(account, cursor string) error
+	DeleteCursor(account string) error
+}
+
+// JobStore is the queue of jobs run by the workers.
+type JobStore interface {
+	EnqueueJob(kind, account, topic string, payload interface{}) (int64, error)
+	LeaseJob(lease time.Duration) (*Job, error)
+	HeartbeatJob(id int64, lease string, duration time.Duration) error
+	CompleteJob(id int64, lease string) error
+	FailJob(id int64, lease, message string, next time.Time) error
+	CountJobs(status string) (int, error)
+	ReleaseJob(id int64, lease string) error
+	CancelJobs(account string, kinds ...string) error
+	CancelTopic(account, topic string) error
+	GetJob(id int64) (Job, error)
+	PurgeJobs(before time.Time) error
+}
+
+// PlanStore stores the sync plans waiting for review.
+type PlanStore interface {
+	SavePlan(plan StoredPlan) (int64, error)
+	GetPlan(id int64) (StoredPlan, error)
+	GetPendingPlans(userID string) ([]StoredPlan, error)
+	SetPlanStatus(id int64, status string) error
+	DiscardPendingPlans(userID, fileID string) error
+	DiscardUserPlans(userID string) error
+}
+
+// TrashStore stores the tasks deleted by syncs.
+type TrashStore interface {
+	SaveTrash(entry TrashEntry) error
+	GetTrash(userID string) ([]TrashEntry, error)
+	GetTrashEntry(id int64) (TrashEntry, error)
+	DeleteTrash(id int64) error
+	PurgeTrash(before time.Time) error
+}
+
+// RunStore stores the sync runs and their errors.
+type RunStore interface {
+	StartRun(run *SyncRun) error
+	FinishRun(run *SyncRun) error
+	GetRuns(userID string, limit int) ([]SyncRun, error)
+	PurgeRuns(before time.Time) error
+}
+
+// DiagnosticStore stores the problems found parsing the files.
+type DiagnosticStore interface {
+	ReplaceDiagnostics(userID, fileID string, diagnostics []Diagnostic) error
+	DeleteDiagnostics(userID string) error
+	GetDiagnostics(userID string) ([]Diagnostic, error)
+}
+
+// SettingsStore stores the settings of the users.
+type SettingsStore interface {
+	GetSettings(userID string) (Settings, error)
+	SaveSettings(settings Settings) error
+}
+
+var _ Store = (*DB)(nil)
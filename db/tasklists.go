@@ -0,0 +1,72 @@
+package db
+
+import (
+	db "upper.io/db.v3"
+)
+
+// Mapping kinds, a tag mapping takes precedence over a category
+// mapping which takes precedence over a file mapping.
+const (
+	MappingTag      = "tag"
+	MappingCategory = "category"
+	MappingFile     = "file"
+)
+
+// TasklistMapping maps entries from a file, category or tag to a google tasklist.
+type TasklistMapping struct {
+	UserID   string `db:"user_id" json:"-"`
+	Kind     string `db:"kind" json:"kind"`
+	Value    string `db:"value" json:"value"`
+	Tasklist string `db:"tasklist" json:"tasklist"`
+}
+
+// Tasklist is a google tasklist created and managed by orgo.
+type Tasklist struct {
+	UserID string `db:"user_id"`
+	Title  string `db:"title"`
+	ListID string `db:"list_id"`
+}
+
+// GetMappings retrieves the tasklist mappings of an user.
+func (d *DB) GetMappings(userID string) ([]TasklistMapping, error) {
+	var mappings []TasklistMapping
+	err := d.sess.Collection("tasklist_mappings").Find(db.Cond{"user_id": userID}).All(&mappings)
+	return mappings, err
+}
+
+// SaveMapping creates a mapping or replaces the tasklist of an existing one.
+func (d *DB) SaveMapping(mapping TasklistMapping) error {
+	if err := d.DeleteMapping(mapping.UserID, mapping.Kind, mapping.Value); err != nil {
+		return err
+	}
+
+	_, err := d.sess.Collection("tasklist_mappings").Insert(&mapping)
+	return err
+}
+
+// DeleteMapping removes a mapping.
+func (d *DB) DeleteMapping(userID, kind, value string) error {
+	return d.sess.Collection("tasklist_mappings").Find(
+		db.Cond{"user_id": userID},
+		db.Cond{"kind": kind},
+		db.Cond{"value": value},
+	).Delete()
+}
+
+// GetTasklists retrieves the tasklists managed by orgo for an user.
+func (d *DB) GetTasklists(userID string) ([]Tasklist, error) {
+	var lists []Tasklist
+	err := d.sess.Collection("tasklists").Find(db.Cond{"user_id": userID}).All(&lists)
+	return lists, err
+}
+
+// SaveTasklist records a tasklist created by orgo.
+func (d *DB) SaveTasklist(list Tasklist) error {
+	_, err := d.sess.Collection("tasklists").Insert(&list)
+	return err
+}
+
+// DeleteTasklist forgets a tasklist managed by orgo.
+func (d *DB) DeleteTasklist(userID, listID string) error {
+	return d.sess.Collection("tasklists").Find(db.Cond{"user_id": userID}, db.Cond{"list_id": listID}).Delete()
+}
@@ -1,12 +1,15 @@
 package db
 
 import (
+	"context"
+	"fmt"
 	"time"
 
 	"github.com/pkg/errors"
 	"golang.org/x/oauth2"
 
 	db "upper.io/db.v3"
+	"upper.io/db.v3/lib/sqlbuilder"
 )
 
 type Token struct {
@@ -17,53 +20,214 @@ type Token struct {
 	Code         string    `db:"code"`
 	Provider     string    `db:"provider"`
 	Account      string    `db:"account"`
+	// NeedsConsent is set when the token can not be refreshed, the user must authorize again
+	NeedsConsent bool `db:"needs_consent"`
+	// KeyID is the key encrypting DataKey, the key encrypting the tokens,
+	// tokens saved without a keyring are not encrypted and have no key.
+	KeyID   string `db:"key_id"`
+	DataKey string `db:"data_key"`
+
+	// legacy is set when the tokens decrypted only authenticated the account
+	legacy bool
 }
 
-type MapGoogleDropbox struct {
-	GoogleID  string `db:"google_id"`
-	DropboxID string `db:"dropbox_id"`
+// sealedData returns the data authenticated with the tokens, the provider and
+// the account bind them to their row so they can not be swapped between rows.
+func (t *Token) sealedData() []byte {
+	return []byte(t.Provider + "\x00" + t.Account)
 }
 
-// SaveGoogleDropbox creates the map between google and dropbox accounts.
-func (d *DB) SaveGoogleDropbox(googleID, dropboxID string) error {
-	col := d.sess.Collection("map_google_dropbox")
-	_, err := col.Insert(&MapGoogleDropbox{GoogleID: googleID, DropboxID: dropboxID})
-	return err
+// encrypt encrypts the tokens with a new data key when there is a keyring.
+func (t *Token) encrypt(keyring *Keyring) error {
+	t.KeyID, t.DataKey = "", ""
+	if keyring == nil {
+		return nil
+	}
+
+	dataKey, wrapped, err := keyring.newDataKey()
+	if err != nil {
+		return errors.Wrap(err, "new data key")
+	}
+
+	if t.AccessToken, err = seal(dataKey, []byte(t.AccessToken), t.sealedData()); err != nil {
+		return err
+	}
+	if t.RefreshToken, err = seal(dataKey, []byte(t.RefreshToken), t.sealedData()); err != nil {
+		return err
+	}
+
+	t.KeyID, t.DataKey = keyring.Current(), wrapped
+	return nil
 }
 
-// GetDropboxID retrieves the dropbox id for a given google id.
-func (d *DB) GetDropboxID(googleID string) (string, error) {
-	var result MapGoogleDropbox
-	if err := d.sess.Collection("map_google_dropbox").Find(db.Cond{"google_id": googleID}).One(&result); err != nil {
-		return "", err
+// decrypt decrypts the tokens of an encrypted token.
+func (t *Token) decrypt(keyring *Keyring) error {
+	if t.KeyID == "" {
+		return nil
+	}
+	if keyring == nil {
+		return fmt.Errorf("token of %s encrypted with key %s without a keyring", t.Account, t.KeyID)
+	}
+
+	dataKey, err := keyring.dataKey(t.KeyID, t.DataKey)
+	if err != nil {
+		return errors.Wrapf(err, "data key of %s", t.Account)
+	}
+
+	// Tokens encrypted before the provider was authenticated open with the
+	// account alone until they are encrypted again
+	data := t.sealedData()
+	access, err := open(dataKey, t.AccessToken, data)
+	if err != nil {
+		data = []byte(t.Account)
+		if access, err = open(dataKey, t.AccessToken, data); err != nil {
+			return errors.Wrapf(err, "access token of %s", t.Account)
+		}
+		t.legacy = true
 	}
-	return result.DropboxID, nil
+	refresh, err := open(dataKey, t.RefreshToken, data)
+	if err != nil {
+		return errors.Wrapf(err, "refresh token of %s", t.Account)
+	}
+
+	t.AccessToken, t.RefreshToken = string(access), string(refresh)
+	t.KeyID, t.DataKey = "", ""
+	return nil
 }
 
-func (d *DB) GetGoogleID(dropboxID string) (string, error) {
-	var result MapGoogleDropbox
-	err := d.sess.Collection("map_google_dropbox").Find(db.Cond{"dropbox_id": dropboxID}).One(&result)
-	return result.GoogleID, err
+// OAuth2 returns the token as an oauth2 token.
+func (t Token) OAuth2() *oauth2.Token {
+	return &oauth2.Token{
+		AccessToken:  t.AccessToken,
+		TokenType:    t.TokenType,
+		RefreshToken: t.RefreshToken,
+		Expiry:       t.Expiry,
+	}
 }
 
-// SaveToken saves the code from an OAUTH nepotiation with a provider for a specific account.
+// SaveToken saves the code from an OAUTH nepotiation with a provider for a specific account,
+// authorizing an account again replaces its token and keeps the refresh token when none is given.
 func (d *DB) SaveToken(provider, account, code string, token *oauth2.Token) error {
-	col := d.sess.Collection("tokens")
-	_, err := col.Insert(&Token{
-		Account:      account,
-		Provider:     provider,
-		AccessToken:  token.AccessToken,
-		TokenType:    token.TokenType,
-		RefreshToken: token.RefreshToken,
-		Expiry:       token.Expiry,
-		Code:         code,
+	return d.sess.Tx(context.Background(), func(tx sqlbuilder.Tx) error {
+		res := tx.Collection("tokens").Find(db.Cond{"provider": provider}, db.Cond{"account": account})
+
+		var current Token
+		err := res.One(&current)
+		if err != nil && err != db.ErrNoMoreRows {
+			return err
+		}
+		if err := current.decrypt(d.keyring); err != nil {
+			return err
+		}
+
+		saved := Token{
+			Account:      account,
+			Provider:     provider,
+			AccessToken:  token.AccessToken,
+			TokenType:    token.TokenType,
+			RefreshToken: token.RefreshToken,
+			Expiry:       token.Expiry,
+			Code:         code,
+		}
+
+		if err == db.ErrNoMoreRows {
+			if err := saved.encrypt(d.keyring); err != nil {
+				return err
+			}
+			_, err := tx.Collection("tokens").Insert(&saved)
+			return err
+		}
+
+		if saved.RefreshToken == "" {
+			saved.RefreshToken = current.RefreshToken
+		}
+		if err := saved.encrypt(d.keyring); err != nil {
+			return err
+		}
+		return res.Update(&saved)
+	})
+}
+
+// UpdateToken saves a refreshed token of an account.
+func (d *DB) UpdateToken(provider, account string, token *oauth2.Token) error {
+	saved := Token{Provider: provider, Account: account, AccessToken: token.AccessToken, RefreshToken: token.RefreshToken}
+	if err := saved.encrypt(d.keyring); err != nil {
+		return err
+	}
+
+	return d.sess.Collection("tokens").Find(db.Cond{"provider": provider}, db.Cond{"account": account}).Update(map[string]interface{}{
+		"token":         saved.AccessToken,
+		"token_type":    token.TokenType,
+		"token_refresh": saved.RefreshToken,
+		"expiry":        token.Expiry,
+		"needs_consent": false,
+		"key_id":        saved.KeyID,
+		"data_key":      saved.DataKey,
+	})
+}
+
+// SetNeedsConsent marks the token of an account as needing the user to authorize again.
+func (d *DB) SetNeedsConsent(provider, account string) error {
+	return d.sess.Collection("tokens").Find(db.Cond{"provider": provider}, db.Cond{"account": account}).Update(map[string]interface{}{
+		"needs_consent": true,
 	})
-	return err
 }
 
 // GetToken retrieves the token for a provider and account.
 func (d *DB) GetToken(provider, account string) (Token, error) {
 	var result Token
 	err := d.sess.Collection("tokens").Find(db.Cond{"provider": provider}, db.Cond{"account": account}).One(&result)
-	return result, errors.Wrap(err, "get token")
+	if err != nil {
+		return result, errors.Wrap(err, "get token")
+	}
+	return result, errors.Wrap(result.decrypt(d.keyring), "get token")
+}
+
+// DeleteToken removes the token of an account.
+func (d *DB) DeleteToken(provider, account string) error {
+	return d.sess.Collection("tokens").Find(db.Cond{"provider": provider}, db.Cond{"account": account}).Delete()
+}
+
+// EncryptTokens encrypts the tokens not encrypted with the current key of the
+// keyring, tokens saved in plaintext, with a key being rotated out or only
+// authenticating their account, and returns the number of tokens encrypted.
+func (d *DB) EncryptTokens() (int, error) {
+	if d.keyring == nil {
+		return 0, errors.New("encrypt tokens without a keyring")
+	}
+
+	count := 0
+	err := d.sess.Tx(context.Background(), func(tx sqlbuilder.Tx) error {
+		var tokens []Token
+		if err := tx.Collection("tokens").Find().All(&tokens); err != nil {
+			return err
+		}
+
+		for _, token := range tokens {
+			keyID := token.KeyID
+			if err := token.decrypt(d.keyring); err != nil {
+				return err
+			}
+			if keyID == d.keyring.Current() && !token.legacy {
+				continue
+			}
+
+			if err := token.encrypt(d.keyring); err != nil {
+				return err
+			}
+
+			err := tx.Collection("tokens").Find(db.Cond{"provider": token.Provider}, db.Cond{"account": token.Account}).Update(map[string]interface{}{
+				"token":         token.AccessToken,
+				"token_refresh": token.RefreshToken,
+				"key_id":        token.KeyID,
+				"data_key":      token.DataKey,
+			})
+			if err != nil {
+				return err
+			}
+			count++
+		}
+		return nil
+	})
+	return count, err
 }
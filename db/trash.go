@@ -0,0 +1,49 @@
+package db
+
+import (
+	"time"
+
+	db "upper.io/db.v3"
+)
+
+// TrashEntry is a task deleted by a sync, Data holds the task encoded as JSON
+// so it can be restored until the retention period expires.
+type TrashEntry struct {
+	ID       int64     `db:"id,omitempty" json:"id"`
+	UserID   string    `db:"user_id" json:"-"`
+	Tasklist string    `db:"tasklist" json:"tasklist"`
+	Title    string    `db:"title" json:"title"`
+	File     string    `db:"file" json:"file"`
+	Deleted  time.Time `db:"deleted_at" json:"deleted_at"`
+	Data     string    `db:"data" json:"-"`
+}
+
+// SaveTrash keeps a deleted task in the trash.
+func (d *DB) SaveTrash(entry TrashEntry) error {
+	_, err := d.sess.Collection("trash").Insert(&entry)
+	return err
+}
+
+// GetTrash retrieves the deleted tasks of an user, most recent first.
+func (d *DB) GetTrash(userID string) ([]TrashEntry, error) {
+	var entries []TrashEntry
+	err := d.sess.Collection("trash").Find(db.Cond{"user_id": userID}).OrderBy("-deleted_at").All(&entries)
+	return entries, err
+}
+
+// GetTrashEntry retrieves a deleted task by id.
+func (d *DB) GetTrashEntry(id int64) (TrashEntry, error) {
+	var entry TrashEntry
+	err := d.sess.Collection("trash").Find(db.Cond{"id": id}).One(&entry)
+	return entry, err
+}
+
+// DeleteTrash removes a task from the trash.
+func (d *DB) DeleteTrash(id int64) error {
+	return d.sess.Collection("trash").Find(db.Cond{"id": id}).Delete()
+}
+
+// PurgeTrash removes the tasks deleted before a time.
+func (d *DB) PurgeTrash(before time.Time) error {
+	return d.sess.Collection("trash").Find(db.Cond{"deleted_at <": before}).Delete()
+}
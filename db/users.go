@@ -0,0 +1,114 @@
+package db
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/uuid"
+	db "upper.io/db.v3"
+	"upper.io/db.v3/lib/sqlbuilder"
+)
+
+// User of orgo, every other record of an user references its ID.
+type User struct {
+	ID       string    `db:"id" json:"id"`
+	Email    string    `db:"email" json:"email"`
+	Name     string    `db:"name" json:"name"`
+	Timezone string    `db:"timezone" json:"timezone"`
+	Created  time.Time `db:"created_at" json:"created_at"`
+}
+
+// Account is a google or dropbox account linked to an user, an user signs
+// in with a single google account and can link many dropbox accounts.
+type Account struct {
+	Provider string    `db:"provider" json:"provider"`
+	Account  string    `db:"account" json:"account"`
+	UserID   string    `db:"user_id" json:"-"`
+	Email    string    `db:"email" json:"email"`
+	Linked   time.Time `db:"linked_at" json:"linked_at"`
+}
+
+// SignIn returns the user signed in with a google account, creating the user on its first sign in.
+func (d *DB) SignIn(googleID, email, name string) (User, error) {
+	var user User
+	err := d.sess.Tx(context.Background(), func(tx sqlbuilder.Tx) error {
+		var account Account
+		err := tx.Collection("accounts").Find(db.Cond{"provider": "google"}, db.Cond{"account": googleID}).One(&account)
+		if err != nil && err != db.ErrNoMoreRows {
+			return err
+		}
+
+		if err == db.ErrNoMoreRows {
+			user = User{ID: uuid.New().String(), Email: email, Name: name, Created: time.Now()}
+			if _, err := tx.Collection("users").Insert(&user); err != nil {
+				return err
+			}
+
+			account = Account{Provider: "google", Account: googleID, UserID: user.ID, Email: email, Linked: time.Now()}
+			_, err := tx.Collection("accounts").Insert(&account)
+			return err
+		}
+
+		res := tx.Collection("users").Find(db.Cond{"id": account.UserID})
+		if err := res.One(&user); err != nil {
+			return err
+		}
+
+		// The profile follows the one of the google account
+		user.Email, user.Name = email, name
+		return res.Update(map[string]interface{}{"email": email, "name": name})
+	})
+	return user, err
+}
+
+// GetUser retrieves an user by id.
+func (d *DB) GetUser(userID string) (User, error) {
+	var user User
+	err := d.sess.Collection("users").Find(db.Cond{"id": userID}).One(&user)
+	return user, err
+}
+
+// SetTimezone sets the timezone the files of an user are read in, an IANA name as "Europe/Lisbon".
+func (d *DB) SetTimezone(userID, timezone string) error {
+	return d.sess.Collection("users").Find(db.Cond{"id": userID}).Update(map[string]interface{}{"timezone": timezone})
+}
+
+// LinkAccount links an account to an user, an account linked to another user is moved to this one.
+func (d *DB) LinkAccount(account Account) error {
+	return d.sess.Tx(context.Background(), func(tx sqlbuilder.Tx) error {
+		res := tx.Collection("accounts").Find(db.Cond{"provider": account.Provider}, db.Cond{"account": account.Account})
+		if err := res.Delete(); err != nil {
+			return err
+		}
+
+		account.Linked = time.Now()
+		_, err := tx.Collection("accounts").Insert(&account)
+		return err
+	})
+}
+
+// UnlinkAccount removes an account from its user.
+func (d *DB) UnlinkAccount(provider, account string) error {
+	return d.sess.Collection("accounts").Find(db.Cond{"provider": provider}, db.Cond{"account": account}).Delete()
+}
+
+// GetAccounts retrieves the accounts of a provider linked to an user.
+func (d *DB) GetAccounts(userID, provider string) ([]Account, error) {
+	var accounts []Account
+	err := d.sess.Collection("accounts").Find(db.Cond{"user_id": userID}, db.Cond{"provider": provider}).OrderBy("linked_at").All(&accounts)
+	return accounts, err
+}
+
+// GetAccountID retrieves the first account of a provider linked to an user, the google account of an user.
+func (d *DB) GetAccountID(userID, provider string) (string, error) {
+	var account Account
+	err := d.sess.Collection("accounts").Find(db.Cond{"user_id": userID}, db.Cond{"provider": provider}).OrderBy("linked_at").One(&account)
+	return account.Account, err
+}
+
+// GetAccountUser retrieves the user an account is linked to.
+func (d *DB) GetAccountUser(provider, account string) (string, error) {
+	var result Account
+	err := d.sess.Collection("accounts").Find(db.Cond{"provider": provider}, db.Cond{"account": account}).One(&result)
+	return result.UserID, err
+}
@@ -14,6 +14,7 @@ import (
 
 	log "github.com/Sirupsen/logrus"
 	orgodb "github.com/rsampaio/orgo/db"
+	"github.com/rsampaio/orgo/oauthstate"
 
 	"github.com/gorilla/sessions"
 	"golang.org/x/oauth2"
@@ -36,24 +37,54 @@ var ErrSignatureMismatch = errors.New("signature mismatch error")
 // DropboxHandler struct with unexported fields
 type DropboxHandler struct {
 	oauthConfig *oauth2.Config
-	workChan    chan string
-	db          *orgodb.DB
+	db          orgodb.Store
 	store       *sessions.CookieStore
 }
 
 // NewDropboxHandler returns a new DropboxHandler
-func NewDropboxHandler(oauth *oauth2.Config, workChan chan string, store *sessions.CookieStore) *DropboxHandler {
+func NewDropboxHandler(oauth *oauth2.Config, store *sessions.CookieStore, db orgodb.Store) *DropboxHandler {
 	return &DropboxHandler{
 		oauthConfig: oauth,
-		workChan:    workChan,
-		db:          orgodb.NewDB("orgo.db"),
+		db:          db,
 		store:       store,
 	}
 }
 
-// AuthCodeURL returns the url to redirect for an authorization code
-func (h *DropboxHandler) AuthCodeURL() string {
-	return h.oauthConfig.AuthCodeURL("state-token", []oauth2.AuthCodeOption{}...)
+// AuthCodeURL returns the url to redirect for an authorization code, offline
+// access returns a short-lived access token with a refresh token and the
+// code is bound to verifier with PKCE.
+func (h *DropboxHandler) AuthCodeURL(state, verifier string) string {
+	return h.oauthConfig.AuthCodeURL(state,
+		oauth2.SetAuthURLParam("token_access_type", "offline"),
+		oauth2.SetAuthURLParam("code_challenge", oauthstate.Challenge(verifier)),
+		oauth2.SetAuthURLParam("code_challenge_method", "S256"),
+	)
+}
+
+// LoginHandler redirects to dropbox to authorize orgo, the state and PKCE
+// verifier are kept in the session until dropbox redirects back with the code.
+func (h *DropboxHandler) LoginHandler(w http.ResponseWriter, r *http.Request) {
+	session, err := h.store.Get(r, "orgo-session")
+	if err != nil {
+		log.Errorf("get session %s", err.Error())
+		oauthstate.Error(w, http.StatusBadRequest, "Dropbox", "your session is invalid")
+		return
+	}
+
+	state, verifier, err := oauthstate.Begin(session, "dropbox")
+	if err != nil {
+		log.Errorf("begin authorization %s", err.Error())
+		oauthstate.Error(w, http.StatusInternalServerError, "Dropbox", "the authorization could not be started")
+		return
+	}
+
+	if err := session.Save(r, w); err != nil {
+		log.Errorf("save session %s", err.Error())
+		oauthstate.Error(w, http.StatusInternalServerError, "Dropbox", "the authorization could not be started")
+		return
+	}
+
+	http.Redirect(w, r, h.AuthCodeURL(state, verifier), http.StatusFound)
 }
 
 func (h *DropboxHandler) verifyRequest(r *http.Request) (bytes.Buffer, error) {
@@ -88,42 +119,72 @@ func (h *DropboxHandler) verifyRequest(r *http.Request) (bytes.Buffer, error) {
 // OauthHandler handles dropbox oauth calls
 func (h *DropboxHandler) OauthHandler(w http.ResponseWriter, r *http.Request) {
 	var (
-		code = r.FormValue("code")
+		code  = r.FormValue("code")
+		state = r.FormValue("state")
 	)
 
-	tok, err := h.oauthConfig.Exchange(context.Background(), code)
+	session, err := h.store.Get(r, "orgo-session")
+	if err != nil {
+		log.Errorf("get session %s", err.Error())
+		oauthstate.Error(w, http.StatusBadRequest, "Dropbox", "your session is invalid")
+		return
+	}
+
+	// Only the session that was redirected to dropbox can complete the authorization
+	verifier, err := oauthstate.Verify(session, "dropbox", state)
 	if err != nil {
-		http.Error(w, "token exchange failed", http.StatusBadRequest)
+		log.Errorf("dropbox callback %s", err.Error())
+		oauthstate.Error(w, http.StatusBadRequest, "Dropbox", "the authorization was not started from this browser")
+		return
 	}
 
-	uid := tok.Extra("account_id").(string)
+	if err := session.Save(r, w); err != nil {
+		log.Errorf("save session %s", err.Error())
+	}
 
-	// save dropbox token
-	h.db.SaveToken("dropbox", uid, code, tok)
+	if reason := r.FormValue("error"); reason != "" {
+		log.Infof("dropbox authorization refused: %s", reason)
+		oauthstate.Error(w, http.StatusBadRequest, "Dropbox", "the authorization was refused")
+		return
+	}
 
-	session, err := h.store.Get(r, "orgo-session")
+	sessionID, _ := session.Values["session_id"].(string)
+	userID, err := h.db.GetSession(sessionID)
 	if err != nil {
 		log.Errorf("get session %s", err.Error())
+		oauthstate.Error(w, http.StatusUnauthorized, "Dropbox", "you must sign in with Google first")
 		return
 	}
 
-	sessionID := session.Values["session_id"].(string)
-	userID, err := h.db.GetSession(sessionID)
+	tok, err := h.oauthConfig.Exchange(context.Background(), code, oauth2.SetAuthURLParam("code_verifier", verifier))
 	if err != nil {
-		log.Error(err.Error())
+		log.Errorf("token exchange %s", err.Error())
+		oauthstate.Error(w, http.StatusBadRequest, "Dropbox", "the token exchange failed")
+		return
+	}
+
+	uid, ok := tok.Extra("account_id").(string)
+	if !ok {
+		oauthstate.Error(w, http.StatusBadRequest, "Dropbox", "dropbox did not return the account")
+		return
+	}
+
+	// save dropbox token, authorizing again replaces it
+	if err := h.db.SaveToken("dropbox", uid, code, tok); err != nil {
+		log.Errorf("save token %s", err.Error())
+		oauthstate.Error(w, http.StatusInternalServerError, "Dropbox", "the token could not be saved")
+		return
 	}
 
-	err = h.db.SaveGoogleDropbox(userID, tok.Extra("account_id").(string))
+	// An user can link many dropbox accounts, authorizing one again keeps a single link
+	err = h.db.LinkAccount(orgodb.Account{Provider: "dropbox", Account: uid, UserID: userID})
 	if err != nil {
-		log.Errorf("save google dropbox %s", err.Error())
+		log.Errorf("link dropbox account %s", err.Error())
+		oauthstate.Error(w, http.StatusInternalServerError, "Dropbox", "the account could not be linked")
 		return
 	}
 
-	log.Info("redirect ",
-		tok.Extra("uid").(string),
-		sessionID,
-		userID,
-		tok.Extra("account_id").(string))
+	log.Info("redirect ", sessionID, userID, uid)
 
 	http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
 }
@@ -148,9 +209,17 @@ func (h *DropboxHandler) WebhookHandler(w http.ResponseWriter, r *http.Request)
 			log.Infof("decoder error %s", err.Error())
 		}
 
+		// Jobs are queued for the user so the syncs of an user run one at a time
 		for _, account := range event.ListFolder.Accounts {
-			//go Process(account)
-			h.workChan <- account
+			userID, err := h.db.GetAccountUser("dropbox", account)
+			if err != nil {
+				log.Errorf("user of %s: %s", account, err.Error())
+				continue
+			}
+
+			if _, err := h.db.EnqueueJob(orgodb.JobProcess, userID, account, account); err != nil {
+				log.Errorf("enqueue %s: %s", account, err.Error())
+			}
 		}
 
 		http.Error(w, "", http.StatusOK)
@@ -8,28 +8,29 @@ import (
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"strings"
 	"testing"
 
 	"github.com/gorilla/sessions"
+	orgodb "github.com/rsampaio/orgo/db"
 	"golang.org/x/oauth2"
 )
 
 func TestDropbox(t *testing.T) {
 	var (
-		workChan = make(chan string, 10)
-		store    = sessions.NewCookieStore([]byte("test-secret"))
+		store = sessions.NewCookieStore([]byte("test-secret"))
 
 		dropboxOauth = &oauth2.Config{
 			ClientID:     "client-id",
 			ClientSecret: "apiSecret123",
 			RedirectURL:  "http://localhost",
 			Endpoint: oauth2.Endpoint{
-				AuthURL:  "https://www.dropbox.com/1/oauth2/authorize",
-				TokenURL: "https://api.dropbox.com/1/oauth2/token",
+				AuthURL:  "https://www.dropbox.com/oauth2/authorize",
+				TokenURL: "https://api.dropboxapi.com/oauth2/token",
 			},
 		}
-		testHandler = NewDropboxHandler(dropboxOauth, workChan, store)
+		testHandler = NewDropboxHandler(dropboxOauth, store, orgodb.NewMemory(nil))
 	)
 
 	t.Run("dropbox_webhook_handler", func(t *testing.T) {
@@ -73,8 +74,69 @@ func TestDropbox(t *testing.T) {
 		}
 	})
 
+	t.Run("dropbox_login_handler", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		testHandler.LoginHandler(rec, httptest.NewRequest("GET", "/dropbox/login", nil))
+
+		if rec.Code != http.StatusFound {
+			t.Fatalf("login status: %d", rec.Code)
+		}
+
+		location, err := url.Parse(rec.Header().Get("Location"))
+		if err != nil {
+			t.Fatalf("login location: %s", err.Error())
+		}
+
+		query := location.Query()
+		if query.Get("token_access_type") != "offline" {
+			t.Errorf("token access type: %q", query.Get("token_access_type"))
+		}
+
+		if query.Get("code_challenge_method") != "S256" || query.Get("code_challenge") == "" {
+			t.Errorf("code challenge: %q", query)
+		}
+
+		if query.Get("state") == "" || query.Get("state") == "state-token" {
+			t.Errorf("state: %q", query.Get("state"))
+		}
+
+		if rec.Header().Get("Set-Cookie") == "" {
+			t.Errorf("verifier not kept in the session")
+		}
+	})
+
+	t.Run("dropbox_code_challenge", func(t *testing.T) {
+		verifier := "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+		location, err := url.Parse(testHandler.AuthCodeURL("state", verifier))
+		if err != nil {
+			t.Fatalf("auth code url: %s", err.Error())
+		}
+
+		// Example of RFC 7636 appendix B
+		if challenge := location.Query().Get("code_challenge"); challenge != "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM" {
+			t.Errorf("code challenge: %q", challenge)
+		}
+	})
+
 	t.Run("dropbox_oauth_handler", func(t *testing.T) {
-		ts := httptest.NewServer(http.HandlerFunc(testHandler.OauthHandler))
-		defer ts.Close()
+		rec := httptest.NewRecorder()
+		testHandler.OauthHandler(rec, httptest.NewRequest("GET", "/dropbox/oauth?code=code", nil))
+
+		// Without the state of a login the code is not exchanged
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("oauth status without login: %d", rec.Code)
+		}
+
+		rec = httptest.NewRecorder()
+		testHandler.LoginHandler(rec, httptest.NewRequest("GET", "/dropbox/login", nil))
+
+		req := httptest.NewRequest("GET", "/dropbox/oauth?code=code&state=crafted", nil)
+		req.Header.Set("Cookie", rec.Header().Get("Set-Cookie"))
+
+		rec = httptest.NewRecorder()
+		testHandler.OauthHandler(rec, req)
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("oauth status with a crafted state: %d", rec.Code)
+		}
 	})
 }
@@ -1,41 +1,81 @@
 package google
 
 import (
+	"encoding/json"
 	"net/http"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
 	orgodb "github.com/rsampaio/orgo/db"
-	uuid "github.com/satori/go.uuid"
+	"github.com/rsampaio/orgo/oauthstate"
 	oauth2api "google.golang.org/api/oauth2/v2"
 
 	"github.com/gorilla/sessions"
 	"golang.org/x/oauth2"
 )
 
-// GoogleHandler struct with unexported fields
+// GoogleHandler struct signing users in with google
 type GoogleHandler struct {
+	// Sessions created on sign in expire after SessionTTL or when not used for SessionIdle
+	SessionTTL  time.Duration
+	SessionIdle time.Duration
+
 	oauthConfig *oauth2.Config
 	store       *sessions.CookieStore
-	db          *orgodb.DB
+	db          orgodb.Store
 }
 
 // NewGoogleHandler creates an instance of GoogleHandler
-func NewGoogleHandler(oauth *oauth2.Config, store *sessions.CookieStore) *GoogleHandler {
+func NewGoogleHandler(oauth *oauth2.Config, store *sessions.CookieStore, db orgodb.Store) *GoogleHandler {
 	return &GoogleHandler{
+		SessionTTL:  30 * 24 * time.Hour,
+		SessionIdle: 72 * time.Hour,
 		store:       store,
 		oauthConfig: oauth,
-		db:          orgodb.NewDB("orgo.db"),
+		db:          db,
 	}
 }
 
 // AuthCodeURL returns the URL to get the authentication code
-func (g *GoogleHandler) AuthCodeURL() string {
-	return g.oauthConfig.AuthCodeURL(uuid.NewV4().String(), oauth2.AccessTypeOffline)
+func (g *GoogleHandler) AuthCodeURL(state string) string {
+	return g.oauthConfig.AuthCodeURL(state, oauth2.AccessTypeOffline)
+}
+
+// StateHandler starts a sign in, the state returned is kept in the
+// session and must be posted back with the code.
+func (g *GoogleHandler) StateHandler(w http.ResponseWriter, r *http.Request) {
+	session, err := g.store.Get(r, "orgo-session")
+	if err != nil {
+		log.Error(err.Error())
+	}
+
+	// The sign in popup does not support PKCE, only the state is checked
+	state, _, err := oauthstate.Begin(session, "google")
+	if err != nil {
+		log.Error(err.Error())
+		http.Error(w, "sign in failed", http.StatusInternalServerError)
+		return
+	}
+
+	if err := session.Save(r, w); err != nil {
+		log.Error(err.Error())
+		http.Error(w, "sign in failed", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"state": state})
 }
 
 // ServiceGetter get a google service configured
 func (g *GoogleHandler) ServiceGetter(userID string) {
-	t, err := g.db.GetToken("google", userID)
+	googleID, err := g.db.GetAccountID(userID, "google")
+	if err != nil {
+		log.Error(err.Error())
+		return
+	}
+
+	t, err := g.db.GetToken("google", googleID)
 	log.Info(t.AccessToken, t.Code, err)
 }
 
@@ -45,14 +85,31 @@ func (g *GoogleHandler) OauthHandler(w http.ResponseWriter, r *http.Request) {
 	code := r.FormValue("code")
 	if code == "" {
 		log.Info("code is empty")
-		http.Error(w, "code is empty", http.StatusBadRequest)
+		oauthstate.Error(w, http.StatusBadRequest, "Google", "google did not return a code")
+		return
+	}
+
+	session, err := g.store.Get(r, "orgo-session")
+	if err != nil {
+		log.Error(err.Error())
+	}
+
+	// Only the session that started the sign in can complete it
+	if _, err := oauthstate.Verify(session, "google", r.FormValue("state")); err != nil {
+		log.Errorf("google callback %s", err.Error())
+		oauthstate.Error(w, http.StatusBadRequest, "Google", "the sign in was not started from this browser")
 		return
 	}
 
+	// The state is used once, a failing sign in starts again
+	if err := session.Save(r, w); err != nil {
+		log.Errorf("save session %s", err.Error())
+	}
+
 	tok, err := g.oauthConfig.Exchange(oauth2.NoContext, code)
 	if err != nil {
 		log.Error(err.Error())
-		http.Error(w, "token exchange failed", http.StatusBadRequest)
+		oauthstate.Error(w, http.StatusBadRequest, "Google", "the token exchange failed")
 		return
 	}
 
@@ -61,18 +118,51 @@ func (g *GoogleHandler) OauthHandler(w http.ResponseWriter, r *http.Request) {
 
 	tokenCall := service.Tokeninfo()
 	tokenCall.AccessToken(tok.AccessToken)
-	tokenInfo, _ := tokenCall.Do()
+	tokenInfo, err := tokenCall.Do()
+	if err != nil {
+		log.Error(err.Error())
+		oauthstate.Error(w, http.StatusBadRequest, "Google", "the token could not be verified")
+		return
+	}
+
+	// Signing in again replaces the token and clears a pending consent
+	if err := g.db.SaveToken("google", tokenInfo.UserId, code, tok); err != nil {
+		log.Error(err.Error())
+		oauthstate.Error(w, http.StatusInternalServerError, "Google", "the token could not be saved")
+		return
+	}
 
-	g.db.SaveToken("google", tokenInfo.UserId, code, tok)
+	var name string
+	if profile, err := service.Userinfo.Get().Do(); err == nil {
+		name = profile.Name
+	} else {
+		log.Errorf("user info %s", err.Error())
+	}
 
-	// Session
-	session, err := g.store.Get(r, "orgo-session")
+	user, err := g.db.SignIn(tokenInfo.UserId, tokenInfo.Email, name)
 	if err != nil {
 		log.Error(err.Error())
+		oauthstate.Error(w, http.StatusInternalServerError, "Google", "the user could not be signed in")
+		return
+	}
+
+	// Signing in rotates the session, a session id known before the sign in is not kept
+	if previous, ok := session.Values["session_id"].(string); ok {
+		if err := g.db.DeleteSession(previous); err != nil {
+			log.Error(err.Error())
+		}
+	}
+
+	sessionID, err := g.db.SaveSession(user.ID, r.UserAgent(), g.SessionTTL, g.SessionIdle)
+	if err != nil {
+		log.Error(err.Error())
+		oauthstate.Error(w, http.StatusInternalServerError, "Google", "the session could not be created")
+		return
 	}
 
-	sessionID, _ := g.db.SaveSession(tokenInfo.UserId)
 	session.Values["session_id"] = sessionID
-	session.Save(r, w)
+	if err := session.Save(r, w); err != nil {
+		log.Error(err.Error())
+	}
 	http.Error(w, "ok", http.StatusOK)
 }
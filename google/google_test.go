@@ -1,9 +1,15 @@
 package google
 
 import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
 	"testing"
 
 	"github.com/gorilla/sessions"
+	orgodb "github.com/rsampaio/orgo/db"
 	"golang.org/x/oauth2"
 )
 
@@ -19,12 +25,60 @@ func TestGoogle(t *testing.T) {
 			ClientSecret: "apiSecret123",
 			RedirectURL:  "http://localhost",
 		}
-		testHandler = NewGoogleHandler(googleOauth, store)
+		testHandler = NewGoogleHandler(googleOauth, store, orgodb.NewMemory(nil))
 	})
 
 	t.Run("auth_code_url", func(t *testing.T) {
-		if testHandler.AuthCodeURL() == "" {
+		if testHandler.AuthCodeURL("state") == "" {
 			t.Error("auth_code url invalid")
 		}
 	})
+
+	t.Run("oauth_handler_state", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		testHandler.StateHandler(rec, httptest.NewRequest("GET", "/google/state", nil))
+
+		var started struct {
+			State string `json:"state"`
+		}
+		if err := json.NewDecoder(rec.Body).Decode(&started); err != nil || started.State == "" {
+			t.Fatalf("state %q: %v", started.State, err)
+		}
+		cookie := rec.Header().Get("Set-Cookie")
+
+		// A code posted with another state is rejected before the exchange
+		form := url.Values{"code": {"code"}, "state": {"other"}}
+		req := httptest.NewRequest("POST", "/google/oauth", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("Cookie", cookie)
+
+		rec = httptest.NewRecorder()
+		testHandler.OauthHandler(rec, req)
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("oauth status with another state: %d", rec.Code)
+		}
+
+		// The state is consumed even when the exchange fails
+		form = url.Values{"code": {"code"}, "state": {started.State}}
+		req = httptest.NewRequest("POST", "/google/oauth", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("Cookie", cookie)
+
+		rec = httptest.NewRecorder()
+		testHandler.OauthHandler(rec, req)
+		consumed := rec.Header().Get("Set-Cookie")
+		if rec.Code != http.StatusBadRequest || consumed == "" {
+			t.Fatalf("oauth status %d with a failing exchange, session %q", rec.Code, consumed)
+		}
+
+		req = httptest.NewRequest("POST", "/google/oauth", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("Cookie", consumed)
+
+		rec = httptest.NewRecorder()
+		testHandler.OauthHandler(rec, req)
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("oauth status replaying the state: %d", rec.Code)
+		}
+	})
 }
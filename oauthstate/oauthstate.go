@@ -0,0 +1,98 @@
+// Package oauthstate binds the state and PKCE verifier of an authorization
+// to the session that started it, a callback is only accepted by the session
+// that was redirected to the provider.
+package oauthstate
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"html/template"
+	"net/http"
+	"path"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gorilla/sessions"
+	orgodb "github.com/rsampaio/orgo/db"
+)
+
+// ErrStateMismatch is returned for callbacks whose state was not started by the session.
+var ErrStateMismatch = errors.New("authorization state does not match this session")
+
+func stateKey(provider string) string {
+	return provider + "_state"
+}
+
+func verifierKey(provider string) string {
+	return provider + "_verifier"
+}
+
+// random returns 32 random bytes in base64 url encoding.
+func random() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// Begin starts an authorization with provider, keeping a random state and
+// PKCE verifier in the session, the session must be saved afterwards.
+func Begin(session *sessions.Session, provider string) (state, verifier string, err error) {
+	if state, err = random(); err != nil {
+		return "", "", err
+	}
+	if verifier, err = random(); err != nil {
+		return "", "", err
+	}
+
+	session.Values[stateKey(provider)] = state
+	session.Values[verifierKey(provider)] = verifier
+	return state, verifier, nil
+}
+
+// Verify checks the state of a callback from provider was started by the session
+// and returns its PKCE verifier, an authorization is verified only once.
+func Verify(session *sessions.Session, provider, state string) (string, error) {
+	expected, _ := session.Values[stateKey(provider)].(string)
+	verifier, _ := session.Values[verifierKey(provider)].(string)
+	delete(session.Values, stateKey(provider))
+	delete(session.Values, verifierKey(provider))
+
+	if expected == "" || subtle.ConstantTimeCompare([]byte(expected), []byte(state)) != 1 {
+		return "", ErrStateMismatch
+	}
+	return verifier, nil
+}
+
+// Challenge returns the S256 PKCE challenge of verifier.
+func Challenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// errorPage is the data of the authorization error page, the layout
+// reads the User of every page and there is none signed in here.
+type errorPage struct {
+	User     orgodb.User
+	Provider string
+	Message  string
+}
+
+// Error replies with the page explaining an authorization with provider failed.
+func Error(w http.ResponseWriter, status int, provider, message string) {
+	tmpl, err := template.ParseFiles(path.Join("tmpl", "layout.html"), path.Join("tmpl", "oauth_error.html"))
+	if err != nil {
+		log.Error(err.Error())
+		http.Error(w, message, status)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	if err := tmpl.ExecuteTemplate(w, "layout", errorPage{Provider: provider, Message: message}); err != nil {
+		log.Error(err.Error())
+	}
+}
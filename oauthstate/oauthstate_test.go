@@ -0,0 +1,78 @@
+package oauthstate
+
+import (
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/sessions"
+)
+
+func TestOauthState(t *testing.T) {
+	store := sessions.NewCookieStore([]byte("test-secret"))
+
+	t.Run("verify", func(t *testing.T) {
+		session, _ := store.Get(httptest.NewRequest("GET", "/", nil), "orgo-session")
+
+		state, verifier, err := Begin(session, "dropbox")
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+
+		if _, err := Verify(session, "google", state); err != ErrStateMismatch {
+			t.Errorf("state of another provider verified: %v", err)
+		}
+
+		got, err := Verify(session, "dropbox", state)
+		if err != nil || got != verifier {
+			t.Fatalf("verifier %q %v, want %q", got, err, verifier)
+		}
+
+		// A state is verified only once
+		if _, err := Verify(session, "dropbox", state); err != ErrStateMismatch {
+			t.Errorf("state verified twice: %v", err)
+		}
+	})
+
+	t.Run("mismatch", func(t *testing.T) {
+		session, _ := store.Get(httptest.NewRequest("GET", "/", nil), "orgo-session")
+
+		if _, _, err := Begin(session, "dropbox"); err != nil {
+			t.Fatal(err.Error())
+		}
+
+		for _, state := range []string{"", "state-token"} {
+			if _, err := Verify(session, "dropbox", state); err != ErrStateMismatch {
+				t.Errorf("state %q verified: %v", state, err)
+			}
+		}
+	})
+
+	t.Run("challenge", func(t *testing.T) {
+		// Example of RFC 7636 appendix B
+		if c := Challenge("dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"); c != "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM" {
+			t.Errorf("challenge %q", c)
+		}
+	})
+}
+
+func TestError(t *testing.T) {
+	// The templates are read from the root of the repository
+	if err := os.Chdir(".."); err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.Chdir("oauthstate")
+
+	rec := httptest.NewRecorder()
+	Error(rec, 400, "dropbox", "access denied")
+
+	body := rec.Body.String()
+	if rec.Code != 400 || !strings.Contains(body, "access denied") || !strings.Contains(body, "</html>") {
+		t.Errorf("error page %d %q, want the whole page with the message", rec.Code, body)
+	}
+
+	if strings.Contains(body, "data-user") {
+		t.Error("error page rendered for a signed in user")
+	}
+}
@@ -0,0 +1,319 @@
+// Package org parses org-mode files into a tree of headings.
+package org
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Keywords recognized at the start of a heading.
+var Keywords = []string{"TODO", "DONE"}
+
+var (
+	planningRe  = regexp.MustCompile(`(SCHEDULED|DEADLINE|CLOSED):\s*([<\[][^>\]]*[>\]])`)
+	keywordRe   = regexp.MustCompile(`^(SCHEDULED|DEADLINE|CLOSED):`)
+	priorityRe  = regexp.MustCompile(`^\[#[A-Z0-9]\]$`)
+	inactiveRe  = regexp.MustCompile(`^\[\d{4}-\d{2}-\d{2}[^\]]*\]$`)
+	timestampRe = regexp.MustCompile(`^[<\[](\d{4}-\d{2}-\d{2})(?:\s+[^\s\d>\]]+)?(?:\s+(\d{1,2}:\d{2}))?`)
+	tagsRe      = regexp.MustCompile(`\s+(:[\w@#%:]+:)\s*$`)
+	propertyRe  = regexp.MustCompile(`^:([\w-]+):\s*(.*)$`)
+)
+
+// Heading is an org-mode heading in this format:
+//
+//	** [KEYWORD [#PRIORITY]] Title
+//	   SCHEDULED:value CLOSED:value
+//	   [date]
+//	   body
+type Heading struct {
+	// Raw is the heading line as it appears in the file
+	Raw      string
+	Title    string
+	Level    int
+	Line     int
+	Keyword  string
+	Priority string
+	Tags     []string
+	Body     []string
+
+	// Category is read from the CATEGORY property of the
+	// heading, its ancestors or the #+CATEGORY of the file
+	Category   string
+	Properties map[string]string
+
+	Date      time.Time
+	Scheduled time.Time
+	Closed    time.Time
+
+	Parent   *Heading
+	Children []*Heading
+}
+
+// Diagnostic severities
+const (
+	SeverityError   = "error"
+	SeverityWarning = "warning"
+)
+
+// Diagnostic is a problem found parsing a file, Column counts bytes from 1.
+type Diagnostic struct {
+	Line     int
+	Column   int
+	Severity string
+	Message  string
+}
+
+func (d Diagnostic) String() string {
+	return fmt.Sprintf("%d:%d: %s: %s", d.Line, d.Column, d.Severity, d.Message)
+}
+
+// Error returns the message of the diagnostic, a diagnostic is the error parsing its line.
+func (d Diagnostic) Error() string {
+	return d.Message
+}
+
+// Document is a parsed org file.
+type Document struct {
+	Category    string
+	Headings    []*Heading
+	Diagnostics []Diagnostic
+}
+
+// Parse reads the headings in content, timestamps are read in loc.
+// Keywords are recognized at the start of headings besides the default Keywords.
+// Malformed timestamps, drawers and headings are reported as diagnostics
+// and parsing goes on with the next line.
+func Parse(content []byte, loc *time.Location, keywords ...string) *Document {
+	var (
+		doc     = &Document{}
+		current *Heading
+		drawer  int
+	)
+
+	keywords = append(append([]string(nil), Keywords...), keywords...)
+
+	diag := func(line, col int, severity, format string, args ...interface{}) {
+		doc.Diagnostics = append(doc.Diagnostics, Diagnostic{
+			Line:     line,
+			Column:   col,
+			Severity: severity,
+			Message:  fmt.Sprintf(format, args...),
+		})
+	}
+
+	timestamp := func(value, line string, n int) time.Time {
+		t, err := parseTimestamp(value, loc)
+		if err != nil {
+			diag(n, strings.Index(line, value)+1, SeverityError, "%s", err.Error())
+		}
+		return t
+	}
+
+	for i, line := range strings.Split(string(content), "\n") {
+		n := i + 1
+
+		if level := headingLevel(line); level > 0 {
+			if drawer > 0 {
+				diag(drawer, 1, SeverityError, "drawer not closed with :END:")
+			}
+
+			h, diags := parseHeading(line, level, keywords)
+			h.Line = n
+			for _, d := range diags {
+				diag(n, d.Column, d.Severity, "%s", d.Message)
+			}
+
+			parent := current
+			for parent != nil && parent.Level >= level {
+				parent = parent.Parent
+			}
+
+			if parent == nil {
+				h.Category = doc.Category
+				doc.Headings = append(doc.Headings, h)
+			} else {
+				h.Parent = parent
+				h.Category = parent.Category
+				parent.Children = append(parent.Children, h)
+			}
+			current = h
+			drawer = 0
+			continue
+		}
+
+		trimmed := strings.TrimSpace(line)
+		if strings.HasPrefix(strings.ToUpper(trimmed), "#+CATEGORY:") {
+			doc.Category = strings.TrimSpace(trimmed[len("#+CATEGORY:"):])
+		}
+
+		// Content before the first heading is ignored
+		if current == nil {
+			continue
+		}
+
+		// Drawer lines are kept in the body, properties are also read
+		if trimmed == ":PROPERTIES:" {
+			drawer = n
+		} else if drawer > 0 && trimmed == ":END:" {
+			drawer = 0
+		} else if m := propertyRe.FindStringSubmatch(trimmed); drawer > 0 && m != nil {
+			name := strings.ToUpper(m[1])
+			if current.Properties == nil {
+				current.Properties = make(map[string]string)
+			}
+			current.Properties[name] = m[2]
+			if name == "CATEGORY" {
+				current.Category = m[2]
+			}
+		} else if drawer > 0 && trimmed != "" {
+			diag(n, strings.Index(line, trimmed)+1, SeverityWarning, "property %q is not in the :NAME: value format", trimmed)
+		}
+
+		if planning := planningRe.FindAllStringSubmatch(trimmed, -1); len(planning) > 0 && strings.HasPrefix(trimmed, planning[0][1]) {
+			for _, p := range planning {
+				switch p[1] {
+				case "SCHEDULED":
+					current.Scheduled = timestamp(p[2], line, n)
+				case "CLOSED":
+					current.Closed = timestamp(p[2], line, n)
+				}
+			}
+		} else if m := keywordRe.FindStringSubmatch(trimmed); m != nil {
+			diag(n, strings.Index(line, m[1])+1, SeverityError, "%s without a <timestamp>", m[1])
+			current.Body = append(current.Body, line)
+		} else if current.Date.IsZero() && inactiveRe.MatchString(trimmed) {
+			current.Date = timestamp(trimmed, line, n)
+		} else {
+			current.Body = append(current.Body, line)
+		}
+	}
+
+	if drawer > 0 {
+		diag(drawer, 1, SeverityError, "drawer not closed with :END:")
+	}
+	return doc
+}
+
+// Walk calls fn for every heading in document order.
+func (d *Document) Walk(fn func(*Heading)) {
+	var walk func([]*Heading)
+	walk = func(headings []*Heading) {
+		for _, h := range headings {
+			fn(h)
+			walk(h.Children)
+		}
+	}
+	walk(d.Headings)
+}
+
+// AllTags returns the tags of the heading including the ones inherited from its ancestors.
+func (h *Heading) AllTags() []string {
+	var (
+		tags []string
+		seen = make(map[string]bool)
+	)
+
+	for p := h; p != nil; p = p.Parent {
+		for _, t := range p.Tags {
+			if !seen[t] {
+				seen[t] = true
+				tags = append(tags, t)
+			}
+		}
+	}
+	return tags
+}
+
+// Outline returns the titles of the ancestors of the heading.
+func (h *Heading) Outline() []string {
+	var outline []string
+	for p := h.Parent; p != nil; p = p.Parent {
+		outline = append([]string{p.Title}, outline...)
+	}
+	return outline
+}
+
+func headingLevel(line string) int {
+	level := 0
+	for level < len(line) && line[level] == '*' {
+		level++
+	}
+
+	if level == 0 || level >= len(line) || line[level] != ' ' {
+		return 0
+	}
+	return level
+}
+
+// parseHeading reads a heading line starting with one of keywords,
+// the diagnostics returned have no line.
+func parseHeading(line string, level int, keywords []string) (*Heading, []Diagnostic) {
+	var (
+		h     = &Heading{Raw: line, Level: level}
+		text  = line[level:]
+		diags []Diagnostic
+	)
+
+	if m := tagsRe.FindStringSubmatchIndex(text); m != nil {
+		for _, t := range strings.Split(text[m[2]:m[3]], ":") {
+			if t != "" {
+				h.Tags = append(h.Tags, t)
+			}
+		}
+		text = text[:m[0]]
+	}
+
+	fields := strings.Fields(text)
+
+	if len(fields) > 0 {
+		for _, k := range keywords {
+			if fields[0] == k {
+				h.Keyword = k
+				fields = fields[1:]
+				break
+			}
+		}
+	}
+
+	if len(fields) > 0 && strings.HasPrefix(fields[0], "[#") && strings.HasSuffix(fields[0], "]") {
+		if !priorityRe.MatchString(fields[0]) {
+			diags = append(diags, Diagnostic{
+				Column:   strings.Index(line, fields[0]) + 1,
+				Severity: SeverityWarning,
+				Message:  fmt.Sprintf("priority %s is not a single letter or digit", fields[0]),
+			})
+		}
+		h.Priority = fields[0]
+		fields = fields[1:]
+	}
+
+	h.Title = strings.Join(fields, " ")
+	if h.Title == "" {
+		diags = append(diags, Diagnostic{Column: level + 1, Severity: SeverityWarning, Message: "heading without a title"})
+	}
+	return h, diags
+}
+
+func parseTimestamp(value string, loc *time.Location) (time.Time, error) {
+	m := timestampRe.FindStringSubmatch(value)
+	if m == nil {
+		return time.Time{}, fmt.Errorf("malformed timestamp %s", value)
+	}
+
+	if (value[0] == '<') != strings.HasSuffix(value, ">") {
+		return time.Time{}, fmt.Errorf("timestamp %s opens and closes with different brackets", value)
+	}
+
+	layout, text := "2006-01-02", m[1]
+	if m[2] != "" {
+		layout, text = "2006-01-02 15:04", m[1]+" "+m[2]
+	}
+
+	t, err := time.ParseInLocation(layout, text, loc)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid date in timestamp %s", value)
+	}
+	return t, nil
+}
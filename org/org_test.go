@@ -0,0 +1,186 @@
+package org
+
+import (
+	"testing"
+	"time"
+)
+
+const testFile = `#+TITLE: tasks
+#+CATEGORY: orgo
+* Tasks                                                          :work:
+** TODO [#A] Write parser                                        :code:
+   SCHEDULED: <2017-07-20 Thu>
+   [2017-07-18 Tue]
+   body line
+*** DONE Heading tree
+    CLOSED: [2017-07-19 Wed 10:30] SCHEDULED: <2017-07-19 Wed>
+** Notes
+   :PROPERTIES:
+   :CATEGORY: notes
+   :END:
+* Other
+`
+
+func TestParse(t *testing.T) {
+	doc := Parse([]byte(testFile), time.UTC)
+
+	t.Run("tree", func(t *testing.T) {
+		if len(doc.Headings) != 2 {
+			t.Fatalf("top level headings: %d, want 2", len(doc.Headings))
+		}
+
+		tasks := doc.Headings[0]
+		if len(tasks.Children) != 2 {
+			t.Fatalf("children of %q: %d, want 2", tasks.Title, len(tasks.Children))
+		}
+
+		tree := tasks.Children[0].Children[0]
+		if tree.Title != "Heading tree" || tree.Parent != tasks.Children[0] {
+			t.Errorf("unexpected nested heading %#v", tree)
+		}
+
+		outline := tree.Outline()
+		if len(outline) != 2 || outline[0] != "Tasks" || outline[1] != "Write parser" {
+			t.Errorf("outline %v", outline)
+		}
+	})
+
+	t.Run("heading", func(t *testing.T) {
+		h := doc.Headings[0].Children[0]
+		if h.Keyword != "TODO" || h.Priority != "[#A]" || h.Title != "Write parser" {
+			t.Errorf("heading parsed as %q %q %q", h.Keyword, h.Priority, h.Title)
+		}
+
+		if h.Line != 4 {
+			t.Errorf("line %d, want 4", h.Line)
+		}
+
+		if len(h.Tags) != 1 || h.Tags[0] != "code" {
+			t.Errorf("tags %v", h.Tags)
+		}
+
+		if !h.Scheduled.Equal(time.Date(2017, 7, 20, 0, 0, 0, 0, time.UTC)) {
+			t.Errorf("scheduled %v", h.Scheduled)
+		}
+
+		if !h.Date.Equal(time.Date(2017, 7, 18, 0, 0, 0, 0, time.UTC)) {
+			t.Errorf("date %v", h.Date)
+		}
+
+		if len(h.Body) != 1 || h.Body[0] != "   body line" {
+			t.Errorf("body %q", h.Body)
+		}
+	})
+
+	t.Run("planning", func(t *testing.T) {
+		h := doc.Headings[0].Children[0].Children[0]
+		if !h.Closed.Equal(time.Date(2017, 7, 19, 10, 30, 0, 0, time.UTC)) {
+			t.Errorf("closed %v", h.Closed)
+		}
+
+		if !h.Scheduled.Equal(time.Date(2017, 7, 19, 0, 0, 0, 0, time.UTC)) {
+			t.Errorf("scheduled %v", h.Scheduled)
+		}
+	})
+
+	t.Run("tags", func(t *testing.T) {
+		tags := doc.Headings[0].Children[0].Children[0].AllTags()
+		if len(tags) != 2 || tags[0] != "code" || tags[1] != "work" {
+			t.Errorf("inherited tags %v", tags)
+		}
+	})
+
+	t.Run("category", func(t *testing.T) {
+		if doc.Category != "orgo" {
+			t.Errorf("document category %q", doc.Category)
+		}
+
+		tasks := doc.Headings[0]
+		if c := tasks.Children[0].Children[0].Category; c != "orgo" {
+			t.Errorf("inherited category %q, want orgo", c)
+		}
+
+		if c := tasks.Children[1].Category; c != "notes" {
+			t.Errorf("property category %q, want notes", c)
+		}
+	})
+
+	t.Run("walk", func(t *testing.T) {
+		var titles []string
+		doc.Walk(func(h *Heading) {
+			titles = append(titles, h.Title)
+		})
+
+		want := []string{"Tasks", "Write parser", "Heading tree", "Notes", "Other"}
+		if len(titles) != len(want) {
+			t.Fatalf("walk %v, want %v", titles, want)
+		}
+
+		for i := range want {
+			if titles[i] != want[i] {
+				t.Errorf("walk %v, want %v", titles, want)
+			}
+		}
+	})
+
+	t.Run("keywords", func(t *testing.T) {
+		content := []byte("* CANCELLED Not needed\n* WAITING Reply\n")
+		headings := Parse(content, time.UTC, "CANCELLED").Headings
+
+		if h := headings[0]; h.Keyword != "CANCELLED" || h.Title != "Not needed" {
+			t.Errorf("heading parsed as %q %q", h.Keyword, h.Title)
+		}
+
+		if h := headings[1]; h.Keyword != "" || h.Title != "WAITING Reply" {
+			t.Errorf("heading parsed as %q %q", h.Keyword, h.Title)
+		}
+	})
+
+	t.Run("no diagnostics", func(t *testing.T) {
+		if len(doc.Diagnostics) != 0 {
+			t.Errorf("diagnostics %v", doc.Diagnostics)
+		}
+	})
+}
+
+const brokenFile = `* TODO Broken dates
+  SCHEDULED: <2017-13-40 Thu>
+  CLOSED: 2017-07-19
+  [2017-07-18 Tue>
+** [#AB] Priority
+   :PROPERTIES:
+   not a property
+**  
+* Last
+  SCHEDULED: <2017-07-20 Thu 10:30>
+`
+
+func TestDiagnostics(t *testing.T) {
+	doc := Parse([]byte(brokenFile), time.UTC)
+
+	want := []Diagnostic{
+		{Line: 2, Column: 14, Severity: SeverityError},
+		{Line: 3, Column: 3, Severity: SeverityError},
+		{Line: 5, Column: 4, Severity: SeverityWarning},
+		{Line: 7, Column: 4, Severity: SeverityWarning},
+		{Line: 6, Column: 1, Severity: SeverityError},
+		{Line: 8, Column: 3, Severity: SeverityWarning},
+	}
+
+	if len(doc.Diagnostics) != len(want) {
+		t.Fatalf("diagnostics %v, want %d", doc.Diagnostics, len(want))
+	}
+
+	for i, w := range want {
+		d := doc.Diagnostics[i]
+		if d.Line != w.Line || d.Column != w.Column || d.Severity != w.Severity {
+			t.Errorf("diagnostic %s, want %d:%d %s", d, w.Line, w.Column, w.Severity)
+		}
+	}
+
+	// Parsing goes on after the problems
+	last := doc.Headings[len(doc.Headings)-1]
+	if last.Title != "Last" || last.Scheduled.IsZero() {
+		t.Errorf("last heading %q scheduled %v", last.Title, last.Scheduled)
+	}
+}
@@ -0,0 +1,130 @@
+package org
+
+import (
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+var (
+	linkRe      = regexp.MustCompile(`\[\[([^\]]+)\](?:\[([^\]]+)\])?\]`)
+	emphasisRe  = regexp.MustCompile(`(^|[\s({'"])([*/_=~+])([^\s*/_=~+](?:[^\n]*?[^\s])?)([*/_=~+])([\s)}'",.;:!?-]|$)`)
+	listRe      = regexp.MustCompile(`^(\s*)([-+*]|\d+[.)])\s+(?:\[([ xX-])\]\s+)?(.*)$`)
+	drawerRe    = regexp.MustCompile(`^:[\w-]+:$`)
+	checkboxSym = map[string]string{" ": "☐", "x": "☑", "X": "☑", "-": "☐"}
+)
+
+// PlainText renders org markup as readable plain text: drawers and
+// comments are removed, links become `text (url)`, emphasis markers are
+// stripped and lists keep their indentation with checkboxes as symbols.
+func PlainText(lines []string) string {
+	var (
+		out    []string
+		drawer bool
+		indent = -1
+	)
+
+	for _, line := range lines {
+		trimmed := strings.TrimSpace(line)
+
+		if drawer {
+			if strings.ToUpper(trimmed) == ":END:" {
+				drawer = false
+			}
+			continue
+		}
+
+		if drawerRe.MatchString(trimmed) && strings.ToUpper(trimmed) != ":END:" {
+			drawer = true
+			continue
+		}
+
+		if strings.HasPrefix(trimmed, "#") && (trimmed == "#" || strings.HasPrefix(trimmed, "# ") || strings.HasPrefix(trimmed, "#+")) {
+			continue
+		}
+
+		if trimmed == "" {
+			// collapse consecutive blank lines
+			if len(out) > 0 && out[len(out)-1] != "" {
+				out = append(out, "")
+			}
+			continue
+		}
+
+		// Body lines are indented under the heading, keep only the relative indentation
+		lead := len(line) - len(strings.TrimLeft(line, " \t"))
+		if indent < 0 || lead < indent {
+			indent = lead
+		}
+
+		if m := listRe.FindStringSubmatch(line); m != nil {
+			bullet := "•"
+			if m[2] != "-" && m[2] != "+" && m[2] != "*" {
+				bullet = m[2]
+			}
+
+			if m[3] != "" {
+				bullet = checkboxSym[m[3]]
+			}
+			out = append(out, relativeIndent(m[1], indent)+bullet+" "+inline(m[4]))
+			continue
+		}
+
+		out = append(out, relativeIndent(line[:lead], indent)+inline(trimmed))
+	}
+
+	return strings.TrimSpace(strings.Join(out, "\n"))
+}
+
+// Truncate shortens text to at most max bytes without splitting
+// a character, an ellipsis marks text that was cut.
+func Truncate(text string, max int) string {
+	if len(text) <= max {
+		return text
+	}
+
+	const ellipsis = "…"
+	cut := max - len(ellipsis)
+	if cut < 0 {
+		cut = 0
+	}
+
+	for cut > 0 && !utf8.RuneStart(text[cut]) {
+		cut--
+	}
+	return strings.TrimRightFunc(text[:cut], func(r rune) bool { return r == ' ' || r == '\n' }) + ellipsis
+}
+
+func relativeIndent(lead string, indent int) string {
+	if len(lead) <= indent || indent < 0 {
+		return ""
+	}
+	return lead[indent:]
+}
+
+func inline(text string) string {
+	text = linkRe.ReplaceAllStringFunc(text, func(link string) string {
+		m := linkRe.FindStringSubmatch(link)
+		url := strings.TrimPrefix(m[1], "file:")
+		if m[2] == "" || m[2] == m[1] {
+			return url
+		}
+		return m[2] + " (" + url + ")"
+	})
+
+	// emphasis markers may be adjacent, run until nothing changes
+	for {
+		stripped := emphasisRe.ReplaceAllStringFunc(text, func(s string) string {
+			m := emphasisRe.FindStringSubmatch(s)
+			if m[2] != m[4] {
+				return s
+			}
+			return m[1] + m[3] + m[5]
+		})
+
+		if stripped == text {
+			return text
+		}
+		text = stripped
+	}
+}
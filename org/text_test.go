@@ -0,0 +1,47 @@
+package org
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPlainText(t *testing.T) {
+	body := []string{
+		"   :PROPERTIES:",
+		"   :ID: 1234",
+		"   :END:",
+		"   Read the *org manual* and /the/ =docs= at [[https://orgmode.org][orgmode]].",
+		"",
+		"",
+		"   # a comment",
+		"   - [ ] first",
+		"     - [X] nested",
+		"   1. numbered [[https://example.com]]",
+		"   :LOGBOOK:",
+		"   - State \"DONE\" from \"TODO\"",
+		"   :END:",
+	}
+
+	want := strings.Join([]string{
+		"Read the org manual and the docs at orgmode (https://orgmode.org).",
+		"",
+		"☐ first",
+		"  ☑ nested",
+		"1. numbered https://example.com",
+	}, "\n")
+
+	if got := PlainText(body); got != want {
+		t.Errorf("PlainText:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	if got := Truncate("short", 10); got != "short" {
+		t.Errorf("Truncate short text: %q", got)
+	}
+
+	got := Truncate("ação ação ação", 10)
+	if len(got) > 10 || !strings.HasSuffix(got, "…") {
+		t.Errorf("Truncate: %q (%d bytes)", got, len(got))
+	}
+}
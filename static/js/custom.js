@@ -6,17 +6,21 @@ function getCookie(key) {
   return keyValue ? keyValue[2] : null;
 }
 
-function deleteCookie( name ) {
-  document.cookie = name + '=; expires=Thu, 01 Jan 1970 00:00:01 GMT;';
-}
+// The state is kept in the session and sent back with the code
+var state;
 
 function onSignIn(authRequest) {
-  $.post("/google/oauth", {code: authRequest.code},
+  $.post("/google/oauth", {code: authRequest.code, state: state},
          function(data, statusText, request) {
            if (statusText == 'success') {
              window.location = '/';
            }
-         });
+         })
+    .fail(function(request) {
+      document.open();
+      document.write(request.responseText);
+      document.close();
+    });
 }
 
 function signOut() {
@@ -24,12 +28,28 @@ function signOut() {
   auth2.signOut().then(function () {
     console.log('User signed out.');
   });
-  deleteCookie("orgo-session");
-  window.location = '/';
+  // The session is deleted on the server, a copy of the cookie is not valid anymore
+  $.post("/logout").always(function() {
+    window.location = '/';
+  });
+}
+
+// The timezone of the browser is used for users who did not choose one
+function detectTimezone() {
+  var body = $('body');
+  if (!body.data('user') || body.data('timezone')) {
+    return;
+  }
+
+  var timezone = Intl.DateTimeFormat().resolvedOptions().timeZone;
+  if (timezone) {
+    $.post("/api/timezone", {timezone: timezone, detected: "1"});
+  }
 }
 
 function startApp() {
   console.log("start app");
+  detectTimezone();
   gapi.load('auth2', function() {
     auth2 = gapi.auth2.init({
       client_id: "203571506393-0vg0i4muh04j9t3vurm68c867ht9uccl.apps.googleusercontent.com",
@@ -40,8 +60,17 @@ function startApp() {
       .text("Sign-out")
       .click(signOut);
 
+    $.getJSON("/google/state", function(data) {
+      state = data.state;
+    });
+
     $('#google-login').click(function() {
       auth2.grantOfflineAccess({redirect_uri: "postmessage"}).then(onSignIn);
     });
+
+    // Consent is asked again so google returns a new refresh token
+    $('#google-reconnect').click(function() {
+      auth2.grantOfflineAccess({redirect_uri: "postmessage", prompt: "consent"}).then(onSignIn);
+    });
   });
 }
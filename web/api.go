@@ -0,0 +1,498 @@
+package web
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	orgodb "github.com/rsampaio/orgo/db"
+	"github.com/rsampaio/orgo/work"
+)
+
+// MappingsHandler lists, saves and deletes the tasklist mappings of the user.
+// ```
+// GET    /api/mappings
+// POST   /api/mappings {"kind": "tag", "value": "work", "tasklist": "Work"}
+// DELETE /api/mappings?kind=tag&value=work
+// ```
+func (h *Handler) MappingsHandler(w http.ResponseWriter, r *http.Request) {
+	userID, err := h.sessionUser(r)
+	if err != nil {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+	case "POST":
+		var mapping orgodb.TasklistMapping
+		if err := json.NewDecoder(r.Body).Decode(&mapping); err != nil {
+			http.Error(w, "invalid mapping", http.StatusBadRequest)
+			return
+		}
+
+		switch mapping.Kind {
+		case orgodb.MappingTag, orgodb.MappingCategory, orgodb.MappingFile:
+		default:
+			http.Error(w, "invalid mapping kind", http.StatusBadRequest)
+			return
+		}
+
+		if mapping.Value == "" || mapping.Tasklist == "" {
+			http.Error(w, "invalid mapping", http.StatusBadRequest)
+			return
+		}
+
+		mapping.UserID = userID
+		if err := h.db.SaveMapping(mapping); err != nil {
+			log.Error(err.Error())
+			http.Error(w, "save mapping", http.StatusInternalServerError)
+			return
+		}
+	case "DELETE":
+		if err := h.db.DeleteMapping(userID, r.FormValue("kind"), r.FormValue("value")); err != nil {
+			log.Error(err.Error())
+			http.Error(w, "delete mapping", http.StatusInternalServerError)
+			return
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Entries are moved to their new tasklist on the next sync
+	if r.Method != "GET" {
+		if err := h.resync(userID); err != nil {
+			log.Errorf("resync %s", err.Error())
+		}
+	}
+
+	mappings, err := h.db.GetMappings(userID)
+	if err != nil {
+		log.Error(err.Error())
+		http.Error(w, "get mappings", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(mappings)
+}
+
+// pendingPlans returns the plans of the user waiting for review.
+func (h *Handler) pendingPlans(userID string) ([]*work.Plan, error) {
+	stored, err := h.db.GetPendingPlans(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	var plans []*work.Plan
+	for _, s := range stored {
+		plan, err := work.LoadPlan(s)
+		if err != nil {
+			return nil, err
+		}
+		plans = append(plans, plan)
+	}
+	return plans, nil
+}
+
+// PlansHandler lists the sync plans of the user waiting for review.
+func (h *Handler) PlansHandler(w http.ResponseWriter, r *http.Request) {
+	userID, err := h.sessionUser(r)
+	if err != nil {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	plans, err := h.pendingPlans(userID)
+	if err != nil {
+		log.Error(err.Error())
+		http.Error(w, "get plans", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(plans)
+}
+
+// PlanActionHandler applies or discards a plan of the user.
+// ```
+// POST /api/plans/apply   id=1
+// POST /api/plans/discard id=1
+// ```
+func (h *Handler) PlanActionHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, err := h.sessionUser(r)
+	if err != nil {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	id, err := strconv.ParseInt(r.FormValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid plan id", http.StatusBadRequest)
+		return
+	}
+
+	plan, err := h.db.GetPlan(id)
+	if err != nil || plan.UserID != userID || plan.Status != orgodb.PlanPending {
+		http.Error(w, "plan not found", http.StatusNotFound)
+		return
+	}
+
+	switch r.URL.Path {
+	case "/api/plans/apply":
+		if _, err := h.db.EnqueueJob(orgodb.JobApply, userID, strconv.FormatInt(id, 10), id); err != nil {
+			log.Error(err.Error())
+			http.Error(w, "apply plan", http.StatusInternalServerError)
+			return
+		}
+	case "/api/plans/discard":
+		if err := h.db.SetPlanStatus(id, orgodb.PlanDiscarded); err != nil {
+			log.Error(err.Error())
+			http.Error(w, "discard plan", http.StatusInternalServerError)
+			return
+		}
+	default:
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+
+	http.Redirect(w, r, "/plans.html", http.StatusSeeOther)
+}
+
+// SettingsHandler reads and updates the settings of the user, forms only
+// update the settings they post and return to the page in next.
+// ```
+// GET  /api/settings
+// POST /api/settings {"tasklist": "orgo", "folders": ["/notes"], "done_keywords": ["DONE"], "deletion": "guard"}
+// ```
+func (h *Handler) SettingsHandler(w http.ResponseWriter, r *http.Request) {
+	userID, err := h.sessionUser(r)
+	if err != nil {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	settings, err := h.db.GetSettings(userID)
+	if err != nil {
+		log.Error(err.Error())
+		http.Error(w, "get settings", http.StatusInternalServerError)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+	case "POST", "PUT":
+		previous := settings
+		if r.Header.Get("Content-Type") == "application/json" {
+			err = json.NewDecoder(r.Body).Decode(&settings)
+		} else {
+			err = formSettings(r, &settings)
+		}
+
+		if err != nil {
+			http.Error(w, "invalid settings", http.StatusBadRequest)
+			return
+		}
+
+		if err := settings.Validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if _, err := time.LoadLocation(settings.Timezone); err != nil {
+			http.Error(w, "unknown timezone", http.StatusBadRequest)
+			return
+		}
+
+		settings.UserID = userID
+		if err := h.db.SaveSettings(settings); err != nil {
+			log.Error(err.Error())
+			http.Error(w, "save settings", http.StatusInternalServerError)
+			return
+		}
+
+		// Files are read again when what is synced from them changed
+		if needsResync(previous, settings) {
+			if err := h.resync(userID); err != nil {
+				log.Errorf("resync %s", err.Error())
+			}
+		}
+
+		if r.Header.Get("Content-Type") != "application/json" {
+			next := r.FormValue("next")
+			if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") {
+				next = "/settings.html"
+			}
+			http.Redirect(w, r, next, http.StatusSeeOther)
+			return
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(settings)
+}
+
+// formSettings reads the settings posted by a form, lists are one value per line.
+func formSettings(r *http.Request, settings *orgodb.Settings) error {
+	if err := r.ParseForm(); err != nil {
+		return err
+	}
+
+	lines := func(value string) orgodb.List {
+		var list orgodb.List
+		for _, line := range strings.Split(value, "\n") {
+			if line = strings.TrimSpace(line); line != "" {
+				list = append(list, line)
+			}
+		}
+		return list
+	}
+
+	for key := range r.PostForm {
+		value := r.PostForm.Get(key)
+		switch key {
+		case "always_preview":
+			preview, err := strconv.ParseBool(value)
+			if err != nil {
+				return err
+			}
+			settings.AlwaysPreview = preview
+		case "tasklist":
+			settings.Tasklist = strings.TrimSpace(value)
+		case "folders":
+			settings.Folders = lines(value)
+		case "done_keywords":
+			settings.DoneKeywords = lines(value)
+		case "deletion":
+			settings.Deletion = value
+		case "timezone":
+			settings.Timezone = strings.TrimSpace(value)
+		}
+	}
+	return nil
+}
+
+// needsResync reports whether a change of settings changes the entries synced from the files.
+func needsResync(previous, current orgodb.Settings) bool {
+	return previous.Tasklist != current.Tasklist ||
+		previous.Timezone != current.Timezone ||
+		strings.Join(previous.Folders, ",") != strings.Join(current.Folders, ",") ||
+		strings.Join(previous.DoneKeywords, ",") != strings.Join(current.DoneKeywords, ",")
+}
+
+// TrashHandler lists the tasks of the user deleted by syncs.
+func (h *Handler) TrashHandler(w http.ResponseWriter, r *http.Request) {
+	userID, err := h.sessionUser(r)
+	if err != nil {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	trash, err := h.db.GetTrash(userID)
+	if err != nil {
+		log.Error(err.Error())
+		http.Error(w, "get trash", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(trash)
+}
+
+// RestoreHandler restores a task of the user from the trash.
+// ```
+// POST /api/trash/restore id=1
+// ```
+func (h *Handler) RestoreHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, err := h.sessionUser(r)
+	if err != nil {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	id, err := strconv.ParseInt(r.FormValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid trash id", http.StatusBadRequest)
+		return
+	}
+
+	entry, err := h.db.GetTrashEntry(id)
+	if err != nil || entry.UserID != userID {
+		http.Error(w, "trash entry not found", http.StatusNotFound)
+		return
+	}
+
+	if _, err := h.db.EnqueueJob(orgodb.JobRestore, userID, strconv.FormatInt(id, 10), id); err != nil {
+		log.Error(err.Error())
+		http.Error(w, "restore task", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/trash.html", http.StatusSeeOther)
+}
+
+// DisconnectHandler queues unlinking google or dropbox from the user, the
+// tasklists created by orgo are removed when remove_tasklists is set.
+func (h *Handler) DisconnectHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, err := h.sessionUser(r)
+	if err != nil {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	d := work.Disconnect{
+		Provider:        r.FormValue("provider"),
+		Account:         r.FormValue("account"),
+		RemoveTasklists: r.FormValue("remove_tasklists") != "",
+	}
+	if d.Provider != "google" && d.Provider != "dropbox" {
+		http.Error(w, "invalid provider", http.StatusBadRequest)
+		return
+	}
+
+	if _, err := h.db.EnqueueJob(orgodb.JobDisconnect, userID, d.Provider+d.Account, d); err != nil {
+		log.Error(err.Error())
+		http.Error(w, "disconnect", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/accounts.html", http.StatusSeeOther)
+}
+
+// TimezoneHandler sets the timezone of the user, the browser sends the
+// timezone it detected when the user has none.
+// ```
+// POST /api/timezone {"timezone": "Europe/Lisbon", "detected": true}
+// ```
+func (h *Handler) TimezoneHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, err := h.sessionUser(r)
+	if err != nil {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var request struct {
+		Timezone string `json:"timezone"`
+		Detected bool   `json:"detected"`
+	}
+
+	if r.Header.Get("Content-Type") == "application/json" {
+		err = json.NewDecoder(r.Body).Decode(&request)
+	} else {
+		request.Timezone = r.FormValue("timezone")
+		request.Detected = r.FormValue("detected") != ""
+	}
+
+	if err != nil || request.Timezone == "" {
+		http.Error(w, "invalid timezone", http.StatusBadRequest)
+		return
+	}
+
+	if _, err := time.LoadLocation(request.Timezone); err != nil {
+		http.Error(w, "unknown timezone", http.StatusBadRequest)
+		return
+	}
+
+	user, err := h.db.GetUser(userID)
+	if err != nil {
+		log.Error(err.Error())
+		http.Error(w, "get user", http.StatusInternalServerError)
+		return
+	}
+
+	// A detected timezone does not replace the one chosen by the user
+	if !request.Detected || user.Timezone == "" {
+		if err := h.db.SetTimezone(userID, request.Timezone); err != nil {
+			log.Error(err.Error())
+			http.Error(w, "set timezone", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if r.Header.Get("Content-Type") != "application/json" {
+		http.Redirect(w, r, "/settings.html", http.StatusSeeOther)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// RevokeSessionHandler signs out another session of the user, the session is
+// posted by its handle.
+func (h *Handler) RevokeSessionHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, err := h.sessionUser(r)
+	if err != nil {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	sessions, err := h.db.GetSessions(userID)
+	if err != nil {
+		log.Error(err.Error())
+		http.Error(w, "revoke session", http.StatusInternalServerError)
+		return
+	}
+
+	for _, session := range sessions {
+		if session.Handle() != r.FormValue("id") {
+			continue
+		}
+
+		if err := h.db.DeleteSession(session.ID); err != nil {
+			log.Error(err.Error())
+			http.Error(w, "revoke session", http.StatusInternalServerError)
+			return
+		}
+		http.Redirect(w, r, "/sessions.html", http.StatusSeeOther)
+		return
+	}
+	http.Error(w, "session not found", http.StatusNotFound)
+}
+
+// SyncsHandler lists the latest sync runs of the user with their errors.
+func (h *Handler) SyncsHandler(w http.ResponseWriter, r *http.Request) {
+	userID, err := h.sessionUser(r)
+	if err != nil {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	runs, err := h.db.GetRuns(userID, latestRuns)
+	if err != nil {
+		log.Error(err.Error())
+		http.Error(w, "get syncs", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(runs)
+}
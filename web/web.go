@@ -2,34 +2,163 @@ package web
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"html/template"
 	"net/http"
 	"os"
 	"path"
+	"strings"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
 	orgodb "github.com/rsampaio/orgo/db"
+	"github.com/rsampaio/orgo/org"
+	"github.com/rsampaio/orgo/work"
 
 	"github.com/gorilla/sessions"
+	upper "upper.io/db.v3"
 )
 
-// Handler struct with unexported fields.
+type contextKey string
+
+const userKey contextKey = "user"
+
+// funcs are available to every template.
+var funcs = template.FuncMap{
+	"plaintext": func(body string) string {
+		return org.PlainText(strings.Split(body, "\n"))
+	},
+	"lines": func(list orgodb.List) string {
+		return strings.Join(list, "\n")
+	},
+}
+
+// templateData is passed to every template.
+type templateData struct {
+	URLs     map[string]string
+	Entries  []*orgodb.OrgEntry
+	Plans    []*work.Plan
+	Settings orgodb.Settings
+	Trash    []orgodb.TrashEntry
+	Runs     []orgodb.SyncRun
+
+	Diagnostics []orgodb.Diagnostic
+	// Reconnect lists the providers the user must authorize again
+	Reconnect []string
+	// User signed in and the dropbox accounts linked to it
+	User    orgodb.User
+	Dropbox []orgodb.Account
+	// Sessions of the user, SessionID is the one of the request
+	Sessions  []orgodb.Session
+	SessionID string
+}
+
+// latestRuns is the number of sync runs shown to the user
+const latestRuns = 10
+
+// ErrNoSession is returned for requests without a valid session.
+var ErrNoSession = errors.New("no session")
+
+// Handler struct serving the pages and the api.
 type Handler struct {
+	// SessionIdle is how long a session lasts without being used
+	SessionIdle time.Duration
+
 	ctx   context.Context
 	store *sessions.CookieStore
 	urls  map[string]string
-	db    *orgodb.DB
+	db    orgodb.Store
 }
 
 // NewHandler returns an instance of Handler.
-func NewHandler(ctx context.Context, store *sessions.CookieStore, urls map[string]string) *Handler {
+func NewHandler(ctx context.Context, store *sessions.CookieStore, urls map[string]string, db orgodb.Store) *Handler {
 	return &Handler{
-		ctx:   ctx,
-		store: store,
-		urls:  urls,
-		db:    orgodb.NewDB("orgo.db"),
+		SessionIdle: 72 * time.Hour,
+		ctx:         ctx,
+		store:       store,
+		urls:        urls,
+		db:          db,
+	}
+}
+
+// sessionUser returns the user of the request session, using the session keeps it from expiring idle.
+func (h *Handler) sessionUser(r *http.Request) (string, error) {
+	session, _ := h.store.Get(r, "orgo-session")
+	sessionID, ok := session.Values["session_id"].(string)
+	if !ok {
+		return "", ErrNoSession
+	}
+
+	userID, err := h.db.TouchSession(sessionID, h.SessionIdle)
+	if err == upper.ErrNoMoreRows {
+		return "", ErrNoSession
+	}
+	return userID, err
+}
+
+// resync forgets the dropbox cursors of the user and queues a sync of every file.
+func (h *Handler) resync(userID string) error {
+	accounts, err := h.db.GetAccounts(userID, "dropbox")
+	if err != nil {
+		return err
+	}
+
+	for _, account := range accounts {
+		if err := h.db.DeleteCursor(account.Account); err != nil {
+			return err
+		}
+
+		if _, err := h.db.EnqueueJob(orgodb.JobProcess, userID, account.Account, account.Account); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reconnect returns the providers whose token could not be refreshed.
+func (h *Handler) reconnect(userID string) []string {
+	var providers []string
+	if googleID, err := h.db.GetAccountID(userID, "google"); err == nil {
+		if t, err := h.db.GetToken("google", googleID); err == nil && t.NeedsConsent {
+			providers = append(providers, "google")
+		}
+	}
+
+	accounts, err := h.db.GetAccounts(userID, "dropbox")
+	if err != nil {
+		return providers
+	}
+
+	for _, account := range accounts {
+		if t, err := h.db.GetToken("dropbox", account.Account); err == nil && t.NeedsConsent {
+			return append(providers, "dropbox")
+		}
 	}
+	return providers
+}
+
+// LogoutHandler signs the session out, the session is deleted so a copy of the cookie is not valid anymore.
+func (h *Handler) LogoutHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	session, _ := h.store.Get(r, "orgo-session")
+	if sessionID, ok := session.Values["session_id"].(string); ok {
+		if err := h.db.DeleteSession(sessionID); err != nil {
+			log.Error(err.Error())
+			http.Error(w, "logout", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	session.Options.MaxAge = -1
+	if err := session.Save(r, w); err != nil {
+		log.Error(err.Error())
+	}
+	http.Redirect(w, r, "/", http.StatusSeeOther)
 }
 
 // IndexMiddleware wrap requests to protected resources.
@@ -37,20 +166,26 @@ func (h *Handler) IndexMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		session, _ := h.store.Get(r, "orgo-session")
 		if ok := session.Values["session_id"]; ok != nil {
-			log.Infof("session %s", session.Values["session_id"].(string))
-			userID, err := h.db.GetSession(session.Values["session_id"].(string))
+			userID, err := h.sessionUser(r)
 			if err != nil {
-				r.URL.Path = "/error.html"
+				// Expired and logged out sessions sign in again
+				log.Infof("session %s: %s", session.Values["session_id"], err.Error())
+				delete(session.Values, "session_id")
+				session.Save(r, w)
+				r.URL.Path = "/index.html"
 				goto reply
 			}
 
 			log.Infof("session %s", userID)
-			_, err = h.db.GetDropboxID(userID)
+			_, err = h.db.GetAccountID(userID, "dropbox")
 			if err != nil {
 				r.URL.Path = "/dropbox.html"
 				goto reply
 			} else {
-				r.URL.Path = "/logged.html"
+				r = r.WithContext(context.WithValue(r.Context(), userKey, userID))
+				if r.URL.Path == "/" || r.URL.Path == "/index.html" || r.URL.Path == "/dropbox.html" {
+					r.URL.Path = "/logged.html"
+				}
 				goto reply
 			}
 		} else {
@@ -86,14 +221,67 @@ func (h *Handler) TemplateHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	tmpl, err := template.ParseFiles(layout, bodyTmpl)
+	tmpl, err := template.New("layout").Funcs(funcs).ParseFiles(layout, bodyTmpl)
 	if err != nil {
 		log.Error(err.Error())
 		http.Error(w, "template", http.StatusInternalServerError)
 		return
 	}
 
-	if err := tmpl.ExecuteTemplate(w, "layout", h.urls); err != nil {
+	data := templateData{URLs: h.urls}
+	if userID, ok := r.Context().Value(userKey).(string); ok {
+		data.Entries, err = h.db.GetEntries(userID)
+		if err != nil {
+			log.Error(err.Error())
+		}
+
+		data.Plans, err = h.pendingPlans(userID)
+		if err != nil {
+			log.Error(err.Error())
+		}
+
+		data.Settings, err = h.db.GetSettings(userID)
+		if err != nil {
+			log.Error(err.Error())
+		}
+
+		data.Trash, err = h.db.GetTrash(userID)
+		if err != nil {
+			log.Error(err.Error())
+		}
+
+		data.Runs, err = h.db.GetRuns(userID, latestRuns)
+		if err != nil {
+			log.Error(err.Error())
+		}
+
+		data.Diagnostics, err = h.db.GetDiagnostics(userID)
+		if err != nil {
+			log.Error(err.Error())
+		}
+
+		data.Reconnect = h.reconnect(userID)
+
+		data.User, err = h.db.GetUser(userID)
+		if err != nil {
+			log.Error(err.Error())
+		}
+
+		data.Dropbox, err = h.db.GetAccounts(userID, "dropbox")
+		if err != nil {
+			log.Error(err.Error())
+		}
+
+		data.Sessions, err = h.db.GetSessions(userID)
+		if err != nil {
+			log.Error(err.Error())
+		}
+
+		session, _ := h.store.Get(r, "orgo-session")
+		data.SessionID, _ = session.Values["session_id"].(string)
+	}
+
+	if err := tmpl.ExecuteTemplate(w, "layout", data); err != nil {
 		log.Error(err.Error())
 		http.Error(w, "template", http.StatusInternalServerError)
 	}
@@ -0,0 +1,319 @@
+package work
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	orgodb "github.com/rsampaio/orgo/db"
+	tasks "google.golang.org/api/tasks/v1"
+)
+
+// Endpoints revoking the tokens of an account
+var (
+	googleRevokeURL  = "https://oauth2.googleapis.com/revoke"
+	dropboxRevokeURL = "https://api.dropboxapi.com/2/auth/token/revoke"
+)
+
+// Disconnect is the payload of a disconnect job.
+type Disconnect struct {
+	// Provider is "google" or "dropbox", google signs the user in so
+	// disconnecting it disconnects dropbox as well
+	Provider string `json:"provider"`
+	// Account is the dropbox account to disconnect, every one when empty
+	Account string `json:"account"`
+	// RemoveTasklists deletes the tasklists created by orgo and their tasks
+	RemoveTasklists bool `json:"remove_tasklists"`
+}
+
+// Disconnect unlinks a provider from an user, revoking and deleting its tokens
+// and stopping the syncs queued for it.
+func (w *Work) Disconnect(ctx context.Context, userID string, d Disconnect) error {
+	switch d.Provider {
+	case "dropbox":
+		return w.disconnectDropbox(ctx, userID, d.Account, d.RemoveTasklists)
+	case "google":
+		if err := w.disconnectDropbox(ctx, userID, "", d.RemoveTasklists); err != nil {
+			return err
+		}
+		return w.disconnectGoogle(ctx, userID)
+	}
+	return fmt.Errorf("unknown provider %q", d.Provider)
+}
+
+// disconnectDropbox unlinks a dropbox account of an user, or every one when
+// account is empty, and forgets its files.
+func (w *Work) disconnectDropbox(ctx context.Context, userID, account string, removeTasklists bool) error {
+	accounts, err := w.db.GetAccounts(userID, "dropbox")
+	if err != nil {
+		return err
+	}
+
+	// Tasklists are removed first, it needs the google token and can be retried.
+	// Only the tasks of the files of the account are removed when others stay linked.
+	if removeTasklists {
+		var fileIDs map[string]bool
+		if account != "" {
+			fileIDs = make(map[string]bool)
+			for _, a := range accounts {
+				if a.Account != account {
+					continue
+				}
+
+				files, err := w.db.GetFiles(a.Account)
+				if err != nil {
+					return err
+				}
+				for _, file := range files {
+					fileIDs[file.FileID] = true
+				}
+			}
+		}
+
+		if err := w.removeTasklists(ctx, userID, fileIDs); err != nil {
+			return err
+		}
+	}
+
+	linked := len(accounts)
+	for _, a := range accounts {
+		if account != "" && a.Account != account {
+			continue
+		}
+
+		if err := w.unlinkDropbox(ctx, userID, a.Account); err != nil {
+			return err
+		}
+		linked--
+	}
+
+	if linked > 0 {
+		return nil
+	}
+
+	// Nothing is left to sync for the user
+	if err := w.db.CancelJobs(userID, orgodb.JobProcess, orgodb.JobSync, orgodb.JobApply); err != nil {
+		return err
+	}
+	if err := w.db.DiscardUserPlans(userID); err != nil {
+		return err
+	}
+	return w.db.DeleteDiagnostics(userID)
+}
+
+// unlinkDropbox revokes the token of a dropbox account, stops its syncs and forgets its files.
+func (w *Work) unlinkDropbox(ctx context.Context, userID, dropboxID string) error {
+	if err := w.db.CancelTopic(userID, dropboxID); err != nil {
+		return err
+	}
+
+	files, err := w.db.GetFiles(dropboxID)
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		if err := w.db.CancelTopic(userID, file.FileID); err != nil {
+			return err
+		}
+		if err := w.db.DiscardPendingPlans(userID, file.FileID); err != nil {
+			return err
+		}
+		if err := w.db.ReplaceDiagnostics(userID, file.FileID, nil); err != nil {
+			return err
+		}
+	}
+
+	if t, err := w.db.GetToken("dropbox", dropboxID); err == nil {
+		w.revoke(ctx, t)
+	}
+
+	if err := w.db.DeleteFiles(dropboxID); err != nil {
+		return err
+	}
+	if err := w.db.DeleteCursor(dropboxID); err != nil {
+		return err
+	}
+	if err := w.db.DeleteToken("dropbox", dropboxID); err != nil {
+		return err
+	}
+
+	log.Infof("dropbox %s disconnected from %s", dropboxID, userID)
+	return w.db.UnlinkAccount("dropbox", dropboxID)
+}
+
+// disconnectGoogle forgets the google token of an user and signs them out.
+func (w *Work) disconnectGoogle(ctx context.Context, userID string) error {
+	if err := w.db.CancelJobs(userID, orgodb.JobRestore); err != nil {
+		return err
+	}
+
+	googleID, err := w.db.GetAccountID(userID, "google")
+	if err != nil {
+		return err
+	}
+
+	if t, err := w.db.GetToken("google", googleID); err == nil {
+		w.revoke(ctx, t)
+	}
+
+	// The google account stays linked so signing in again returns to the same user
+	if err := w.db.DeleteToken("google", googleID); err != nil {
+		return err
+	}
+
+	log.Infof("google %s disconnected", userID)
+	return w.db.DeleteSessions(userID)
+}
+
+// removeTasklists deletes the tasks synced from the files in fileIDs, or from
+// every file when nil, and forgets their entries. The tasklists created by orgo
+// no other entry is synced to are deleted with them, a tasklist or task already
+// deleted by the user is skipped.
+func (w *Work) removeTasklists(ctx context.Context, userID string, fileIDs map[string]bool) error {
+	service, err := w.tasksService(ctx, userID)
+	if err != nil {
+		return err
+	}
+
+	stored, err := w.db.GetEntries(userID)
+	if err != nil {
+		return err
+	}
+
+	prefs, err := w.preferences(userID)
+	if err != nil {
+		return err
+	}
+
+	mappings, err := w.db.GetMappings(userID)
+	if err != nil {
+		return err
+	}
+
+	var (
+		removed = make(map[string][]*orgodb.OrgEntry)
+		used    = make(map[string]bool)
+	)
+	for _, entry := range stored {
+		title := tasklistOf(mappings, entry, prefs.Tasklist)
+		if fileIDs == nil || fileIDs[entry.FileID] {
+			removed[title] = append(removed[title], entry)
+		} else {
+			used[title] = true
+		}
+	}
+
+	managed, err := w.db.GetTasklists(userID)
+	if err != nil {
+		return err
+	}
+
+	for _, list := range managed {
+		if used[list.Title] || (fileIDs != nil && removed[list.Title] == nil) {
+			continue
+		}
+
+		err := tasks.NewTasklistsService(service).Delete(list.ListID).Context(ctx).Do()
+		if err != nil && !isNotFound(err) {
+			return err
+		}
+
+		log.Infof("tasklist removed: %s", list.Title)
+		if err := w.db.DeleteTasklist(userID, list.ListID); err != nil {
+			return err
+		}
+		delete(removed, list.Title)
+	}
+
+	// The tasklists still used keep the tasks of the other files
+	for title, entries := range removed {
+		if err := removeTasks(ctx, service, title, entries); err != nil {
+			return err
+		}
+	}
+
+	if fileIDs == nil {
+		return w.db.DeleteEntries(userID)
+	}
+
+	for fileID := range fileIDs {
+		if err := w.db.DeleteFileEntries(userID, fileID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeTasks deletes the tasks synced from entries in a tasklist.
+func removeTasks(ctx context.Context, service *tasks.Service, title string, entries []*orgodb.OrgEntry) error {
+	tl, err := findTasklist(ctx, service, title)
+	if err != nil || tl == nil {
+		return err
+	}
+
+	remote, err := listTasks(ctx, service, tl.Id)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		task := findTask(remote, entry)
+		if task == nil {
+			continue
+		}
+
+		err := tasks.NewTasksService(service).Delete(tl.Id, task.Id).Context(ctx).Do()
+		if err != nil && !isNotFound(err) {
+			return err
+		}
+		log.Infof("task removed: %s", task.Title)
+	}
+	return nil
+}
+
+// revoke revokes a token with its provider, a token that can not be
+// revoked is still deleted so failures are only logged.
+func (w *Work) revoke(ctx context.Context, t orgodb.Token) {
+	var req *http.Request
+	switch t.Provider {
+	case "google":
+		// Revoking the refresh token revokes the whole grant
+		token := t.RefreshToken
+		if token == "" {
+			token = t.AccessToken
+		}
+		req, _ = http.NewRequest("POST", googleRevokeURL, strings.NewReader(url.Values{"token": {token}}.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	case "dropbox":
+		// Dropbox revokes the token authorizing the call, an expired one is refreshed first
+		source, err := w.tokenSource(ctx, w.DropboxOauth, t)
+		if err != nil {
+			log.Errorf("revoke dropbox token of %s: %s", t.Account, err.Error())
+			return
+		}
+		current, err := source.Token()
+		if err != nil {
+			log.Errorf("revoke dropbox token of %s: %s", t.Account, err.Error())
+			return
+		}
+		req, _ = http.NewRequest("POST", dropboxRevokeURL, nil)
+		current.SetAuthHeader(req)
+	default:
+		return
+	}
+
+	res, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		log.Errorf("revoke %s token of %s: %s", t.Provider, t.Account, err.Error())
+		return
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		log.Errorf("revoke %s token of %s: %s", t.Provider, t.Account, res.Status)
+	}
+}
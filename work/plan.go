@@ -0,0 +1,494 @@
+package work
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	orgodb "github.com/rsampaio/orgo/db"
+	"google.golang.org/api/googleapi"
+	tasks "google.golang.org/api/tasks/v1"
+)
+
+// Action is the kind of change a plan makes to a remote task.
+type Action string
+
+// Plan actions
+const (
+	ActionCreate   Action = "create"
+	ActionUpdate   Action = "update"
+	ActionComplete Action = "complete"
+	ActionDelete   Action = "delete"
+	// ActionMove removes the task of an entry mapped to another tasklist,
+	// the entry is created in the new tasklist by the same plan
+	ActionMove Action = "move"
+)
+
+// sinkTasks names the google tasks sink in plan changes
+const sinkTasks = "google_tasks"
+
+// Change is a planned change to a task of a sink.
+type Change struct {
+	Action     Action `json:"action"`
+	Sink       string `json:"sink"`
+	Tasklist   string `json:"tasklist"`
+	TasklistID string `json:"tasklist_id,omitempty"`
+	TaskID     string `json:"task_id,omitempty"`
+	Title      string `json:"title"`
+	File       string `json:"file,omitempty"`
+	Line       int    `json:"line,omitempty"`
+
+	// Task and Entry keep what a deletion removes so it can be restored from the trash
+	Task  *tasks.Task      `json:"task,omitempty"`
+	Entry *orgodb.OrgEntry `json:"entry,omitempty"`
+}
+
+// Plan is the set of changes that syncs the entries parsed from a file.
+type Plan struct {
+	ID      int64              `json:"id"`
+	UserID  string             `json:"user_id"`
+	FileID  string             `json:"file_id"`
+	File    string             `json:"file"`
+	Created time.Time          `json:"created"`
+	Entries []*orgodb.OrgEntry `json:"entries"`
+	Changes []Change           `json:"changes"`
+
+	// Held plans delete too many entries and wait for review
+	Held       bool   `json:"held"`
+	HeldReason string `json:"held_reason,omitempty"`
+	// DeletesOnly plans hold the deletions split from a plan applied without them
+	DeletesOnly bool `json:"deletes_only"`
+	// Retained entries are stored with the entries of a plan applied without its
+	// deletions, other files keep their tasks until the held plan is applied
+	Retained []*orgodb.OrgEntry `json:"retained,omitempty"`
+}
+
+// Count returns the number of changes with the action.
+func (p *Plan) Count(action Action) int {
+	var n int
+	for _, c := range p.Changes {
+		if c.Action == action {
+			n++
+		}
+	}
+	return n
+}
+
+// String formats the plan with one change per line.
+func (p *Plan) String() string {
+	lines := []string{fmt.Sprintf("plan %d: %s (%s)", p.ID, p.File, p.Created.Format(time.RFC3339))}
+	for _, c := range p.Changes {
+		lines = append(lines, fmt.Sprintf("  %-8s %-12s %s", c.Action, c.Tasklist, c.Title))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// LoadPlan decodes a stored plan.
+func LoadPlan(stored orgodb.StoredPlan) (*Plan, error) {
+	var plan Plan
+	if err := json.Unmarshal([]byte(stored.Data), &plan); err != nil {
+		return nil, err
+	}
+	plan.ID = stored.ID
+	return &plan, nil
+}
+
+// PlanFile diffs the entries parsed from a file against the stored entries
+// and the remote tasks, nothing is changed until the plan is applied.
+func (w *Work) PlanFile(ctx context.Context, service *tasks.Service, userID, fileID string, entries []*orgodb.OrgEntry) (*Plan, error) {
+	mappings, err := w.db.GetMappings(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	previous, err := w.db.GetFileEntries(userID, fileID)
+	if err != nil {
+		return nil, err
+	}
+
+	stored, err := w.db.GetEntries(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	prefs, err := w.preferences(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	tasklists, err := w.db.GetTasklists(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	managed := make(map[string]bool)
+	for _, list := range tasklists {
+		managed[list.ListID] = true
+	}
+
+	var (
+		plan    = &Plan{UserID: userID, FileID: fileID, Created: time.Now(), Entries: entries}
+		titles  []string
+		lists   = make(map[string][]*orgodb.OrgEntry)
+		kept    = make(map[string][]*orgodb.OrgEntry)
+		matched = make(map[string]bool)
+		parsed  = make(map[string]bool)
+	)
+
+	addList := func(title string) {
+		if _, ok := lists[title]; !ok {
+			titles = append(titles, title)
+			lists[title] = nil
+		}
+	}
+
+	for _, entry := range entries {
+		parsed[entry.ID()] = true
+		entry.Tasklist = tasklistFor(mappings, entry, prefs.Tasklist)
+		entry.TaskID = previousTask(previous, entry, mappings, prefs.Tasklist)
+		addList(entry.Tasklist)
+		lists[entry.Tasklist] = append(lists[entry.Tasklist], entry)
+		kept[entry.Tasklist] = append(kept[entry.Tasklist], entry)
+		plan.File = entry.File
+	}
+
+	// Entries from every other file mapped to a tasklist are kept
+	for _, entry := range stored {
+		if entry.FileID != fileID {
+			title := tasklistOf(mappings, entry, prefs.Tasklist)
+			kept[title] = append(kept[title], entry)
+		}
+	}
+
+	// Tasklists the file had entries in may have tasks to delete
+	for _, entry := range previous {
+		addList(tasklistOf(mappings, entry, prefs.Tasklist))
+		if plan.File == "" {
+			plan.File = entry.File
+		}
+	}
+
+	for _, title := range titles {
+		tl, err := findTasklist(ctx, service, title)
+		if err != nil {
+			return nil, err
+		}
+
+		var remote []*tasks.Task
+		if tl != nil {
+			remote, err = listTasks(ctx, service, tl.Id)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		for _, entry := range lists[title] {
+			change := Change{Sink: sinkTasks, Tasklist: title, Title: entry.Title, File: entry.File, Line: entry.Line}
+			task := entryTask(entry, prefs)
+			current := findTask(remote, entry)
+			if current != nil && matched[current.Id] {
+				// a repeated heading not synced yet matches the task of the first one
+				current = nil
+			}
+			if current != nil {
+				matched[current.Id] = true
+			}
+
+			switch {
+			case current == nil:
+				change.Action = ActionCreate
+			case task.Status == "completed" && current.Status != "completed":
+				change.Action = ActionComplete
+			case taskChanged(current, task):
+				change.Action = ActionUpdate
+			default:
+				continue
+			}
+
+			if current != nil {
+				change.TasklistID = tl.Id
+				change.TaskID = current.Id
+			}
+			plan.Changes = append(plan.Changes, change)
+		}
+
+		// Only the tasks orgo created are deleted, the tasklists orgo did not create
+		// are shared with the tasks the user adds by hand to them
+		for _, task := range remote {
+			entry := findEntry(previous, task)
+			if findEntry(kept[title], task) != nil || (entry == nil && !managed[tl.Id]) {
+				continue
+			}
+
+			// Entries still in the file moved to another tasklist, deleting their
+			// old task is not held with the deletions of the file
+			action := ActionDelete
+			if entry != nil && parsed[entry.ID()] {
+				action = ActionMove
+			}
+
+			plan.Changes = append(plan.Changes, Change{
+				Action:     action,
+				Sink:       sinkTasks,
+				Tasklist:   title,
+				TasklistID: tl.Id,
+				TaskID:     task.Id,
+				Title:      task.Title,
+				File:       taskFile(task),
+				Task:       task,
+				Entry:      entry,
+			})
+		}
+	}
+
+	return plan, nil
+}
+
+// previousTask returns the task the entry was synced to when the file was
+// last synced, the id is kept while the entry stays in the same tasklist
+// so a renamed file updates its tasks instead of recreating them.
+func previousTask(previous []*orgodb.OrgEntry, entry *orgodb.OrgEntry, mappings []orgodb.TasklistMapping, fallback string) string {
+	for _, p := range previous {
+		if p.ID() == entry.ID() && tasklistOf(mappings, p, fallback) == entry.Tasklist {
+			return p.TaskID
+		}
+	}
+	return ""
+}
+
+// guard splits the deletions from a plan following the deletion policy of the user.
+// By default a plan deleting more than DeleteThreshold of the stored entries is held,
+// a truncated or emptied file would otherwise remove every task. The deletions are
+// returned as a held plan and the rest can be applied. Users keeping their tasks
+// have the deletions dropped from the plan.
+func (w *Work) guard(plan *Plan, stored int, policy string) *Plan {
+	deletes := plan.Count(ActionDelete)
+	reason := fmt.Sprintf("deletes %d tasks, %d entries are stored", deletes, stored)
+
+	switch policy {
+	case orgodb.DeletionAlways:
+		return nil
+	case orgodb.DeletionKeep:
+		var rest []Change
+		for _, c := range plan.Changes {
+			if c.Action != ActionDelete {
+				rest = append(rest, c)
+			}
+		}
+		plan.Changes = rest
+		return nil
+	case orgodb.DeletionReview:
+		if deletes == 0 {
+			return nil
+		}
+		reason = fmt.Sprintf("deletes %d tasks, deletions are reviewed", deletes)
+	default:
+		if deletes <= w.DeleteMinimum || float64(deletes) <= w.DeleteThreshold*float64(stored) {
+			return nil
+		}
+	}
+
+	held := *plan
+	held.Held = true
+	held.HeldReason = reason
+	held.DeletesOnly = true
+	held.Entries = nil
+	held.Changes = nil
+
+	var rest []Change
+	for _, c := range plan.Changes {
+		if c.Action == ActionDelete {
+			held.Changes = append(held.Changes, c)
+		} else {
+			rest = append(rest, c)
+		}
+	}
+	plan.Changes = rest
+	return &held
+}
+
+// savePlan stores a plan for review.
+func (w *Work) savePlan(plan *Plan) (int64, error) {
+	data, err := json.Marshal(plan)
+	if err != nil {
+		return 0, err
+	}
+
+	return w.db.SavePlan(orgodb.StoredPlan{
+		UserID:  plan.UserID,
+		FileID:  plan.FileID,
+		Created: plan.Created,
+		Data:    string(data),
+	})
+}
+
+// ApplyPlan applies a plan that was stored for review.
+func (w *Work) ApplyPlan(ctx context.Context, id int64) error {
+	stored, err := w.db.GetPlan(id)
+	if orgodb.NotFound(err) {
+		return &PermanentError{Err: fmt.Errorf("plan %d not found", id)}
+	}
+	if err != nil {
+		return err
+	}
+
+	// A newer sync of the file replaced the plan or it was already reviewed
+	if stored.Status != orgodb.PlanPending {
+		return &PermanentError{Err: fmt.Errorf("plan %d is %s", id, stored.Status)}
+	}
+
+	plan, err := LoadPlan(stored)
+	if err != nil {
+		return err
+	}
+	runOf(ctx).File = plan.File
+
+	service, err := w.tasksService(ctx, plan.UserID)
+	if err != nil {
+		return err
+	}
+
+	if err := w.applyPlan(ctx, service, plan); err != nil {
+		return err
+	}
+
+	return w.db.SetPlanStatus(id, orgodb.PlanApplied)
+}
+
+// applyPlan applies the changes of the plan to google tasks and stores its entries,
+// deleted tasks are kept in the trash. The entries are stored last so an interrupted
+// plan is planned again from the same entries, the entries of held deletions are
+// dropped when the held plan is applied.
+func (w *Work) applyPlan(ctx context.Context, service *tasks.Service, plan *Plan) error {
+	if !plan.DeletesOnly {
+		if err := w.syncPlan(ctx, service, plan); err != nil {
+			return err
+		}
+	}
+
+	t := tasks.NewTasksService(service)
+	for _, change := range plan.Changes {
+		if change.Action != ActionDelete && change.Action != ActionMove {
+			continue
+		}
+
+		// The task of a moved entry was created again in its new tasklist
+		if change.Action == ActionDelete {
+			if err := w.trash(plan.UserID, change); err != nil {
+				return err
+			}
+		}
+
+		log.Infof("deleting task: %v", change.Title)
+		if err := t.Delete(change.TasklistID, change.TaskID).Context(ctx).Do(); err != nil && !isNotFound(err) {
+			return err
+		}
+	}
+
+	if plan.DeletesOnly {
+		if err := w.dropDeleted(plan); err != nil {
+			return err
+		}
+	} else if err := w.db.ReplaceFileEntries(plan.UserID, plan.FileID, retain(plan.Entries, plan.Retained)); err != nil {
+		return err
+	}
+
+	run := runOf(ctx)
+	run.Created += plan.Count(ActionCreate)
+	run.Updated += plan.Count(ActionUpdate)
+	run.Completed += plan.Count(ActionComplete)
+	run.Deleted += plan.Count(ActionDelete)
+
+	stored, err := w.db.GetEntries(plan.UserID)
+	if err != nil {
+		return err
+	}
+
+	return w.collectTasklists(ctx, service, plan.UserID, stored)
+}
+
+// retain returns the entries with the retained entries whose key is not
+// in entries.
+func retain(entries, retained []*orgodb.OrgEntry) []*orgodb.OrgEntry {
+	keys := make(map[string]bool)
+	for _, entry := range entries {
+		keys[entry.ID()] = true
+	}
+
+	all := append([]*orgodb.OrgEntry{}, entries...)
+	for _, entry := range retained {
+		if !keys[entry.ID()] {
+			all = append(all, entry)
+		}
+	}
+	return all
+}
+
+// dropDeleted removes the entries retained for the deletions of a held plan.
+func (w *Work) dropDeleted(plan *Plan) error {
+	deleted := make(map[string]bool)
+	for _, change := range plan.Changes {
+		if change.Action == ActionDelete && change.Entry != nil {
+			deleted[change.Entry.ID()] = true
+		}
+	}
+
+	stored, err := w.db.GetFileEntries(plan.UserID, plan.FileID)
+	if err != nil {
+		return err
+	}
+
+	var entries []*orgodb.OrgEntry
+	for _, entry := range stored {
+		if !deleted[entry.ID()] {
+			entries = append(entries, entry)
+		}
+	}
+
+	if len(entries) == len(stored) {
+		return nil
+	}
+	return w.db.ReplaceFileEntries(plan.UserID, plan.FileID, entries)
+}
+
+// syncPlan applies the creates, updates and completions of a plan
+// by syncing the entries of each tasklist.
+func (w *Work) syncPlan(ctx context.Context, service *tasks.Service, plan *Plan) error {
+	var (
+		titles []string
+		lists  = make(map[string][]*orgodb.OrgEntry)
+	)
+
+	prefs, err := w.preferences(plan.UserID)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range plan.Entries {
+		if _, ok := lists[entry.Tasklist]; !ok {
+			titles = append(titles, entry.Tasklist)
+		}
+		lists[entry.Tasklist] = append(lists[entry.Tasklist], entry)
+	}
+
+	for _, title := range titles {
+		tl, err := w.getTasklist(ctx, service, plan.UserID, title)
+		if err != nil {
+			return err
+		}
+
+		if err := syncTasks(ctx, service, tl.Id, lists[title], prefs); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isNotFound reports whether a google api error is for a missing resource.
+func isNotFound(err error) bool {
+	apiErr, ok := err.(*googleapi.Error)
+	return ok && (apiErr.Code == 404 || apiErr.Code == 410)
+}
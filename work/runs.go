@@ -0,0 +1,159 @@
+package work
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	orgodb "github.com/rsampaio/orgo/db"
+	"github.com/rsampaio/orgo/org"
+	"golang.org/x/oauth2"
+	"google.golang.org/api/googleapi"
+)
+
+// runRetention is how long sync runs are kept
+const runRetention = 30 * 24 * time.Hour
+
+// FileError is an error about a file, Line is set when it points to a line of the file.
+type FileError struct {
+	File string
+	Line int
+	Err  error
+}
+
+func (e *FileError) Error() string {
+	if e.Line > 0 {
+		return fmt.Sprintf("%s:%d: %s", e.File, e.Line, e.Err.Error())
+	}
+	return fmt.Sprintf("%s: %s", e.File, e.Err.Error())
+}
+
+// Unwrap returns the error about the file.
+func (e *FileError) Unwrap() error {
+	return e.Err
+}
+
+// AuthError is an error authorizing with a provider, the account must be connected again.
+type AuthError struct {
+	Provider string
+	Err      error
+}
+
+func (e *AuthError) Error() string {
+	return fmt.Sprintf("%s authorization: %s", e.Provider, e.Err.Error())
+}
+
+// Unwrap returns the authorization error.
+func (e *AuthError) Unwrap() error {
+	return e.Err
+}
+
+// PermanentError is an error a retry can not fix, a job failing with it
+// refers to something that no longer exists or has a payload that can not be decoded.
+type PermanentError struct {
+	Err error
+}
+
+func (e *PermanentError) Error() string {
+	return e.Err.Error()
+}
+
+// Unwrap returns the permanent error.
+func (e *PermanentError) Unwrap() error {
+	return e.Err
+}
+
+// authError returns an AuthError for a missing account or token of a provider,
+// other errors reading them are returned unchanged and retried.
+func authError(provider string, err error) error {
+	if orgodb.NotFound(err) {
+		return &AuthError{Provider: provider, Err: err}
+	}
+	return err
+}
+
+// classify returns the class of an error, only transient errors are worth a retry.
+func classify(err error) string {
+	var (
+		authErr  *AuthError
+		permErr  *PermanentError
+		apiErr   *googleapi.Error
+		tokenErr *oauth2.RetrieveError
+		diag     org.Diagnostic
+	)
+
+	switch {
+	case errors.As(err, &authErr), errors.As(err, &tokenErr):
+		return orgodb.ErrorAuth
+	case errors.As(err, &permErr):
+		return orgodb.ErrorInternal
+	case errors.As(err, &apiErr) && (apiErr.Code == 401 || apiErr.Code == 403):
+		return orgodb.ErrorAuth
+	case errors.As(err, &diag):
+		return orgodb.ErrorParse
+	}
+
+	// The dropbox client reports token errors only in the message
+	if strings.Contains(err.Error(), "invalid_access_token") || strings.Contains(err.Error(), "expired_access_token") {
+		return orgodb.ErrorAuth
+	}
+	return orgodb.ErrorTransient
+}
+
+// syncError converts an error to the error recorded in a sync run.
+func syncError(err error) orgodb.SyncError {
+	e := orgodb.SyncError{Class: classify(err), Message: err.Error()}
+
+	var fileErr *FileError
+	if errors.As(err, &fileErr) {
+		e.File, e.Line, e.Message = fileErr.File, fileErr.Line, fileErr.Err.Error()
+	}
+	return e
+}
+
+type runKey struct{}
+
+// withRun returns a context recording into run.
+func withRun(ctx context.Context, run *orgodb.SyncRun) context.Context {
+	return context.WithValue(ctx, runKey{}, run)
+}
+
+// runOf returns the sync run recorded by ctx, work run outside
+// of a job is recorded in a run that is not stored.
+func runOf(ctx context.Context) *orgodb.SyncRun {
+	if run, ok := ctx.Value(runKey{}).(*orgodb.SyncRun); ok {
+		return run
+	}
+	return &orgodb.SyncRun{}
+}
+
+// startRun records the start of a job run.
+func (w *Work) startRun(job *orgodb.Job) *orgodb.SyncRun {
+	run := &orgodb.SyncRun{UserID: job.Account, JobID: job.ID, Kind: job.Kind, Started: time.Now()}
+	if err := w.db.StartRun(run); err != nil {
+		log.Errorf("start run of job %d: %s", job.ID, err.Error())
+	}
+	return run
+}
+
+// finishRun records the end of a job run and the error it failed with.
+func (w *Work) finishRun(run *orgodb.SyncRun, err error) {
+	run.Finished = time.Now()
+	run.Status = orgodb.RunOK
+	if err != nil {
+		e := syncError(err)
+		if e.File == "" {
+			e.File = run.File
+		}
+
+		run.Status = orgodb.RunFailed
+		run.Errors = append(run.Errors, e)
+	}
+
+	if err := w.db.FinishRun(run); err != nil {
+		log.Errorf("finish run of job %d: %s", run.JobID, err.Error())
+	}
+}
@@ -0,0 +1,355 @@
+package work
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	orgodb "github.com/rsampaio/orgo/db"
+	"github.com/rsampaio/orgo/org"
+	tasks "google.golang.org/api/tasks/v1"
+)
+
+// maxNotesLength is the size limit of the notes of a google task.
+const maxNotesLength = 8192
+
+// maxTaskDepth is the nesting supported by google tasks, deeper
+// entries are flattened under their ancestor at this depth.
+const maxTaskDepth = 1
+
+// taskTree keeps the order of the tasks under each parent of a tasklist.
+type taskTree map[string][]string
+
+func newTaskTree(items []*tasks.Task) taskTree {
+	sorted := append([]*tasks.Task{}, items...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Position < sorted[j].Position
+	})
+
+	tree := taskTree{}
+	for _, task := range sorted {
+		tree[task.Parent] = append(tree[task.Parent], task.Id)
+	}
+	return tree
+}
+
+// placed reports whether the task is under parent right after previous,
+// only the tasks in managed are considered so tasks added by hand are left alone.
+func (tt taskTree) placed(id, parent, previous string, managed map[string]bool) bool {
+	var last string
+	for _, child := range tt[parent] {
+		if child == id {
+			return last == previous
+		}
+
+		if managed[child] {
+			last = child
+		}
+	}
+	return false
+}
+
+// move places the task under parent right after previous.
+func (tt taskTree) move(id, parent, previous string) {
+	for p, children := range tt {
+		for i, child := range children {
+			if child == id {
+				tt[p] = append(children[:i:i], children[i+1:]...)
+				break
+			}
+		}
+	}
+
+	children := tt[parent]
+	i := 0
+	for j, child := range children {
+		if child == previous {
+			i = j + 1
+			break
+		}
+	}
+	tt[parent] = append(children[:i:i], append([]string{id}, children[i:]...)...)
+}
+
+// listTasks retrieves every task of a tasklist.
+func listTasks(ctx context.Context, s *tasks.Service, tasklistID string) ([]*tasks.Task, error) {
+	var (
+		items []*tasks.Task
+		call  = tasks.NewTasksService(s).List(tasklistID).MaxResults(100).Context(ctx)
+	)
+
+	for {
+		tl, err := call.Do()
+		if err != nil {
+			return nil, err
+		}
+
+		items = append(items, tl.Items...)
+		if tl.NextPageToken == "" {
+			return items, nil
+		}
+		call.PageToken(tl.NextPageToken)
+	}
+}
+
+// entryTask converts an entry to a google task, entries done for the user are completed.
+// Google tasks only keeps the date of the due time, the date the entry is scheduled
+// in the timezone of the user is sent at midnight UTC so it is not moved to the day
+// before or after.
+func entryTask(entry *orgodb.OrgEntry, prefs preferences) *tasks.Task {
+	task := &tasks.Task{
+		Title:  entry.Title,
+		Notes:  taskNotes(entry),
+		Status: "needsAction",
+	}
+
+	if !entry.Scheduled.IsZero() {
+		year, month, day := entry.Scheduled.In(prefs.loc).Date()
+		task.Due = time.Date(year, month, day, 0, 0, 0, 0, time.UTC).Format(time.RFC3339)
+	}
+
+	if prefs.done(entry) {
+		closed := entry.Closed
+		if closed.IsZero() {
+			closed = time.Now()
+		}
+
+		completed := closed.Format(time.RFC3339)
+		task.Completed = &completed
+		task.Status = "completed"
+	}
+	return task
+}
+
+// taskChanged reports whether the remote task differs from the task of an entry.
+func taskChanged(remote, task *tasks.Task) bool {
+	if remote.Notes != task.Notes || remote.Status != task.Status {
+		return true
+	}
+
+	if remote.Due == "" || task.Due == "" {
+		return remote.Due != task.Due
+	}
+
+	remoteDue, err := time.Parse(time.RFC3339, remote.Due)
+	if err != nil {
+		return true
+	}
+
+	due, err := time.Parse(time.RFC3339, task.Due)
+	if err != nil {
+		return true
+	}
+
+	// google tasks only keeps the date of the due time
+	return remoteDue.UTC().Format("2006-01-02") != due.UTC().Format("2006-01-02")
+}
+
+// findTask returns the remote task created from entry.
+func findTask(remote []*tasks.Task, entry *orgodb.OrgEntry) *tasks.Task {
+	for _, task := range remote {
+		if sameTask(task, entry) {
+			return task
+		}
+	}
+	return nil
+}
+
+// findEntry returns the entry a remote task was created from.
+func findEntry(entries []*orgodb.OrgEntry, task *tasks.Task) *orgodb.OrgEntry {
+	for _, entry := range entries {
+		if sameTask(task, entry) {
+			return entry
+		}
+	}
+	return nil
+}
+
+// syncTasks creates or updates the tasks of entries in a tasklist, subtasks
+// are nested under their parent in the same order as in the file.
+func syncTasks(ctx context.Context, s *tasks.Service, tasklistID string, entries []*orgodb.OrgEntry, prefs preferences) error {
+	t := tasks.NewTasksService(s)
+	remote, err := listTasks(ctx, s, tasklistID)
+	if err != nil {
+		return err
+	}
+
+	var (
+		tree     = newTaskTree(remote)
+		ids      = make(map[string]string)
+		managed  = make(map[string]bool)
+		previous = make(map[string]string)
+	)
+
+	for _, entry := range entries {
+		var (
+			task    = entryTask(entry, prefs)
+			parent  = ids[entry.Parent]
+			current = findTask(remote, entry)
+		)
+
+		if current != nil && managed[current.Id] {
+			// a repeated heading not synced yet matches the task of the first one
+			current = nil
+		}
+
+		if current == nil {
+			insertCall := t.Insert(tasklistID, task).Context(ctx)
+			if parent != "" {
+				insertCall.Parent(parent)
+			}
+			if previous[parent] != "" {
+				insertCall.Previous(previous[parent])
+			}
+
+			e, err := insertCall.Do()
+			if err != nil {
+				return err
+			}
+
+			log.Infof("task added: %v", e.Id)
+			current = e
+			tree.move(e.Id, parent, previous[parent])
+		} else {
+			if taskChanged(current, task) {
+				log.Infof("event already exist: %v, updating", current.Title)
+				current.Notes = task.Notes
+				current.Due = task.Due
+				current.Status = task.Status
+				current.Completed = task.Completed
+				tuCall := t.Update(tasklistID, current.Id, current).Context(ctx)
+				if _, err := tuCall.Do(); err != nil {
+					return err
+				}
+			}
+
+			if !tree.placed(current.Id, parent, previous[parent], managed) {
+				moveCall := t.Move(tasklistID, current.Id).Context(ctx)
+				if parent != "" {
+					moveCall.Parent(parent)
+				}
+				if previous[parent] != "" {
+					moveCall.Previous(previous[parent])
+				}
+
+				if _, err := moveCall.Do(); err != nil {
+					return err
+				}
+
+				log.Infof("task moved: %v", current.Title)
+				tree.move(current.Id, parent, previous[parent])
+			}
+		}
+
+		entry.TaskID = current.Id
+		ids[entry.ID()] = current.Id
+		managed[current.Id] = true
+		previous[parent] = current.Id
+	}
+	return nil
+}
+
+// taskNotes prefixes the entry body rendered as plain text with the file,
+// line and outline it came from:
+// ```
+// /file.org:12
+// Parent / Heading
+//
+// body
+// ```
+func taskNotes(entry *orgodb.OrgEntry) string {
+	notes := fmt.Sprintf("%s:%d\n", entry.File, entry.Line)
+	if entry.Outline != "" {
+		notes += entry.Outline + "\n"
+	}
+
+	body := org.PlainText(strings.Split(entry.Body, "\n"))
+	if body == "" {
+		return strings.TrimSuffix(notes, "\n")
+	}
+	return org.Truncate(notes+"\n"+body, maxNotesLength)
+}
+
+// taskFile returns the file recorded in the notes of a task,
+// tasks created before files were tracked have none.
+func taskFile(task *tasks.Task) string {
+	header := strings.SplitN(task.Notes, "\n", 2)[0]
+	i := strings.LastIndex(header, ":")
+	if !strings.HasPrefix(header, "/") || i < 0 {
+		return ""
+	}
+	return header[:i]
+}
+
+// sameTask reports whether a remote task was created from entry. Entries
+// synced before task ids were stored match by title and the file in the
+// notes of the task, tasks without a file only match entries without one.
+func sameTask(task *tasks.Task, entry *orgodb.OrgEntry) bool {
+	if entry.TaskID != "" {
+		return task.Id == entry.TaskID
+	}
+	return task.Title == entry.Title && taskFile(task) == entry.File
+}
+
+func findTasklist(ctx context.Context, service *tasks.Service, title string) (*tasks.TaskList, error) {
+	ts := tasks.NewTasklistsService(service)
+	call := ts.List().Context(ctx)
+	list, err := call.Do()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, taskList := range list.Items {
+		if taskList.Title == title {
+			return taskList, nil
+		}
+	}
+	return nil, nil
+}
+
+// tasklistFor returns the title of the tasklist an entry is mapped to, tags take
+// precedence over categories which take precedence over files, entries without
+// a mapping are in fallback.
+func tasklistFor(mappings []orgodb.TasklistMapping, entry *orgodb.OrgEntry, fallback string) string {
+	var byCategory, byFile string
+
+	for _, m := range mappings {
+		switch m.Kind {
+		case orgodb.MappingTag:
+			if m.Value != "" && strings.Contains(entry.Tags, ":"+m.Value+":") {
+				return m.Tasklist
+			}
+		case orgodb.MappingCategory:
+			if entry.Category != "" && entry.Category == m.Value {
+				byCategory = m.Tasklist
+			}
+		case orgodb.MappingFile:
+			path := strings.ToLower(m.Value)
+			if entry.File == path || strings.HasPrefix(entry.File, strings.TrimSuffix(path, "/")+"/") {
+				byFile = m.Tasklist
+			}
+		}
+	}
+
+	if byCategory != "" {
+		return byCategory
+	}
+
+	if byFile != "" {
+		return byFile
+	}
+	return fallback
+}
+
+// tasklistOf returns the tasklist an entry was synced to, entries stored
+// before their tasklist was recorded are in the tasklist of the mappings
+// or the fallback tasklist of the user.
+func tasklistOf(mappings []orgodb.TasklistMapping, entry *orgodb.OrgEntry, fallback string) string {
+	if entry.Tasklist == "" {
+		return tasklistFor(mappings, entry, fallback)
+	}
+	return entry.Tasklist
+}
@@ -0,0 +1,74 @@
+package work
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+	orgodb "github.com/rsampaio/orgo/db"
+	"golang.org/x/oauth2"
+)
+
+// errNeedsConsent is returned for accounts whose token could not be refreshed.
+var errNeedsConsent = errors.New("the account must be authorized again")
+
+// savingSource saves the tokens refreshed by a token source, a failed
+// refresh marks the account as needing the user to authorize again.
+type savingSource struct {
+	mu       sync.Mutex
+	base     oauth2.TokenSource
+	db       orgodb.TokenStore
+	provider string
+	account  string
+	refresh  bool
+	last     string
+}
+
+// tokenSource returns a token source refreshing the stored token with config.
+// Long-lived dropbox tokens stored before offline access have no expiry nor
+// refresh token, they are used as they are until dropbox refuses them and the
+// user authorizes again, getting a refresh token.
+func (w *Work) tokenSource(ctx context.Context, config *oauth2.Config, stored orgodb.Token) (oauth2.TokenSource, error) {
+	if stored.NeedsConsent {
+		return nil, &AuthError{Provider: stored.Provider, Err: errNeedsConsent}
+	}
+
+	return &savingSource{
+		base:     config.TokenSource(ctx, stored.OAuth2()),
+		db:       w.db,
+		provider: stored.Provider,
+		account:  stored.Account,
+		refresh:  stored.RefreshToken != "",
+		last:     stored.AccessToken,
+	}, nil
+}
+
+// Token returns a valid token, saving it when it was refreshed.
+func (s *savingSource) Token() (*oauth2.Token, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, err := s.base.Token()
+	if err != nil {
+		// Network errors are retried, the user is only asked to authorize
+		// again when the provider refused the refresh or there is nothing to refresh with
+		var retrieveErr *oauth2.RetrieveError
+		if errors.As(err, &retrieveErr) || !s.refresh {
+			log.Errorf("%s token of %s needs consent: %s", s.provider, s.account, err.Error())
+			if err := s.db.SetNeedsConsent(s.provider, s.account); err != nil {
+				log.Errorf("set needs consent: %s", err.Error())
+			}
+			return nil, &AuthError{Provider: s.provider, Err: err}
+		}
+		return nil, err
+	}
+
+	if t.AccessToken != s.last {
+		if err := s.db.UpdateToken(s.provider, s.account, t); err != nil {
+			return nil, err
+		}
+		s.last = t.AccessToken
+	}
+	return t, nil
+}
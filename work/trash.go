@@ -0,0 +1,119 @@
+package work
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	orgodb "github.com/rsampaio/orgo/db"
+	tasks "google.golang.org/api/tasks/v1"
+)
+
+// trashData is what a trash entry keeps to restore a deleted task.
+type trashData struct {
+	Task  *tasks.Task      `json:"task"`
+	Entry *orgodb.OrgEntry `json:"entry,omitempty"`
+}
+
+// trash keeps the task removed by a delete change so it can be restored.
+func (w *Work) trash(userID string, change Change) error {
+	if change.Task == nil {
+		return nil
+	}
+
+	data, err := json.Marshal(trashData{Task: change.Task, Entry: change.Entry})
+	if err != nil {
+		return err
+	}
+
+	return w.db.SaveTrash(orgodb.TrashEntry{
+		UserID:   userID,
+		Tasklist: change.Tasklist,
+		Title:    change.Title,
+		File:     change.File,
+		Deleted:  time.Now(),
+		Data:     string(data),
+	})
+}
+
+// RestoreTrash recreates a deleted task in its tasklist and the entry it was synced from.
+func (w *Work) RestoreTrash(ctx context.Context, id int64) error {
+	trashed, err := w.db.GetTrashEntry(id)
+	if err != nil {
+		return err
+	}
+
+	var data trashData
+	if err := json.Unmarshal([]byte(trashed.Data), &data); err != nil {
+		return err
+	}
+
+	if data.Task == nil {
+		return fmt.Errorf("trash entry %d has no task", id)
+	}
+
+	service, err := w.tasksService(ctx, trashed.UserID)
+	if err != nil {
+		return err
+	}
+
+	tl, err := w.getTasklist(ctx, service, trashed.UserID, trashed.Tasklist)
+	if err != nil {
+		return err
+	}
+
+	remote, err := listTasks(ctx, service, tl.Id)
+	if err != nil {
+		return err
+	}
+
+	// The task is not inserted twice, a retried restore or an entry added
+	// back to its file and synced again already has one
+	if existing := restoredTask(remote, &data); existing != nil {
+		log.Infof("task already restored: %s", existing.Title)
+		return w.db.DeleteTrash(id)
+	}
+
+	task := *data.Task
+	task.Id = ""
+	task.Parent = ""
+	task.Position = ""
+	task.Etag = ""
+	task.SelfLink = ""
+	restored, err := tasks.NewTasksService(service).Insert(tl.Id, &task).Context(ctx).Do()
+	if err != nil {
+		return err
+	}
+
+	// The entry is stored again with the new task so other syncs keep it, it
+	// fails when the entry was added back to its file in the meantime.
+	if data.Entry != nil {
+		data.Entry.TaskID = restored.Id
+		if err := w.db.SaveEntry(data.Entry); err != nil {
+			log.Infof("restore entry %s: %s", data.Entry.Title, err.Error())
+		}
+	}
+
+	log.Infof("task restored: %s", trashed.Title)
+	return w.db.DeleteTrash(id)
+}
+
+// restoredTask returns the remote task a trashed task already exists as, the
+// task it was deleted as or a task created again for the entry it was synced from.
+func restoredTask(remote []*tasks.Task, data *trashData) *tasks.Task {
+	entry := data.Entry
+	if entry == nil {
+		entry = &orgodb.OrgEntry{Title: data.Task.Title, File: taskFile(data.Task)}
+	}
+
+	again := *entry
+	again.TaskID = ""
+	for _, task := range remote {
+		if task.Id == data.Task.Id || sameTask(task, entry) || sameTask(task, &again) {
+			return task
+		}
+	}
+	return nil
+}
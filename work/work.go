@@ -1,12 +1,18 @@
 package work
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
 	orgodb "github.com/rsampaio/orgo/db"
+	"github.com/rsampaio/orgo/org"
 	tasks "google.golang.org/api/tasks/v1"
 
 	"github.com/dropbox/dropbox-sdk-go-unofficial/dropbox"
@@ -14,274 +20,852 @@ import (
 	"golang.org/x/oauth2"
 )
 
-var location *time.Location
+// FileEntries are the entries parsed from a file, no entries
+// means the file was emptied or removed.
+type FileEntries struct {
+	UserID  string
+	FileID  string
+	Entries []*orgodb.OrgEntry
+}
 
 // Work struct
 type Work struct {
-	// WorkChan receives strings to be parsed
-	WorkChan chan string
-	// ErrChan receives errors and abort operations
-	ErrChan chan error
-	// CalendarChan receives entries to syncn with google calendar if necessary
-	CalendarChan chan []*orgodb.OrgEntry
-
 	GoogleOauth  *oauth2.Config
 	DropboxOauth *oauth2.Config
 
-	db *orgodb.DB
+	// DeleteThreshold is the share of the stored entries a sync can delete before it is held
+	DeleteThreshold float64
+	// DeleteMinimum is the number of deletions that are never held
+	DeleteMinimum int
+	// TrashRetention is how long deleted tasks can be restored
+	TrashRetention time.Duration
+
+	// Lease is how long a job runs before another worker can take it, running jobs extend it
+	Lease time.Duration
+	// MaxAttempts is the number of runs of a job before it fails for good
+	MaxAttempts int
+	// PollInterval is how often an empty queue is checked
+	PollInterval time.Duration
+	// Workers is the number of jobs run at the same time
+	Workers int
+
+	inFlight int64
+	db       orgodb.Store
+
+	// quit stops the workers, jobs is the context of the running jobs
+	quit       chan struct{}
+	stop       sync.Once
+	done       chan struct{}
+	jobs       context.Context
+	cancelJobs context.CancelFunc
+	workers    sync.WaitGroup
 }
 
-// NewWorker creates a Work instance
-func NewWorker(googleOauth, dropboxOauth *oauth2.Config) *Work {
+// Stats are the counters of the worker pool, Queued and Failed count the jobs in the database.
+type Stats struct {
+	Workers  int   `json:"workers"`
+	InFlight int64 `json:"in_flight"`
+	Queued   int   `json:"queued"`
+	Failed   int   `json:"failed"`
+}
+
+// NewWorker creates a Work instance running the jobs queued in store
+func NewWorker(googleOauth, dropboxOauth *oauth2.Config, store orgodb.Store) *Work {
+	jobs, cancelJobs := context.WithCancel(context.Background())
 	return &Work{
-		db:           orgodb.NewDB("orgo.db"),
-		WorkChan:     make(chan string, 100),
-		CalendarChan: make(chan []*orgodb.OrgEntry),
-		ErrChan:      make(chan error),
+		db:           store,
 		GoogleOauth:  googleOauth,
 		DropboxOauth: dropboxOauth,
+
+		DeleteThreshold: 0.5,
+		DeleteMinimum:   3,
+		TrashRetention:  30 * 24 * time.Hour,
+
+		Lease:        time.Minute,
+		MaxAttempts:  8,
+		PollInterval: time.Second,
+		Workers:      4,
+
+		quit:       make(chan struct{}),
+		done:       make(chan struct{}),
+		jobs:       jobs,
+		cancelJobs: cancelJobs,
 	}
 }
 
+// dropboxFiles returns the files client of the dropbox account authorized with token.
+var dropboxFiles = func(token string) files.Client {
+	return files.New(dropbox.Config{Token: token})
+}
+
 // Process org file from dropbox account
 // this should generate entries and update
 // the local database to reflect the file in dropbox
-func (w *Work) Process(accountID string) {
-	location, _ = time.LoadLocation("America/Los_Angeles")
+func (w *Work) Process(ctx context.Context, accountID string) error {
 	t, err := w.db.GetToken("dropbox", accountID)
 	if err != nil {
-		log.Error(err.Error())
-		return
+		return authError("dropbox", err)
 	}
 
-	log.Infof("processing=%s", accountID)
+	source, err := w.tokenSource(ctx, w.DropboxOauth, t)
+	if err != nil {
+		return err
+	}
 
-	dbxCfg := dropbox.Config{Token: string(t.AccessToken)}
-	dbx := files.New(dbxCfg)
+	token, err := source.Token()
+	if err != nil {
+		return err
+	}
 
-	listFolderArg := files.NewListFolderArg("")
-	folderRes, err := dbx.ListFolder(listFolderArg)
+	userID, err := w.db.GetAccountUser("dropbox", accountID)
 	if err != nil {
-		log.Error(err.Error())
-		w.ErrChan <- err
+		return err
 	}
 
-	for _, entry := range folderRes.Entries {
-		_, reader, err := dbx.Download(&files.DownloadArg{Path: entry.(*files.FileMetadata).Metadata.PathLower})
+	prefs, err := w.preferences(userID)
+	if err != nil {
+		return err
+	}
+
+	log.Infof("processing=%s", accountID)
+	run := runOf(ctx)
+	run.Account = accountID
+
+	dbx := dropboxFiles(token.AccessToken)
+
+	var (
+		deleted []*files.DeletedMetadata
+		failed  []error
+		seen    = make(map[string]bool)
+	)
+
+	// Continue from the last cursor to receive deletions, fallback
+	// to a full listing when there is no cursor or it was reset.
+	cursor, _ := w.db.GetCursor(accountID)
+	full := cursor == ""
+
+	var folderRes *files.ListFolderResult
+	if !full {
+		folderRes, err = dbx.ListFolderContinue(files.NewListFolderContinueArg(cursor))
 		if err != nil {
-			log.Error(err.Error())
-			w.ErrChan <- err
+			log.Errorf("list folder continue %s, listing all files", err.Error())
+			full = true
 		}
+	}
 
-		content, err := ioutil.ReadAll(reader)
+	if full {
+		listFolderArg := files.NewListFolderArg("")
+		listFolderArg.Recursive = true
+		folderRes, err = dbx.ListFolder(listFolderArg)
 		if err != nil {
-			w.ErrChan <- err
+			return w.dropboxError(accountID, err)
 		}
-
-		w.CalendarChan <- w.ParseEntries(content, accountID)
 	}
-}
 
-// ParseEntries parses OrgEntry from content
-func (w *Work) ParseEntries(content []byte, accountID string) []*orgodb.OrgEntry {
-	var (
-		entries  []*orgodb.OrgEntry
-		entry    *orgodb.OrgEntry
-		tag      string
-		priority string
-	)
+	for {
+		for _, entry := range folderRes.Entries {
+			switch metadata := entry.(type) {
+			case *files.FileMetadata:
+				// The dropbox client does not take a context, a cancelled run stops between files
+				if err := ctx.Err(); err != nil {
+					return err
+				}
+
+				// Files outside the folders of the user and files that are not org files are skipped
+				if !isOrgFile(metadata.PathLower) || !prefs.InFolders(metadata.PathLower) {
+					continue
+				}
+
+				// A file that fails does not stop the others, the run is retried
+				seen[metadata.Id] = true
+				run.Files++
+				if err := w.processFile(ctx, dbx, accountID, userID, prefs, metadata); err != nil {
+					failed = append(failed, &FileError{File: metadata.PathLower, Err: err})
+				}
+			case *files.DeletedMetadata:
+				deleted = append(deleted, metadata)
+			}
+		}
+
+		if !folderRes.HasMore {
+			break
+		}
+
+		folderRes, err = dbx.ListFolderContinue(files.NewListFolderContinueArg(folderRes.Cursor))
+		if err != nil {
+			return w.dropboxError(accountID, err)
+		}
+	}
 
-	googleID, err := w.db.GetGoogleID(accountID)
+	// Deletions are handled after every file was seen so a rename,
+	// reported as a deletion plus a new file with the same id, keeps its entries.
+	// Files no longer in the folders of the user, or no longer org files, are removed as well.
+	known, err := w.db.GetFiles(accountID)
 	if err != nil {
-		log.Error(err.Error())
-		return entries
+		return err
 	}
 
-	for _, line := range strings.Split(string(content), "\n") {
-		if strings.HasPrefix(line, "** ") {
-			// parse tag
-			p := strings.Split(line, " ")
-			if p[1] == "TODO" || p[1] == "DONE" {
-				tag = p[1]
+	for _, file := range known {
+		if (full && !seen[file.FileID]) || !isOrgFile(file.Path) || !prefs.InFolders(file.Path) {
+			if err := w.removeFile(accountID, file); err != nil {
+				return err
 			}
+			continue
+		}
 
-			if strings.HasPrefix(p[2], "[") {
-				priority = p[2]
+		for _, metadata := range deleted {
+			if file.Path == metadata.PathLower || strings.HasPrefix(file.Path, metadata.PathLower+"/") {
+				if err := w.removeFile(accountID, file); err != nil {
+					return err
+				}
+				break
 			}
+		}
+	}
 
-			entry = &orgodb.OrgEntry{UserID: googleID, Title: line, Tag: tag, Priority: priority}
-		} else if strings.HasPrefix(line, "   [") {
-			entry.Date, _ = time.ParseInLocation("   [2006-01-02 Mon]", line, location)
-			entries = append(entries, []*orgodb.OrgEntry{entry}...)
-		} else if strings.HasPrefix(line, "   SCHEDULED: ") {
-			entry.Scheduled, _ = time.ParseInLocation("   SCHEDULED: <2006-01-02 Mon>", line, location)
-		} else if strings.HasPrefix(line, "   CLOSED: ") {
-			fields := strings.Split(line, "]")
-			if len(fields) > 1 {
-				entry.Closed, _ = time.ParseInLocation("   CLOSED: [2006-01-02 Mon 15:04", fields[0], location)
-				entry.Scheduled, _ = time.ParseInLocation(" SCHEDULED: <2006-01-02 Mon>", fields[1], location)
-			}
-		} else if strings.HasPrefix(line, "* Tasks") {
-			continue // TODO: Ignore first line?
-		} else {
-			entry.Body = entry.Body + line
+	// The cursor is only saved once every change was queued, a failed
+	// run is retried from the previous cursor. The first failure is
+	// returned and the others are recorded in the run.
+	if len(failed) > 0 {
+		for _, err := range failed[1:] {
+			run.Errors = append(run.Errors, syncError(err))
 		}
+		return failed[0]
 	}
-	return entries
+	return w.db.SaveCursor(accountID, folderRes.Cursor)
 }
 
-// Calendar syncs entries with google calendar
-func (w *Work) Calendar(entries []*orgodb.OrgEntry) {
+// dropboxError marks the account as needing consent when dropbox refused its token.
+func (w *Work) dropboxError(accountID string, err error) error {
+	if classify(err) != orgodb.ErrorAuth {
+		return err
+	}
 
-	t, err := w.db.GetToken("google", entries[0].UserID)
+	if err := w.db.SetNeedsConsent("dropbox", accountID); err != nil {
+		log.Errorf("set needs consent: %s", err.Error())
+	}
+	return &AuthError{Provider: "dropbox", Err: err}
+}
+
+// isOrgFile reports whether a dropbox path is an org file, only those are downloaded.
+func isOrgFile(path string) bool {
+	return strings.HasSuffix(strings.ToLower(path), ".org")
+}
+
+// processFile downloads and parses a single file of an user, tracking its path by id.
+func (w *Work) processFile(ctx context.Context, dbx files.Client, accountID, userID string, prefs preferences, metadata *files.FileMetadata) error {
+	file, err := w.db.GetFile(accountID, metadata.Id)
+	if err == nil && file.Path != metadata.PathLower {
+		log.Infof("file renamed: %s -> %s", file.Path, metadata.PathLower)
+	}
+
+	err = w.db.SaveFile(orgodb.DropboxFile{Account: accountID, FileID: metadata.Id, Path: metadata.PathLower})
 	if err != nil {
-		w.ErrChan <- err
+		return err
 	}
 
-	client := w.GoogleOauth.Client(oauth2.NoContext, &oauth2.Token{
-		AccessToken:  t.AccessToken,
-		RefreshToken: t.RefreshToken,
-		Expiry:       t.Expiry,
-	})
-	service, err := tasks.New(client)
+	_, reader, err := dbx.Download(&files.DownloadArg{Path: metadata.PathLower})
 	if err != nil {
-		w.ErrChan <- err
-		return
+		return err
 	}
+	defer reader.Close()
 
-	taskService, err := getTasklist(service)
+	content, err := ioutil.ReadAll(reader)
 	if err != nil {
-		w.ErrChan <- err
-		return
+		return err
+	}
+
+	entries, diagnostics := w.ParseEntries(content, userID, prefs.loc, prefs.DoneKeywords)
+	if err := w.saveDiagnostics(userID, metadata, diagnostics); err != nil {
+		return err
+	}
+
+	// The errors found parsing the file are recorded in the run, the
+	// entries parsed around them are synced anyway
+	run := runOf(ctx)
+	for _, d := range diagnostics {
+		if d.Severity == org.SeverityError {
+			run.Errors = append(run.Errors, syncError(&FileError{File: metadata.PathLower, Line: d.Line, Err: d}))
+		}
+	}
+
+	if len(entries) == 0 {
+		return w.retireEntries(accountID, metadata.Id)
 	}
 
 	for _, entry := range entries {
-		err := w.db.SaveOrUpdate(entry)
-		if err != nil {
-			w.ErrChan <- err
+		entry.FileID = metadata.Id
+		entry.File = metadata.PathLower
+	}
+
+	_, err = w.db.EnqueueJob(orgodb.JobSync, userID, metadata.Id, FileEntries{UserID: userID, FileID: metadata.Id, Entries: entries})
+	return err
+}
+
+// saveDiagnostics stores the problems found parsing a file so the user can fix them.
+func (w *Work) saveDiagnostics(userID string, metadata *files.FileMetadata, diagnostics []org.Diagnostic) error {
+	var stored []orgodb.Diagnostic
+	for _, d := range diagnostics {
+		log.Infof("%s:%s", metadata.PathLower, d)
+		stored = append(stored, orgodb.Diagnostic{
+			UserID:   userID,
+			FileID:   metadata.Id,
+			File:     metadata.PathLower,
+			Line:     d.Line,
+			Column:   d.Column,
+			Severity: d.Severity,
+			Message:  d.Message,
+		})
+	}
+	return w.db.ReplaceDiagnostics(userID, metadata.Id, stored)
+}
+
+// removeFile retires the entries of a file deleted from dropbox and forgets it.
+func (w *Work) removeFile(accountID string, file orgodb.DropboxFile) error {
+	log.Infof("file removed: %s", file.Path)
+	if err := w.retireEntries(accountID, file.FileID); err != nil {
+		return err
+	}
+
+	userID, err := w.db.GetAccountUser("dropbox", accountID)
+	if err != nil {
+		return err
+	}
+
+	if err := w.db.ReplaceDiagnostics(userID, file.FileID, nil); err != nil {
+		return err
+	}
+	return w.db.DeleteFile(accountID, file.FileID)
+}
+
+// retireEntries syncs a file without entries so its stored
+// entries are removed from google tasks.
+func (w *Work) retireEntries(accountID, fileID string) error {
+	userID, err := w.db.GetAccountUser("dropbox", accountID)
+	if err != nil {
+		return err
+	}
+
+	entries, err := w.db.GetFileEntries(userID, fileID)
+	if err != nil {
+		return err
+	}
+
+	if len(entries) == 0 {
+		return nil
+	}
+
+	_, err = w.db.EnqueueJob(orgodb.JobSync, userID, fileID, FileEntries{UserID: userID, FileID: fileID})
+	return err
+}
+
+// preferences are the settings of an user with the timezone their files are read in.
+type preferences struct {
+	orgodb.Settings
+	loc *time.Location
+}
+
+// preferences returns the settings of an user, the timezone is UTC when the user has none.
+func (w *Work) preferences(userID string) (preferences, error) {
+	settings, err := w.db.GetSettings(userID)
+	if err != nil {
+		return preferences{}, err
+	}
+
+	prefs := preferences{Settings: settings, loc: time.UTC}
+	if settings.Timezone == "" {
+		return prefs, nil
+	}
+
+	if prefs.loc, err = time.LoadLocation(settings.Timezone); err != nil {
+		log.Errorf("timezone of %s: %s", userID, err.Error())
+		prefs.loc = time.UTC
+	}
+	return prefs, nil
+}
+
+// done reports whether an entry is completed, closed entries and
+// entries with one of the done keywords of the user are.
+func (p preferences) done(entry *orgodb.OrgEntry) bool {
+	if !entry.Closed.IsZero() {
+		return true
+	}
+
+	for _, keyword := range p.DoneKeywords {
+		if entry.Tag == keyword {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseEntries parses OrgEntry of an user from content with the problems
+// found in it, timestamps are read in loc and keywords start tasks besides
+// the default org keywords.
+func (w *Work) ParseEntries(content []byte, userID string, loc *time.Location, keywords []string) ([]*orgodb.OrgEntry, []org.Diagnostic) {
+	var (
+		entries []*orgodb.OrgEntry
+		keys    = make(map[*org.Heading]string)
+		seen    = make(map[string]int)
+	)
+
+	doc := org.Parse(content, loc, keywords...)
+	doc.Walk(func(h *org.Heading) {
+		if !isEntry(h) {
+			return
 		}
 
-		var completed *string
-		closed := entry.Closed.Format(time.RFC3339)
-		completed = &closed
-		task := &tasks.Task{
-			Title:     entry.Title,
-			Due:       entry.Scheduled.Format(time.RFC3339),
-			Completed: completed,
-			Notes:     entry.Body,
+		// headings repeated in the file are numbered in the order they appear
+		seen[h.Raw]++
+		keys[h] = h.Raw
+		if n := seen[h.Raw]; n > 1 {
+			keys[h] = fmt.Sprintf("%s #%d", h.Raw, n)
 		}
 
-		if completed != nil {
-			task.Status = "completed"
+		var parent string
+		if p := entryParent(h); p != nil {
+			parent = keys[p]
 		}
 
-		err = addTask(service, taskService.Id, task)
-		if err != nil {
-			w.ErrChan <- err
-			return
+		entries = append(entries, &orgodb.OrgEntry{
+			UserID:    userID,
+			Title:     h.Raw,
+			Key:       keys[h],
+			Parent:    parent,
+			Outline:   strings.Join(h.Outline(), " / "),
+			Line:      h.Line,
+			Tag:       h.Keyword,
+			Tags:      tagString(h.AllTags()),
+			Category:  h.Category,
+			Priority:  h.Priority,
+			Body:      strings.Join(h.Body, "\n"),
+			Date:      h.Date,
+			Scheduled: h.Scheduled,
+			Closed:    h.Closed,
+		})
+	})
+	return entries, doc.Diagnostics
+}
+
+// isEntry reports whether a heading becomes an entry, only tasks and dated headings do.
+func isEntry(h *org.Heading) bool {
+	return h.Keyword != "" || !h.Date.IsZero() || !h.Scheduled.IsZero() || !h.Closed.IsZero()
+}
+
+// entryParent returns the ancestor entry a heading is nested under, nil for top level entries,
+// headings nested deeper than maxTaskDepth are flattened under the ancestor at that depth.
+func entryParent(h *org.Heading) *org.Heading {
+	var ancestors []*org.Heading
+	for p := h.Parent; p != nil; p = p.Parent {
+		if isEntry(p) {
+			ancestors = append([]*org.Heading{p}, ancestors...)
 		}
 	}
 
-	deleteTasks(service, taskService.Id, entries)
+	if len(ancestors) == 0 {
+		return nil
+	}
+
+	if len(ancestors) > maxTaskDepth {
+		return ancestors[maxTaskDepth-1]
+	}
+	return ancestors[len(ancestors)-1]
+}
+
+// tagString formats tags as stored in entries: `:tag1:tag2:`
+func tagString(tags []string) string {
+	if len(tags) == 0 {
+		return ""
+	}
+	return ":" + strings.Join(tags, ":") + ":"
 }
 
-func deleteTasks(s *tasks.Service, tasklistID string, taskList []*orgodb.OrgEntry) error {
-	t := tasks.NewTasksService(s)
-	tlCall := t.List(tasklistID)
-	tl, err := tlCall.Do()
+// Sync plans the changes for the entries parsed from a file and applies them,
+// when the user reviews changes the plan is stored until it is confirmed.
+// Deletions held by the deletion policy are stored for review and the rest
+// of the plan is applied.
+func (w *Work) Sync(ctx context.Context, file FileEntries) error {
+	service, err := w.tasksService(ctx, file.UserID)
 	if err != nil {
 		return err
 	}
 
-loop:
-	for _, tt := range tl.Items {
-		var del bool
-		for _, ta := range taskList {
-			if tt.Title == ta.Title {
-				continue loop
-			}
-			del = true
+	plan, err := w.PlanFile(ctx, service, file.UserID, file.FileID, file.Entries)
+	if err != nil {
+		return err
+	}
+	runOf(ctx).File = plan.File
+
+	prefs, err := w.preferences(file.UserID)
+	if err != nil {
+		return err
+	}
+
+	stored, err := w.db.GetEntries(file.UserID)
+	if err != nil {
+		return err
+	}
+
+	if prefs.AlwaysPreview && len(plan.Changes) > 0 {
+		if held := w.guard(plan, len(stored), prefs.Deletion); held != nil {
+			plan.Changes = append(plan.Changes, held.Changes...)
+			plan.Held, plan.HeldReason = true, held.HeldReason
 		}
 
-		if del {
-			log.Infof("deleting task: %v", tt.Title)
-			delCall := t.Delete(tasklistID, tt.Id)
-			err := delCall.Do()
-			if err != nil {
-				return err
+		id, err := w.savePlan(plan)
+		if err != nil {
+			return err
+		}
+
+		log.Infof("plan %d for %s waiting for review: %d changes", id, plan.File, len(plan.Changes))
+		return nil
+	}
+
+	if held := w.guard(plan, len(stored), prefs.Deletion); held != nil {
+		for _, change := range held.Changes {
+			if change.Entry != nil {
+				plan.Retained = append(plan.Retained, change.Entry)
 			}
 		}
+
+		id, err := w.savePlan(held)
+		if err != nil {
+			return err
+		}
+
+		log.Warnf("plan %d for %s held: %s", id, held.File, held.HeldReason)
+	} else if err := w.db.DiscardPendingPlans(file.UserID, file.FileID); err != nil {
+		return err
 	}
-	return nil
+
+	return w.applyPlan(ctx, service, plan)
 }
 
-func addTask(s *tasks.Service, tasklistID string, entry *tasks.Task) error {
-	t := tasks.NewTasksService(s)
-	tlCall := t.List(tasklistID)
-	tl, err := tlCall.Do()
+// collectTasklists deletes the empty tasklists created by orgo that no entry is mapped to,
+// the default tasklist of the user is kept
+func (w *Work) collectTasklists(ctx context.Context, service *tasks.Service, userID string, stored []*orgodb.OrgEntry) error {
+	managed, err := w.db.GetTasklists(userID)
 	if err != nil {
 		return err
 	}
 
-	for _, ta := range tl.Items {
-		if ta.Title == entry.Title {
-			log.Infof("event already exist: %v, updating", ta.Title)
-			ta.Notes = entry.Notes
-			ta.Due = entry.Due
-			tuCall := t.Update(tasklistID, ta.Id, ta)
-			if _, err := tuCall.Do(); err != nil {
-				return err
-			}
-			return nil
-		}
+	prefs, err := w.preferences(userID)
+	if err != nil {
+		return err
 	}
 
-	tiCall := t.Insert(tasklistID, entry)
-	e, err := tiCall.Do()
+	mappings, err := w.db.GetMappings(userID)
 	if err != nil {
 		return err
 	}
 
-	log.Infof("task added: %v", e.Id)
+	used := make(map[string]bool)
+	for _, entry := range stored {
+		used[tasklistOf(mappings, entry, prefs.Tasklist)] = true
+	}
+
+	for _, list := range managed {
+		if list.Title == prefs.Tasklist || used[list.Title] {
+			continue
+		}
+
+		tl, err := tasks.NewTasksService(service).List(list.ListID).Context(ctx).Do()
+		if err != nil {
+			log.Errorf("list tasks of %s: %s", list.Title, err.Error())
+			continue
+		}
+
+		if len(tl.Items) > 0 {
+			continue
+		}
+
+		log.Infof("deleting empty tasklist: %s", list.Title)
+		if err := tasks.NewTasklistsService(service).Delete(list.ListID).Context(ctx).Do(); err != nil {
+			log.Errorf("delete tasklist %s: %s", list.Title, err.Error())
+			continue
+		}
+
+		if err := w.db.DeleteTasklist(userID, list.ListID); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
-func getTasklist(service *tasks.Service) (*tasks.TaskList, error) {
-	ts := tasks.NewTasklistsService(service)
-	call := ts.List()
-	list, err := call.Do()
+// getTasklist finds a tasklist by title, creating it when missing
+func (w *Work) getTasklist(ctx context.Context, service *tasks.Service, userID, title string) (*tasks.TaskList, error) {
+	tl, err := findTasklist(ctx, service, title)
+	if err != nil || tl != nil {
+		return tl, err
+	}
+
+	tl, err = tasks.NewTasklistsService(service).Insert(&tasks.TaskList{Title: title}).Context(ctx).Do()
 	if err != nil {
 		return nil, err
 	}
-	var tl *tasks.TaskList
-	for _, taskList := range list.Items {
-		if taskList.Title == "orgo" {
-			tl = taskList
-			break
+
+	log.Infof("tasklist added: %s", title)
+	return tl, w.db.SaveTasklist(orgodb.Tasklist{UserID: userID, Title: title, ListID: tl.Id})
+}
+
+// tasksService returns a google tasks service authorized for the user
+func (w *Work) tasksService(ctx context.Context, userID string) (*tasks.Service, error) {
+	googleID, err := w.db.GetAccountID(userID, "google")
+	if err != nil {
+		return nil, authError("google", err)
+	}
+
+	t, err := w.db.GetToken("google", googleID)
+	if err != nil {
+		return nil, authError("google", err)
+	}
+
+	source, err := w.tokenSource(ctx, w.GoogleOauth, t)
+	if err != nil {
+		return nil, err
+	}
+	return tasks.New(oauth2.NewClient(ctx, source))
+}
+
+// WaitWork starts the workers running the jobs of the queue until Shutdown
+// is called, the trash and finished jobs are purged every hour
+func (w *Work) WaitWork() {
+	defer close(w.done)
+
+	for i := 0; i < w.Workers; i++ {
+		w.workers.Add(1)
+		go w.runWorker()
+	}
+
+	purge := time.NewTicker(time.Hour)
+	defer purge.Stop()
+
+	for {
+		select {
+		case <-w.quit:
+			w.workers.Wait()
+			return
+		case <-purge.C:
+			w.purge()
 		}
 	}
+}
+
+// Shutdown stops leasing jobs and waits for the running jobs to finish,
+// when ctx is done first the running jobs are cancelled and queued again.
+func (w *Work) Shutdown(ctx context.Context) error {
+	w.stop.Do(func() { close(w.quit) })
+
+	select {
+	case <-w.done:
+		return nil
+	case <-ctx.Done():
+		w.cancelJobs()
+		<-w.done
+		return ctx.Err()
+	}
+}
+
+// runWorker runs the jobs due one at a time, polling the queue when no job can run.
+func (w *Work) runWorker() {
+	defer w.workers.Done()
+
+	for {
+		select {
+		case <-w.quit:
+			return
+		default:
+		}
 
-	if tl == nil {
-		insertcall := ts.Insert(&tasks.TaskList{Title: "orgo"})
-		tl, err = insertcall.Do()
+		job, err := w.db.LeaseJob(w.Lease)
 		if err != nil {
-			return nil, err
+			log.Errorf("lease job: %s", err.Error())
 		}
+
+		if job == nil {
+			select {
+			case <-w.quit:
+				return
+			case <-time.After(w.PollInterval):
+			}
+			continue
+		}
+
+		w.runJob(job)
 	}
+}
 
-	return tl, nil
+// Stats returns the counters of the worker pool.
+func (w *Work) Stats() Stats {
+	stats := Stats{Workers: w.Workers, InFlight: atomic.LoadInt64(&w.inFlight)}
+
+	var err error
+	if stats.Queued, err = w.db.CountJobs(orgodb.JobPending); err != nil {
+		log.Errorf("count jobs: %s", err.Error())
+	}
+
+	if stats.Failed, err = w.db.CountJobs(orgodb.JobFailed); err != nil {
+		log.Errorf("count jobs: %s", err.Error())
+	}
+	return stats
 }
 
-// WaitWork waits for work on worker channels
-func (w *Work) WaitWork() {
+// runJob runs a leased job extending its lease until it finishes,
+// failed jobs are retried with exponential backoff up to MaxAttempts.
+// A job whose lease expired is taken again, counting an attempt, so
+// jobs stopping their workers also fail after MaxAttempts.
+func (w *Work) runJob(job *orgodb.Job) {
+	atomic.AddInt64(&w.inFlight, 1)
+	defer atomic.AddInt64(&w.inFlight, -1)
+
+	if job.Attempts > w.MaxAttempts {
+		log.Errorf("job %d %s failed after %d attempts", job.ID, job.Kind, w.MaxAttempts)
+		message := fmt.Sprintf("lease expired after %d attempts", w.MaxAttempts)
+		if err := w.db.FailJob(job.ID, job.Lease, message, time.Time{}); err != nil {
+			log.Errorf("fail job %d: %s", job.ID, err.Error())
+		}
+		return
+	}
+
+	// The run stops when the lease is lost, another worker runs the job
+	ctx, cancel := context.WithCancel(w.jobs)
+	defer cancel()
+
+	done := make(chan struct{})
+	defer close(done)
+	go w.heartbeat(job, done, cancel)
+
+	run := w.startRun(job)
+	err := w.doJob(withRun(ctx, run), job)
+	w.finishRun(run, err)
+	if err == nil {
+		if err := w.db.CompleteJob(job.ID, job.Lease); err != nil {
+			log.Errorf("complete job %d: %s", job.ID, err.Error())
+		}
+		return
+	}
+
+	// Jobs interrupted by a shutdown run again from their last checkpoint,
+	// the cursor of a dropbox account or the stored entries of a file.
+	if w.jobs.Err() != nil {
+		log.Infof("job %d %s interrupted: %s", job.ID, job.Kind, err.Error())
+		if err := w.db.ReleaseJob(job.ID, job.Lease); err != nil {
+			log.Errorf("release job %d: %s", job.ID, err.Error())
+		}
+		return
+	}
+
+	// Only transient errors are retried, auth, parse and internal errors fail until fixed
+	var next time.Time
+	if job.Attempts < w.MaxAttempts && classify(err) == orgodb.ErrorTransient {
+		next = time.Now().Add(backoff(job.Attempts))
+	}
+
+	log.Errorf("job %d %s attempt %d: %s", job.ID, job.Kind, job.Attempts, err.Error())
+	if err := w.db.FailJob(job.ID, job.Lease, err.Error(), next); err != nil {
+		log.Errorf("fail job %d: %s", job.ID, err.Error())
+	}
+}
+
+// heartbeat extends the lease of a job until done is closed, the run
+// is cancelled when the lease was lost.
+func (w *Work) heartbeat(job *orgodb.Job, done chan struct{}, cancel context.CancelFunc) {
+	ticker := time.NewTicker(w.Lease / 3)
+	defer ticker.Stop()
+
 	for {
 		select {
-		case entry := <-w.CalendarChan:
-			go w.Calendar(entry)
-		case work := <-w.WorkChan:
-			go w.Process(work)
-		case err := <-w.ErrChan:
-			log.Error(err.Error())
+		case <-done:
+			return
+		case <-ticker.C:
+			err := w.db.HeartbeatJob(job.ID, job.Lease, w.Lease)
+			if err == orgodb.ErrLeaseLost {
+				log.Errorf("job %d lost its lease, stopping", job.ID)
+				cancel()
+				return
+			}
+			if err != nil {
+				log.Errorf("heartbeat job %d: %s", job.ID, err.Error())
+			}
 		}
 	}
 }
+
+// doJob decodes the payload of a job and runs it.
+func (w *Work) doJob(ctx context.Context, job *orgodb.Job) error {
+	switch job.Kind {
+	case orgodb.JobProcess:
+		var accountID string
+		if err := decodePayload(job, &accountID); err != nil {
+			return err
+		}
+		return w.Process(ctx, accountID)
+	case orgodb.JobSync:
+		var file FileEntries
+		if err := decodePayload(job, &file); err != nil {
+			return err
+		}
+		return w.Sync(ctx, file)
+	case orgodb.JobApply:
+		var id int64
+		if err := decodePayload(job, &id); err != nil {
+			return err
+		}
+		return w.ApplyPlan(ctx, id)
+	case orgodb.JobRestore:
+		var id int64
+		if err := decodePayload(job, &id); err != nil {
+			return err
+		}
+		return w.RestoreTrash(ctx, id)
+	case orgodb.JobDisconnect:
+		var d Disconnect
+		if err := decodePayload(job, &d); err != nil {
+			return err
+		}
+		return w.Disconnect(ctx, job.Account, d)
+	}
+	return &PermanentError{Err: fmt.Errorf("unknown job kind %s", job.Kind)}
+}
+
+// decodePayload decodes the payload of a job, a payload that can not be
+// decoded fails the same way on every attempt.
+func decodePayload(job *orgodb.Job, v interface{}) error {
+	if err := json.Unmarshal([]byte(job.Payload), v); err != nil {
+		return &PermanentError{Err: fmt.Errorf("payload of job %d: %s", job.ID, err.Error())}
+	}
+	return nil
+}
+
+// backoff returns the delay before the next attempt of a job,
+// doubling from 30 seconds up to an hour.
+func backoff(attempts int) time.Duration {
+	delay := 30 * time.Second
+	for i := 1; i < attempts && delay < time.Hour; i++ {
+		delay *= 2
+	}
+
+	if delay > time.Hour {
+		return time.Hour
+	}
+	return delay
+}
+
+// purge removes the expired trash, the finished jobs older than a week, the old sync runs and the expired sessions.
+func (w *Work) purge() {
+	if err := w.db.PurgeTrash(time.Now().Add(-w.TrashRetention)); err != nil {
+		log.Errorf("purge trash: %s", err.Error())
+	}
+
+	if err := w.db.PurgeJobs(time.Now().Add(-7 * 24 * time.Hour)); err != nil {
+		log.Errorf("purge jobs: %s", err.Error())
+	}
+
+	if err := w.db.PurgeRuns(time.Now().Add(-runRetention)); err != nil {
+		log.Errorf("purge runs: %s", err.Error())
+	}
+
+	if err := w.db.PurgeSessions(time.Now()); err != nil {
+		log.Errorf("purge sessions: %s", err.Error())
+	}
+}
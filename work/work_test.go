@@ -1,7 +1,1087 @@
 package work
 
-import "testing"
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dropbox/dropbox-sdk-go-unofficial/dropbox/files"
+	orgodb "github.com/rsampaio/orgo/db"
+	"github.com/rsampaio/orgo/org"
+	"golang.org/x/oauth2"
+	"google.golang.org/api/googleapi"
+	tasks "google.golang.org/api/tasks/v1"
+)
 
 func TestProcessFile(t *testing.T) {
+	store := orgodb.NewMemory(nil)
+	w := NewWorker(nil, &oauth2.Config{}, store)
+
+	if err := store.LinkAccount(orgodb.Account{Provider: "dropbox", Account: "dropbox1", UserID: "user1"}); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := store.SaveToken("dropbox", "dropbox1", "", &oauth2.Token{AccessToken: "token"}); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	fake := &fakeDropbox{
+		listed: []files.IsMetadata{
+			&files.FileMetadata{Metadata: files.Metadata{PathLower: "/a.org"}, Id: "id:a"},
+			&files.FileMetadata{Metadata: files.Metadata{PathLower: "/b.txt"}, Id: "id:b"},
+		},
+		contents: map[string]string{"/a.org": "* TODO a\n  SCHEDULED: <2017-13-40 Thu>\n"},
+	}
+	defer func(files func(string) files.Client) { dropboxFiles = files }(dropboxFiles)
+	dropboxFiles = func(string) files.Client { return fake }
+
+	t.Run("List", func(t *testing.T) {
+		run := &orgodb.SyncRun{}
+		if err := w.Process(withRun(context.Background(), run), "dropbox1"); err != nil {
+			t.Fatal(err.Error())
+		}
+
+		// The entry is synced and the broken timestamp recorded as a parse error
+		if len(run.Errors) != 1 || run.Errors[0].Class != orgodb.ErrorParse || run.Errors[0].File != "/a.org" || run.Errors[0].Line != 2 {
+			t.Errorf("run errors %+v, want the parse error of /a.org", run.Errors)
+		}
+
+		if len(fake.downloads) != 1 || fake.downloads[0] != "/a.org" {
+			t.Errorf("downloaded %v, want only the org file", fake.downloads)
+		}
+
+		if cursor, err := store.GetCursor("dropbox1"); err != nil || cursor != "cursor1" {
+			t.Errorf("cursor %q: %v, want the cursor of the listing", cursor, err)
+		}
+
+		file := leaseSync(t, store)
+		if file.FileID != "id:a" || len(file.Entries) != 1 || file.Entries[0].File != "/a.org" || file.Entries[0].FileID != "id:a" {
+			t.Errorf("sync of %+v, want the entries of /a.org", file)
+		}
+	})
+
+	t.Run("Deleted", func(t *testing.T) {
+		if err := store.SaveEntry(&orgodb.OrgEntry{UserID: "user1", FileID: "id:a", File: "/a.org", Title: "* TODO a"}); err != nil {
+			t.Fatal(err.Error())
+		}
+
+		// Changes are listed from the cursor of the previous run
+		fake.changes = []files.IsMetadata{&files.DeletedMetadata{Metadata: files.Metadata{PathLower: "/a.org"}}}
+		if err := w.Process(context.Background(), "dropbox1"); err != nil {
+			t.Fatal(err.Error())
+		}
+
+		if file := leaseSync(t, store); file.FileID != "id:a" || len(file.Entries) != 0 {
+			t.Errorf("sync of %+v, want the entries of /a.org retired", file)
+		}
+
+		if known, err := store.GetFiles("dropbox1"); err != nil || len(known) != 0 {
+			t.Errorf("files %v: %v, want the deleted file forgotten", known, err)
+		}
+
+		if cursor, _ := store.GetCursor("dropbox1"); cursor != "cursor2" {
+			t.Errorf("cursor %q, want the cursor of the changes", cursor)
+		}
+	})
+
+	t.Run("Paging", func(t *testing.T) {
+		// A token expiring while listing the next page needs the user to connect dropbox again
+		fake.pageErr = errors.New("expired_access_token")
+		if err := w.Process(context.Background(), "dropbox1"); classify(err) != orgodb.ErrorAuth {
+			t.Fatalf("listing the next page: %v, want an auth error", err)
+		}
+
+		if token, err := store.GetToken("dropbox", "dropbox1"); err != nil || !token.NeedsConsent {
+			t.Errorf("token %+v: %v, want it needing consent", token, err)
+		}
+	})
+}
+
+// leaseSync leases the next job, a sync, and returns the file it syncs.
+func leaseSync(t *testing.T, store orgodb.Store) FileEntries {
+	job, err := store.LeaseJob(time.Minute)
+	if err != nil || job == nil || job.Kind != orgodb.JobSync {
+		t.Fatalf("job %v: %v, want a sync job", job, err)
+	}
+
+	var file FileEntries
+	if err := json.Unmarshal([]byte(job.Payload), &file); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if err := store.CompleteJob(job.ID, job.Lease); err != nil {
+		t.Fatal(err.Error())
+	}
+	return file
+}
+
+// fakeDropbox lists and downloads the files of a dropbox account from memory,
+// continuing from the cursor of the listing returns the changes.
+type fakeDropbox struct {
+	files.Client
+	listed    []files.IsMetadata
+	changes   []files.IsMetadata
+	contents  map[string]string
+	downloads []string
+	// pageErr fails listing the page after the first one
+	pageErr error
+}
+
+func (f *fakeDropbox) ListFolder(arg *files.ListFolderArg) (*files.ListFolderResult, error) {
+	if f.pageErr != nil {
+		return &files.ListFolderResult{Entries: f.listed, Cursor: "page", HasMore: true}, nil
+	}
+	return &files.ListFolderResult{Entries: f.listed, Cursor: "cursor1"}, nil
+}
+
+func (f *fakeDropbox) ListFolderContinue(arg *files.ListFolderContinueArg) (*files.ListFolderResult, error) {
+	if arg.Cursor == "page" {
+		return nil, f.pageErr
+	}
+	if arg.Cursor != "cursor1" {
+		return nil, errors.New("reset")
+	}
+	return &files.ListFolderResult{Entries: f.changes, Cursor: "cursor2"}, nil
+}
+
+func (f *fakeDropbox) Download(arg *files.DownloadArg) (*files.FileMetadata, io.ReadCloser, error) {
+	f.downloads = append(f.downloads, arg.Path)
+	return &files.FileMetadata{}, ioutil.NopCloser(strings.NewReader(f.contents[arg.Path])), nil
+}
+
+func TestIsOrgFile(t *testing.T) {
+	for path, want := range map[string]bool{
+		"/todo.org":          true,
+		"/work/Notes.ORG":    true,
+		"/photos/a.jpg":      false,
+		"/todo.org.bak":      false,
+		"/archive/org/notes": false,
+	} {
+		if got := isOrgFile(path); got != want {
+			t.Errorf("isOrgFile(%s) = %v, want %v", path, got, want)
+		}
+	}
+}
+
+func TestTasklistFor(t *testing.T) {
+	mappings := []orgodb.TasklistMapping{
+		{Kind: orgodb.MappingFile, Value: "/Work/", Tasklist: "work"},
+		{Kind: orgodb.MappingCategory, Value: "house", Tasklist: "home"},
+		{Kind: orgodb.MappingTag, Value: "urgent", Tasklist: "urgent"},
+	}
+
+	for _, tc := range []struct {
+		entry *orgodb.OrgEntry
+		want  string
+	}{
+		{&orgodb.OrgEntry{File: "/tasks.org"}, "inbox"},
+		{&orgodb.OrgEntry{File: "/work/tasks.org"}, "work"},
+		{&orgodb.OrgEntry{File: "/work/tasks.org", Category: "house"}, "home"},
+		{&orgodb.OrgEntry{File: "/work/tasks.org", Category: "house", Tags: ":a:urgent:"}, "urgent"},
+		{&orgodb.OrgEntry{File: "/tasks.org", Tags: ":urgently:"}, "inbox"},
+	} {
+		if got := tasklistFor(mappings, tc.entry, "inbox"); got != tc.want {
+			t.Errorf("tasklistFor(%+v) = %s, want %s", tc.entry, got, tc.want)
+		}
+	}
+
+	// Entries stored before their tasklist was recorded follow the mappings and settings
+	for _, tc := range []struct {
+		entry *orgodb.OrgEntry
+		want  string
+	}{
+		{&orgodb.OrgEntry{File: "/tasks.org"}, "inbox"},
+		{&orgodb.OrgEntry{File: "/work/tasks.org"}, "work"},
+		{&orgodb.OrgEntry{File: "/work/tasks.org", Tasklist: "home"}, "home"},
+	} {
+		if got := tasklistOf(mappings, tc.entry, "inbox"); got != tc.want {
+			t.Errorf("tasklistOf(%+v) = %s, want %s", tc.entry, got, tc.want)
+		}
+	}
+}
+
+func TestEntryParent(t *testing.T) {
+	content := `* Project
+** TODO Website
+*** TODO Design
+**** TODO Logo
+** Notes
+*** TODO Read
+`
+	doc := org.Parse([]byte(content), time.UTC)
+
+	parents := make(map[string]string)
+	doc.Walk(func(h *org.Heading) {
+		if isEntry(h) {
+			if p := entryParent(h); p != nil {
+				parents[h.Title] = p.Raw
+			}
+		}
+	})
+
+	for title, want := range map[string]string{
+		"Website": "",
+		"Design":  "** TODO Website",
+		"Logo":    "** TODO Website",
+		"Read":    "",
+	} {
+		if parents[title] != want {
+			t.Errorf("parent of %s is %q, want %q", title, parents[title], want)
+		}
+	}
+}
+
+func TestTaskTree(t *testing.T) {
+	tree := newTaskTree([]*tasks.Task{
+		{Id: "b", Position: "2"},
+		{Id: "a", Position: "1"},
+		{Id: "manual", Position: "3"},
+		{Id: "c", Parent: "a", Position: "1"},
+	})
+
+	managed := map[string]bool{"a": true}
+	if !tree.placed("a", "", "", managed) {
+		t.Error("a should be first")
+	}
+
+	managed["b"] = true
+	if !tree.placed("b", "", "a", managed) {
+		t.Error("b should be after a")
+	}
+
+	if tree.placed("c", "", "b", managed) {
+		t.Error("c is a subtask of a")
+	}
+
+	tree.move("c", "", "b")
+	if !tree.placed("c", "", "b", managed) {
+		t.Errorf("c not moved after b: %v", tree)
+	}
+
+	if len(tree["a"]) != 0 || len(tree[""]) != 4 {
+		t.Errorf("unexpected tree after move: %v", tree)
+	}
+}
+
+func TestEntryTask(t *testing.T) {
+	scheduled := time.Date(2017, 7, 20, 0, 0, 0, 0, time.UTC)
+	entry := &orgodb.OrgEntry{Title: "** TODO a", File: "/a.org", Line: 1, Tag: "TODO", Scheduled: scheduled}
+	prefs := preferences{Settings: orgodb.Settings{DoneKeywords: orgodb.DefaultDoneKeywords}, loc: time.UTC}
+
+	task := entryTask(entry, prefs)
+	if task.Status != "needsAction" || task.Completed != nil {
+		t.Errorf("open entry converted to %s task", task.Status)
+	}
+
+	remote := *task
+	remote.Due = "2017-07-20T00:00:00.000Z"
+	if taskChanged(&remote, task) {
+		t.Error("same due date reported as a change")
+	}
+
+	entry.Tag = "DONE"
+	done := entryTask(entry, prefs)
+	if done.Status != "completed" || done.Completed == nil {
+		t.Errorf("done entry converted to %s task", done.Status)
+	}
+
+	if !taskChanged(task, done) {
+		t.Error("completion not reported as a change")
+	}
+
+	// Users choose the keywords completing a task
+	entry.Tag = "CANCELLED"
+	if status := entryTask(entry, prefs).Status; status != "needsAction" {
+		t.Errorf("entry with an unknown keyword converted to %s task", status)
+	}
+
+	cancelled := preferences{Settings: orgodb.Settings{DoneKeywords: orgodb.List{"DONE", "CANCELLED"}}, loc: time.UTC}
+	if status := entryTask(entry, cancelled).Status; status != "completed" {
+		t.Errorf("entry with a done keyword converted to %s task", status)
+	}
+
+	// An entry scheduled late in the evening is due on its local date
+	la, err := time.LoadLocation("America/Los_Angeles")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	entry.Scheduled = time.Date(2017, 7, 20, 22, 0, 0, 0, la)
+	if due := entryTask(entry, preferences{loc: la}).Due; due != "2017-07-20T00:00:00Z" {
+		t.Errorf("due %s, want the date in the user timezone", due)
+	}
+
+	if due := entryTask(entry, preferences{loc: time.UTC}).Due; due != "2017-07-21T00:00:00Z" {
+		t.Errorf("due %s, want the date in UTC", due)
+	}
+}
+
+func TestSameTask(t *testing.T) {
+	for _, tc := range []struct {
+		task  *tasks.Task
+		entry *orgodb.OrgEntry
+		want  bool
+	}{
+		{&tasks.Task{Id: "task1", Title: "a"}, &orgodb.OrgEntry{Title: "b", File: "/a.org", TaskID: "task1"}, true},
+		{&tasks.Task{Id: "task2", Title: "a", Notes: "/a.org:1"}, &orgodb.OrgEntry{Title: "a", File: "/a.org", TaskID: "task1"}, false},
+		{&tasks.Task{Title: "a", Notes: "/a.org:1"}, &orgodb.OrgEntry{Title: "a", File: "/a.org"}, true},
+		{&tasks.Task{Title: "a", Notes: "/b.org:1"}, &orgodb.OrgEntry{Title: "a", File: "/a.org"}, false},
+		{&tasks.Task{Title: "a", Notes: "written by hand"}, &orgodb.OrgEntry{Title: "a", File: "/a.org"}, false},
+		{&tasks.Task{Title: "a"}, &orgodb.OrgEntry{Title: "a"}, true},
+	} {
+		if got := sameTask(tc.task, tc.entry); got != tc.want {
+			t.Errorf("sameTask(%+v, %+v) = %v, want %v", tc.task, tc.entry, got, tc.want)
+		}
+	}
+}
+
+func TestPlanCount(t *testing.T) {
+	plan := &Plan{Changes: []Change{
+		{Action: ActionCreate, Title: "a"},
+		{Action: ActionDelete, Title: "b"},
+		{Action: ActionDelete, Title: "c"},
+	}}
+
+	if plan.Count(ActionDelete) != 2 || plan.Count(ActionUpdate) != 0 {
+		t.Errorf("unexpected counts for %v", plan.Changes)
+	}
+}
+
+func TestGuard(t *testing.T) {
+	w := &Work{DeleteThreshold: 0.5, DeleteMinimum: 1}
+	changes := []Change{
+		{Action: ActionCreate, Title: "a"},
+		{Action: ActionDelete, Title: "b"},
+		{Action: ActionDelete, Title: "c"},
+	}
+
+	t.Run("Below", func(t *testing.T) {
+		plan := &Plan{Changes: changes}
+		if held := w.guard(plan, 10, orgodb.DeletionGuard); held != nil || len(plan.Changes) != 3 {
+			t.Errorf("plan held with 2 of 10 deletions: %v", held)
+		}
+	})
+
+	t.Run("Above", func(t *testing.T) {
+		plan := &Plan{Changes: changes}
+		held := w.guard(plan, 3, orgodb.DeletionGuard)
+		if held == nil || !held.Held || !held.DeletesOnly {
+			t.Fatalf("plan not held with 2 of 3 deletions")
+		}
+
+		if held.Count(ActionDelete) != 2 || len(plan.Changes) != 1 || plan.Count(ActionCreate) != 1 {
+			t.Errorf("deletions not split: held %v, plan %v", held.Changes, plan.Changes)
+		}
+	})
+
+	t.Run("Review", func(t *testing.T) {
+		plan := &Plan{Changes: changes}
+		held := w.guard(plan, 10, orgodb.DeletionReview)
+		if held == nil || held.Count(ActionDelete) != 2 || len(plan.Changes) != 1 {
+			t.Errorf("deletions not held for review: held %v, plan %v", held, plan.Changes)
+		}
+	})
+
+	t.Run("Always", func(t *testing.T) {
+		plan := &Plan{Changes: changes}
+		if held := w.guard(plan, 3, orgodb.DeletionAlways); held != nil || len(plan.Changes) != 3 {
+			t.Errorf("plan held deleting always: %v", held)
+		}
+	})
+
+	t.Run("Keep", func(t *testing.T) {
+		plan := &Plan{Changes: changes}
+		if held := w.guard(plan, 3, orgodb.DeletionKeep); held != nil || plan.Count(ActionDelete) != 0 || len(plan.Changes) != 1 {
+			t.Errorf("deletions not dropped keeping tasks: held %v, plan %v", held, plan.Changes)
+		}
+	})
+
+	t.Run("Moves", func(t *testing.T) {
+		plan := &Plan{Changes: []Change{
+			{Action: ActionCreate, Title: "a"},
+			{Action: ActionMove, Title: "a"},
+			{Action: ActionCreate, Title: "b"},
+			{Action: ActionMove, Title: "b"},
+		}}
+		if held := w.guard(plan, 2, orgodb.DeletionReview); held != nil || plan.Count(ActionMove) != 2 {
+			t.Errorf("moves held with the deletions: held %v, plan %v", held, plan.Changes)
+		}
+	})
+}
+
+func TestPreferences(t *testing.T) {
+	store := orgodb.NewMemory(nil)
+	w := NewWorker(nil, nil, store)
+
+	user, err := store.SignIn("google1", "user@example.com", "User")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	t.Run("Defaults", func(t *testing.T) {
+		prefs, err := w.preferences(user.ID)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+
+		if prefs.loc != time.UTC || prefs.Tasklist != orgodb.DefaultTasklist || !prefs.done(&orgodb.OrgEntry{Tag: "DONE"}) {
+			t.Errorf("preferences %+v in %s, want the defaults in UTC", prefs.Settings, prefs.loc)
+		}
+	})
+
+	t.Run("Saved", func(t *testing.T) {
+		settings := orgodb.Settings{UserID: user.ID, Timezone: "America/Los_Angeles", DoneKeywords: orgodb.List{"CANCELLED"}}
+		if err := store.SaveSettings(settings); err != nil {
+			t.Fatal(err.Error())
+		}
+
+		prefs, err := w.preferences(user.ID)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+
+		if prefs.loc.String() != "America/Los_Angeles" {
+			t.Errorf("preferences in %s, want the timezone of the user", prefs.loc)
+		}
+
+		if prefs.done(&orgodb.OrgEntry{Tag: "DONE"}) || !prefs.done(&orgodb.OrgEntry{Tag: "CANCELLED"}) {
+			t.Errorf("done keywords %v, want the saved ones", prefs.DoneKeywords)
+		}
+	})
+
+	t.Run("UnknownTimezone", func(t *testing.T) {
+		if err := store.SetTimezone(user.ID, "Nowhere/Town"); err != nil {
+			t.Fatal(err.Error())
+		}
+
+		if prefs, err := w.preferences(user.ID); err != nil || prefs.loc != time.UTC {
+			t.Errorf("preferences in %s: %v, want UTC", prefs.loc, err)
+		}
+	})
+}
+
+func TestRetireEntries(t *testing.T) {
+	store := orgodb.NewMemory(nil)
+	w := NewWorker(nil, nil, store)
+
+	if err := store.LinkAccount(orgodb.Account{Provider: "dropbox", Account: "dropbox1", UserID: "user1"}); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// A file without entries has nothing to remove from google tasks
+	if err := w.retireEntries("dropbox1", "id:empty"); err != nil {
+		t.Fatal(err.Error())
+	}
+	if queued := w.Stats().Queued; queued != 0 {
+		t.Fatalf("%d jobs queued retiring a file without entries", queued)
+	}
+
+	if err := store.SaveEntry(&orgodb.OrgEntry{UserID: "user1", FileID: "id:file1", Title: "** TODO a"}); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if err := w.retireEntries("dropbox1", "id:file1"); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	job, err := store.LeaseJob(time.Minute)
+	if err != nil || job == nil {
+		t.Fatalf("job %v: %v, want a sync job", job, err)
+	}
+
+	var file FileEntries
+	if err := json.Unmarshal([]byte(job.Payload), &file); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if job.Kind != orgodb.JobSync || job.Account != "user1" || file.FileID != "id:file1" || len(file.Entries) != 0 {
+		t.Errorf("job %s of %s syncing %+v, want a sync of the file without entries", job.Kind, job.Account, file)
+	}
+
+	// Retiring the entries of an account of no user fails
+	if err := w.retireEntries("dropbox2", "id:file1"); err == nil {
+		t.Error("entries of an unknown account retired")
+	}
+}
+
+func TestRuns(t *testing.T) {
+	store := orgodb.NewMemory(nil)
+	w := NewWorker(nil, nil, store)
+
+	run := w.startRun(&orgodb.Job{ID: 1, Kind: orgodb.JobSync, Account: "user1"})
+	run.File = "/todo.org"
+	w.finishRun(run, &FileError{Line: 3, Err: errors.New("bad")})
+
+	runs, err := store.GetRuns("user1", 10)
+	if err != nil || len(runs) != 1 {
+		t.Fatalf("runs %v: %v", runs, err)
+	}
+
+	if runs[0].Status != orgodb.RunFailed || len(runs[0].Errors) != 1 || runs[0].Errors[0].File != "/todo.org" {
+		t.Errorf("run %+v, want it failed with the error in its file", runs[0])
+	}
+}
+
+func TestRunJob(t *testing.T) {
+	store := orgodb.NewMemory(nil)
+	w := NewWorker(nil, nil, store)
+	w.MaxAttempts = 2
+
+	id, err := store.EnqueueJob(orgodb.JobProcess, "user1", "dropbox1", "dropbox1")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// A job stopping its workers is taken again each time its lease expires
+	var job *orgodb.Job
+	for i := 0; i <= w.MaxAttempts; i++ {
+		if job, err = store.LeaseJob(-time.Second); err != nil || job == nil {
+			t.Fatalf("job %v: %v, want the job leased again", job, err)
+		}
+	}
+
+	w.runJob(job)
+	if failed, err := store.GetJob(id); err != nil || failed.Status != orgodb.JobFailed {
+		t.Errorf("job %+v: %v, want it failed after %d attempts", failed, err, w.MaxAttempts)
+	}
+}
+
+func TestTasksService(t *testing.T) {
+	// A user without a google account connects it again
+	w := NewWorker(nil, nil, orgodb.NewMemory(nil))
+	if _, err := w.tasksService(context.Background(), "user1"); classify(err) != orgodb.ErrorAuth {
+		t.Errorf("tasks service without an account: %v, want an auth error", err)
+	}
+
+	// Failing to read the account is retried
+	w = NewWorker(nil, nil, failingStore{orgodb.NewMemory(nil)})
+	if _, err := w.tasksService(context.Background(), "user1"); classify(err) != orgodb.ErrorTransient {
+		t.Errorf("tasks service failing to read the account: %v, want a transient error", err)
+	}
+}
+
+// failingStore fails reading the accounts of the users.
+type failingStore struct {
+	orgodb.Store
+}
+
+func (failingStore) GetAccountID(userID, provider string) (string, error) {
+	return "", errors.New("connection refused")
+}
+
+func TestBackoff(t *testing.T) {
+	for attempts, want := range map[int]time.Duration{
+		1:  30 * time.Second,
+		2:  time.Minute,
+		4:  4 * time.Minute,
+		20: time.Hour,
+	} {
+		if got := backoff(attempts); got != want {
+			t.Errorf("backoff(%d) = %s, want %s", attempts, got, want)
+		}
+	}
+}
+
+func TestClassify(t *testing.T) {
+	for _, tc := range []struct {
+		err   error
+		class string
+	}{
+		{errors.New("connection reset"), orgodb.ErrorTransient},
+		{&googleapi.Error{Code: 503}, orgodb.ErrorTransient},
+		{&googleapi.Error{Code: 401}, orgodb.ErrorAuth},
+		{&AuthError{Provider: "google", Err: errors.New("no token")}, orgodb.ErrorAuth},
+		{&PermanentError{Err: errors.New("plan 1 is applied")}, orgodb.ErrorInternal},
+		{errors.New(`path/invalid_access_token/`), orgodb.ErrorAuth},
+		{&FileError{File: "/todo.org", Line: 2, Err: org.Diagnostic{Line: 2, Severity: org.SeverityError, Message: "bad timestamp"}}, orgodb.ErrorParse},
+		{&PermanentError{Err: &json.SyntaxError{}}, orgodb.ErrorInternal},
+	} {
+		if class := classify(tc.err); class != tc.class {
+			t.Errorf("classify(%v) = %s, want %s", tc.err, class, tc.class)
+		}
+	}
+
+	e := syncError(&FileError{File: "/todo.org", Line: 3, Err: errors.New("bad")})
+	if e.File != "/todo.org" || e.Line != 3 || e.Message != "bad" {
+		t.Errorf("sync error %v, want file and line", e)
+	}
+}
+
+func TestSync(t *testing.T) {
+	w, store := syncWorker(t)
+	fake, ctx, done := newFakeTasks()
+	defer done()
+
+	entries := func(file string, titles ...string) []*orgodb.OrgEntry {
+		var entries []*orgodb.OrgEntry
+		for i, title := range titles {
+			entries = append(entries, &orgodb.OrgEntry{UserID: "user1", FileID: "id:file1", File: file, Line: i + 1, Title: title})
+		}
+		return entries
+	}
+
+	t.Run("Rename", func(t *testing.T) {
+		if err := w.Sync(ctx, FileEntries{UserID: "user1", FileID: "id:file1", Entries: entries("/a.org", "** TODO a", "** TODO b")}); err != nil {
+			t.Fatal(err.Error())
+		}
+
+		list := fake.lookup("orgo")
+		created := fake.list(list.Id)
+		if len(created) != 2 {
+			t.Fatalf("tasks %v, want a task per entry", titles(created))
+		}
+
+		if err := w.Sync(ctx, FileEntries{UserID: "user1", FileID: "id:file1", Entries: entries("/b.org", "** TODO a", "** TODO b")}); err != nil {
+			t.Fatal(err.Error())
+		}
+
+		renamed := fake.list(list.Id)
+		if len(renamed) != 2 {
+			t.Fatalf("tasks %v, want the tasks of the renamed file updated", titles(renamed))
+		}
+
+		for i := range renamed {
+			if renamed[i].Id != created[i].Id || taskFile(renamed[i]) != "/b.org" {
+				t.Errorf("task %s of %s, want task %s updated to /b.org", renamed[i].Id, taskFile(renamed[i]), created[i].Id)
+			}
+		}
+
+		stored, err := store.GetFileEntries("user1", "id:file1")
+		if err != nil || len(stored) != 2 || stored[0].TaskID != created[0].Id {
+			t.Errorf("entries %v: %v, want the entries with their tasks", stored, err)
+		}
+	})
+
+	t.Run("AdoptedList", func(t *testing.T) {
+		if err := store.SaveMapping(orgodb.TasklistMapping{UserID: "user1", Kind: orgodb.MappingFile, Value: "/work/", Tasklist: "Work"}); err != nil {
+			t.Fatal(err.Error())
+		}
+
+		// The tasks added by hand to a tasklist of the user are left alone
+		list := fake.addList("Work")
+		fake.addTask(list.Id, &tasks.Task{Title: "** TODO a", Notes: "written by hand"})
+		fake.addTask(list.Id, &tasks.Task{Title: "call the bank"})
+
+		work := FileEntries{UserID: "user1", FileID: "id:file2", Entries: entries("/work/w.org", "** TODO a")}
+		work.Entries[0].FileID = "id:file2"
+		if err := w.Sync(ctx, work); err != nil {
+			t.Fatal(err.Error())
+		}
+
+		synced := fake.list(list.Id)
+		if len(synced) != 3 || synced[0].Notes != "written by hand" || taskFile(synced[2]) != "/work/w.org" {
+			t.Fatalf("tasks %v, want the tasks added by hand and the task of the entry", titles(synced))
+		}
+
+		if err := w.Sync(ctx, FileEntries{UserID: "user1", FileID: "id:file2"}); err != nil {
+			t.Fatal(err.Error())
+		}
+
+		if left := fake.list(list.Id); len(left) != 2 || left[0].Notes != "written by hand" || left[1].Title != "call the bank" {
+			t.Errorf("tasks %v, want only the task of the entry deleted", titles(left))
+		}
+	})
+
+	t.Run("Held", func(t *testing.T) {
+		file := FileEntries{UserID: "user1", FileID: "id:file3", Entries: entries("/c.org", "** TODO c", "** TODO d", "** TODO e", "** TODO f")}
+		for _, entry := range file.Entries {
+			entry.FileID = "id:file3"
+		}
+		if err := w.Sync(ctx, file); err != nil {
+			t.Fatal(err.Error())
+		}
+
+		list := fake.lookup("orgo")
+		synced := len(fake.list(list.Id))
+
+		// Emptying the file deletes more tasks than the guard allows
+		if err := w.Sync(ctx, FileEntries{UserID: "user1", FileID: "id:file3"}); err != nil {
+			t.Fatal(err.Error())
+		}
+
+		plans, err := store.GetPendingPlans("user1")
+		if err != nil || len(plans) != 1 {
+			t.Fatalf("plans %v: %v, want the deletions held", plans, err)
+		}
+
+		stored, err := store.GetFileEntries("user1", "id:file3")
+		if err != nil || len(stored) != 4 {
+			t.Fatalf("entries %v: %v, want the entries of the held deletions kept", stored, err)
+		}
+
+		// Syncing another file keeps the tasks of the held deletions
+		if err := w.Sync(ctx, FileEntries{UserID: "user1", FileID: "id:file1", Entries: entries("/b.org", "** TODO a", "** TODO b")}); err != nil {
+			t.Fatal(err.Error())
+		}
+
+		if n := len(fake.list(list.Id)); n != synced {
+			t.Fatalf("%d tasks after syncing another file, want %d", n, synced)
+		}
+
+		if err := w.ApplyPlan(ctx, plans[0].ID); err != nil {
+			t.Fatal(err.Error())
+		}
+
+		if n := len(fake.list(list.Id)); n != synced-4 {
+			t.Errorf("%d tasks after applying the held plan, want %d", n, synced-4)
+		}
+
+		// Applying a plan again or a plan that does not exist is not retried
+		for _, id := range []int64{plans[0].ID, plans[0].ID + 100} {
+			if err := w.ApplyPlan(ctx, id); classify(err) != orgodb.ErrorInternal {
+				t.Errorf("applying plan %d: %v, want an internal error", id, err)
+			}
+		}
+
+		if stored, err := store.GetFileEntries("user1", "id:file3"); err != nil || len(stored) != 0 {
+			t.Errorf("entries %v: %v, want the entries of the deletions dropped", stored, err)
+		}
+	})
+
+	t.Run("Restore", func(t *testing.T) {
+		trash, err := store.GetTrash("user1")
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+
+		restore := make(map[string]int64)
+		for _, trashed := range trash {
+			restore[trashed.Title] = trashed.ID
+		}
+
+		// The entry added back to its file already has its task again
+		file := FileEntries{UserID: "user1", FileID: "id:file3", Entries: entries("/c.org", "** TODO c")}
+		file.Entries[0].FileID = "id:file3"
+		if err := w.Sync(ctx, file); err != nil {
+			t.Fatal(err.Error())
+		}
+
+		for _, title := range []string{"** TODO c", "** TODO d"} {
+			if err := w.RestoreTrash(ctx, restore[title]); err != nil {
+				t.Fatal(err.Error())
+			}
+		}
+
+		count := make(map[string]int)
+		for _, task := range fake.list(fake.lookup("orgo").Id) {
+			count[task.Title]++
+		}
+
+		if count["** TODO c"] != 1 || count["** TODO d"] != 1 {
+			t.Errorf("tasks %v, want a single task of each restored entry", count)
+		}
+	})
+
+	t.Run("Remapped", func(t *testing.T) {
+		file := FileEntries{UserID: "user1", FileID: "id:file5", Entries: entries("/errands.org", "** TODO g", "** TODO h", "** TODO i", "** TODO j")}
+		for _, entry := range file.Entries {
+			entry.FileID = "id:file5"
+		}
+		if err := w.Sync(ctx, file); err != nil {
+			t.Fatal(err.Error())
+		}
+
+		list := fake.lookup("orgo")
+		synced := len(fake.list(list.Id))
+
+		// Mapping the file to another tasklist moves more tasks than the guard allows
+		if err := store.SaveMapping(orgodb.TasklistMapping{UserID: "user1", Kind: orgodb.MappingFile, Value: "/errands.org", Tasklist: "Errands"}); err != nil {
+			t.Fatal(err.Error())
+		}
+		if err := w.Sync(ctx, file); err != nil {
+			t.Fatal(err.Error())
+		}
+
+		if plans, err := store.GetPendingPlans("user1"); err != nil || len(plans) != 0 {
+			t.Fatalf("plans %v: %v, want the moves applied", plans, err)
+		}
+
+		if n := len(fake.list(list.Id)); n != synced-4 {
+			t.Errorf("%d tasks left in orgo, want %d", n, synced-4)
+		}
+
+		if moved := fake.list(fake.lookup("Errands").Id); len(moved) != 4 {
+			t.Errorf("tasks %v, want the tasks of the file in Errands", titles(moved))
+		}
+	})
+
+	t.Run("RepeatedHeadings", func(t *testing.T) {
+		content := "* TODO call mom\n* TODO call mom\n** TODO buy flowers\n"
+		parsed, _ := w.ParseEntries([]byte(content), "user1", time.UTC, nil)
+		for _, entry := range parsed {
+			entry.FileID, entry.File = "id:file4", "/d.org"
+		}
+
+		if parsed[2].Parent != parsed[1].Key {
+			t.Fatalf("parent %q, want the key %q of the repeated heading", parsed[2].Parent, parsed[1].Key)
+		}
+
+		list := fake.lookup("orgo")
+		before := len(fake.list(list.Id))
+
+		file := FileEntries{UserID: "user1", FileID: "id:file4", Entries: parsed}
+		if err := w.Sync(ctx, file); err != nil {
+			t.Fatal(err.Error())
+		}
+
+		synced := fake.list(list.Id)
+		if len(synced) != before+3 {
+			t.Fatalf("tasks %v, want a task per entry", titles(synced))
+		}
+
+		stored, err := store.GetFileEntries("user1", "id:file4")
+		if err != nil || len(stored) != 3 || stored[0].TaskID == stored[1].TaskID {
+			t.Fatalf("entries %v: %v, want each repeated heading with its task", stored, err)
+		}
+
+		if err := w.Sync(ctx, file); err != nil {
+			t.Fatal(err.Error())
+		}
+
+		if resynced := fake.list(list.Id); len(resynced) != len(synced) {
+			t.Errorf("tasks %v, want the tasks of the repeated headings kept", titles(resynced))
+		}
+	})
+}
+
+func TestDisconnect(t *testing.T) {
+	w, store := syncWorker(t)
+	fake, ctx, done := newFakeTasks()
+	defer done()
+
+	if err := store.SaveMapping(orgodb.TasklistMapping{UserID: "user1", Kind: orgodb.MappingFile, Value: "/work/", Tasklist: "Work"}); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	for _, file := range []orgodb.DropboxFile{
+		{Account: "dropbox1", FileID: "id:a1", Path: "/a.org"},
+		{Account: "dropbox1", FileID: "id:a2", Path: "/work/a.org"},
+		{Account: "dropbox2", FileID: "id:b1", Path: "/b.org"},
+	} {
+		if err := store.LinkAccount(orgodb.Account{Provider: "dropbox", Account: file.Account, UserID: "user1"}); err != nil {
+			t.Fatal(err.Error())
+		}
+		if err := store.SaveFile(file); err != nil {
+			t.Fatal(err.Error())
+		}
+
+		entry := &orgodb.OrgEntry{UserID: "user1", FileID: file.FileID, File: file.Path, Line: 1, Title: "** TODO " + file.FileID}
+		if err := w.Sync(ctx, FileEntries{UserID: "user1", FileID: file.FileID, Entries: []*orgodb.OrgEntry{entry}}); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	// Removing the tasklists of an account keeps the tasks of the other one
+	if err := w.Disconnect(ctx, "user1", Disconnect{Provider: "dropbox", Account: "dropbox1", RemoveTasklists: true}); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if fake.lookup("Work") != nil {
+		t.Error("tasklist of the files of dropbox1 kept")
+	}
+
+	list := fake.lookup("orgo")
+	if list == nil {
+		t.Fatal("tasklist of the files of dropbox2 removed")
+	}
+
+	if left := fake.list(list.Id); len(left) != 1 || left[0].Title != "** TODO id:b1" {
+		t.Errorf("tasks %v, want only the task of dropbox2", titles(left))
+	}
+
+	stored, err := store.GetEntries("user1")
+	if err != nil || len(stored) != 1 || stored[0].FileID != "id:b1" {
+		t.Errorf("entries %v: %v, want only the entries of dropbox2", stored, err)
+	}
+
+	if accounts, err := store.GetAccounts("user1", "dropbox"); err != nil || len(accounts) != 1 || accounts[0].Account != "dropbox2" {
+		t.Errorf("accounts %v: %v, want dropbox2 linked", accounts, err)
+	}
+}
+
+// syncWorker returns a worker syncing the files of user1 to its google account.
+func syncWorker(t *testing.T) (*Work, *orgodb.Memory) {
+	store := orgodb.NewMemory(nil)
+	w := NewWorker(&oauth2.Config{}, &oauth2.Config{}, store)
+
+	if err := store.LinkAccount(orgodb.Account{Provider: "google", Account: "google1", UserID: "user1"}); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if err := store.SaveToken("google", "google1", "", &oauth2.Token{AccessToken: "token"}); err != nil {
+		t.Fatal(err.Error())
+	}
+	return w, store
+}
+
+// fakeTasks serves the tasklists and tasks of the google tasks api from memory.
+type fakeTasks struct {
+	mu    sync.Mutex
+	next  int
+	lists []*tasks.TaskList
+	tasks map[string][]*tasks.Task
+}
+
+// newFakeTasks starts a fake google tasks api, the context sends the
+// requests of the tasks services created with it to the fake.
+func newFakeTasks() (*fakeTasks, context.Context, func()) {
+	fake := &fakeTasks{tasks: make(map[string][]*tasks.Task)}
+	ts := httptest.NewServer(fake)
+
+	client := &http.Client{Transport: fakeTransport(ts.Listener.Addr().String())}
+	return fake, context.WithValue(context.Background(), oauth2.HTTPClient, client), ts.Close
+}
+
+// fakeTransport sends every request to host.
+type fakeTransport string
+
+func (host fakeTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	u := *req.URL
+	u.Scheme, u.Host = "http", string(host)
+
+	r := req.WithContext(req.Context())
+	r.URL = &u
+	return http.DefaultTransport.RoundTrip(r)
+}
+
+func (f *fakeTasks) addList(title string) *tasks.TaskList {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.next++
+	list := &tasks.TaskList{Id: fmt.Sprintf("list%d", f.next), Title: title}
+	f.lists = append(f.lists, list)
+	return list
+}
+
+func (f *fakeTasks) addTask(listID string, task *tasks.Task) *tasks.Task {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.next++
+	task.Id = fmt.Sprintf("task%d", f.next)
+	task.Position = fmt.Sprintf("%08d", f.next)
+	f.tasks[listID] = append(f.tasks[listID], task)
+	return task
+}
+
+// list returns the tasks of a tasklist in the order they were added.
+func (f *fakeTasks) list(listID string) []*tasks.Task {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]*tasks.Task{}, f.tasks[listID]...)
+}
+
+// lookup returns the tasklist of a title.
+func (f *fakeTasks) lookup(title string) *tasks.TaskList {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, list := range f.lists {
+		if list.Title == title {
+			return list
+		}
+	}
+	return nil
+}
+
+func (f *fakeTasks) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	var (
+		path   = strings.Split(strings.TrimPrefix(req.URL.Path, "/tasks/v1/"), "/")
+		result interface{}
+		found  = true
+	)
+
+	switch {
+	case len(path) == 3 && path[0] == "users" && req.Method == "GET":
+		f.mu.Lock()
+		result = &tasks.TaskLists{Items: f.lists}
+		f.mu.Unlock()
+	case len(path) == 3 && path[0] == "users" && req.Method == "POST":
+		var list tasks.TaskList
+		json.NewDecoder(req.Body).Decode(&list)
+		result = f.addList(list.Title)
+	case len(path) == 4 && path[0] == "users" && req.Method == "DELETE":
+		found = f.deleteList(path[3])
+	case len(path) == 3 && req.Method == "GET":
+		result = &tasks.Tasks{Items: f.list(path[1])}
+	case len(path) == 3 && req.Method == "POST":
+		var task tasks.Task
+		json.NewDecoder(req.Body).Decode(&task)
+		task.Parent = req.URL.Query().Get("parent")
+		result = f.addTask(path[1], &task)
+	case len(path) == 4 && req.Method == "PUT":
+		var task tasks.Task
+		json.NewDecoder(req.Body).Decode(&task)
+		result, found = f.update(path[1], path[3], func(current *tasks.Task) {
+			position, parent := current.Position, current.Parent
+			*current = task
+			current.Id, current.Position, current.Parent = path[3], position, parent
+		})
+	case len(path) == 5 && path[4] == "move":
+		result, found = f.update(path[1], path[3], func(current *tasks.Task) {
+			current.Parent = req.URL.Query().Get("parent")
+		})
+	case len(path) == 4 && req.Method == "DELETE":
+		_, found = f.update(path[1], path[3], nil)
+	default:
+		found = false
+	}
+
+	if !found {
+		http.Error(rw, "not found", http.StatusNotFound)
+		return
+	}
+	json.NewEncoder(rw).Encode(result)
+}
+
+// update calls change with a task of a tasklist, a nil change deletes the task.
+func (f *fakeTasks) update(listID, taskID string, change func(*tasks.Task)) (*tasks.Task, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for i, task := range f.tasks[listID] {
+		if task.Id != taskID {
+			continue
+		}
+
+		if change == nil {
+			f.tasks[listID] = append(f.tasks[listID][:i:i], f.tasks[listID][i+1:]...)
+		} else {
+			change(task)
+		}
+		return task, true
+	}
+	return nil, false
+}
+
+func (f *fakeTasks) deleteList(listID string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for i, list := range f.lists {
+		if list.Id == listID {
+			f.lists = append(f.lists[:i:i], f.lists[i+1:]...)
+			delete(f.tasks, listID)
+			return true
+		}
+	}
+	return false
+}
 
+// titles returns the titles of tasks.
+func titles(items []*tasks.Task) []string {
+	var titles []string
+	for _, task := range items {
+		titles = append(titles, task.Title)
+	}
+	return titles
 }